@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditMemoryRecords is how many recent records are kept for /admin/audit
+const auditMemoryRecords = 1000
+
+// AuditRecord describes one upstream call made for an experiment
+type AuditRecord struct {
+	ID         string      `json:"id"`
+	Time       time.Time   `json:"time"`
+	Experiment string      `json:"experiment"`
+	Variant    string      `json:"variant"`
+	Shadow     bool        `json:"shadow,omitempty"`
+	Client     string      `json:"client,omitempty"`
+	Alias      string      `json:"alias"`
+	Model      ModelID     `json:"model"`
+	Backend    string      `json:"backend,omitempty"`
+	LatencyMS  int64       `json:"latency_ms"`
+	Usage      ClaudeUsage `json:"usage"`
+	Output     string      `json:"output,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// AuditStore appends records to a JSON Lines file for offline analysis and
+// keeps the most recent ones in memory
+type AuditStore struct {
+	mu      sync.Mutex
+	file    *os.File
+	records []AuditRecord
+}
+
+// NewAuditStore opens the audit file for appending. An empty path keeps
+// records in memory only.
+func NewAuditStore(path string) (*AuditStore, error) {
+	store := &AuditStore{}
+	if path == "" {
+		return store, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	store.file = file
+	return store, nil
+}
+
+// Record stores a record
+func (a *AuditStore) Record(rec AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.records = append(a.records, rec)
+	if len(a.records) > auditMemoryRecords {
+		a.records = a.records[len(a.records)-auditMemoryRecords:]
+	}
+
+	if a.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return nil
+}
+
+// Close closes the audit file. Records made after Close are kept in memory
+// only.
+func (a *AuditStore) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// Recent returns up to limit of the most recent records, oldest first,
+// optionally only those for one experiment
+func (a *AuditStore) Recent(experiment string, limit int) []AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	records := []AuditRecord{}
+	for i := len(a.records) - 1; i >= 0 && len(records) < limit; i-- {
+		if experiment == "" || a.records[i].Experiment == experiment {
+			records = append(records, a.records[i])
+		}
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records
+}
+
+// clientLabel identifies a client key in records without storing the key
+func clientLabel(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// Handle GET /admin/audit, optionally filtered by ?experiment= and limited
+// by ?limit=
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeOllamaError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Records []AuditRecord `json:"records"`
+	}{s.audit.Recent(r.URL.Query().Get("experiment"), limit)})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Backend sends Messages API requests to Claude through one provider. The
+// translation layer only ever deals in ClaudeRequest and ClaudeResponse;
+// each backend takes care of authentication, URLs and wire format.
+type Backend interface {
+	// Name identifies the backend in logs and configuration
+	Name() string
+
+	// Send makes a request and waits for the whole response
+	Send(ctx context.Context, req ClaudeRequest) (*ClaudeResponse, error)
+
+	// Stream makes a streaming request, calling onText with each piece of
+	// text as it arrives, and returns the assembled response at the end
+	Stream(ctx context.Context, req ClaudeRequest, onText func(string) error) (*ClaudeResponse, error)
+}
+
+// Backend types
+const (
+	BackendAnthropic = "anthropic"
+	BackendBedrock   = "bedrock"
+	BackendVertex    = "vertex"
+)
+
+// BackendConfig configures a named backend. Which fields apply depends on
+// Type.
+type BackendConfig struct {
+	Type string `json:"type"`
+
+	// Endpoint overrides the provider's base URL, e.g. for a VPC endpoint
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Region is the AWS region for Bedrock or the Google Cloud location
+	// for Vertex AI
+	Region string `json:"region,omitempty"`
+
+	// ModelIDs overrides the provider model ID for a Claude model ID
+	ModelIDs map[string]string `json:"model_ids,omitempty"`
+
+	// Bedrock credentials; the AWS_* environment variables are used when
+	// these are empty. Each can instead be read from a file.
+	AccessKeyID         string `json:"access_key_id,omitempty"`
+	AccessKeyIDFile     string `json:"access_key_id_file,omitempty"`
+	SecretAccessKey     string `json:"secret_access_key,omitempty"`
+	SecretAccessKeyFile string `json:"secret_access_key_file,omitempty"`
+	SessionToken        string `json:"session_token,omitempty"`
+	SessionTokenFile    string `json:"session_token_file,omitempty"`
+
+	// Vertex AI project and service-account credentials file
+	ProjectID       string `json:"project_id,omitempty"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+
+	// Model replaces the requested model when forwarding to Ollama
+	Model string `json:"model,omitempty"`
+}
+
+// buildBackends creates every configured backend plus the default Anthropic
+// backend, which is always available as "anthropic"
+func buildBackends(config Config, keys *KeyPool, client *http.Client) (map[string]Backend, error) {
+	backends := map[string]Backend{
+		BackendAnthropic: NewAnthropicBackend(BackendAnthropic, config.APIEndpoint, config.APIVersion, keys, client),
+	}
+
+	for name, bc := range config.Backends {
+		var backend Backend
+		var err error
+
+		switch bc.Type {
+		case BackendAnthropic:
+			endpoint := bc.Endpoint
+			if endpoint == "" {
+				endpoint = config.APIEndpoint
+			}
+			backend = NewAnthropicBackend(name, endpoint, config.APIVersion, keys, client)
+		case BackendBedrock:
+			backend, err = NewBedrockBackend(name, bc, client)
+		case BackendVertex:
+			backend, err = NewVertexBackend(name, bc, client)
+		case BackendOllama:
+			// Ollama upstreams are not Claude backends; see buildOllamaUpstreams
+			continue
+		default:
+			err = fmt.Errorf("unknown type %q", bc.Type)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("backend %q: %w", name, err)
+		}
+		backends[name] = backend
+	}
+
+	return backends, nil
+}
+
+// backendFor returns the backend serving an alias
+func (s *Server) backendFor(alias string) Backend {
+	if backend, ok := s.backends[backendName(s.config, alias)]; ok {
+		return backend
+	}
+	return s.backends[BackendAnthropic]
+}
+
+// backendName returns the name of the backend configured for an alias
+func backendName(config Config, alias string) string {
+	alias = normalizeModelName(alias)
+	for model, mapped := range config.ModelBackends {
+		if normalizeModelName(model) == alias {
+			return mapped
+		}
+	}
+	return config.DefaultBackend
+}
+
+// Call Claude through the backend serving the request's alias
+func (s *Server) callClaudeAPI(ctx context.Context, claudeReq ClaudeRequest) (*ClaudeResponse, error) {
+	return s.backendFor(requestInfoFrom(ctx).Alias).Send(ctx, claudeReq)
+}
+
+// providerBody converts a request into the body Bedrock and Vertex expect:
+// the Messages API body without "model" and with their anthropic_version
+func providerBody(req ClaudeRequest, anthropicVersion string, keepStream bool) ([]byte, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+	delete(body, "model")
+	if !keepStream {
+		delete(body, "stream")
+	}
+	body["anthropic_version"] = anthropicVersion
+
+	return json.Marshal(body)
+}
+
+// upstreamError is returned for non-2xx upstream responses so that callers
+// can react to the status code
+type upstreamError struct {
+	Provider string
+	Status   int
+	Header   http.Header
+	Body     string
+}
+
+func (e *upstreamError) Error() string {
+	if e.Provider == BackendAnthropic {
+		return fmt.Sprintf("claude API returned status %d: %s", e.Status, e.Body)
+	}
+	return fmt.Sprintf("%s returned status %d: %s", e.Provider, e.Status, e.Body)
+}
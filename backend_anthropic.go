@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AnthropicBackend calls the Anthropic Messages API with keys from the pool,
+// failing over to another key when one is rate limited or rejected
+type AnthropicBackend struct {
+	name     string
+	endpoint string
+	version  string
+	keys     *KeyPool
+	client   *http.Client
+}
+
+// NewAnthropicBackend creates a backend for the Anthropic API
+func NewAnthropicBackend(name, endpoint, version string, keys *KeyPool, client *http.Client) *AnthropicBackend {
+	return &AnthropicBackend{
+		name:     name,
+		endpoint: endpoint,
+		version:  version,
+		keys:     keys,
+		client:   client,
+	}
+}
+
+// Name implements Backend
+func (b *AnthropicBackend) Name() string {
+	return b.name
+}
+
+// Send implements Backend
+func (b *AnthropicBackend) Send(ctx context.Context, req ClaudeRequest) (*ClaudeResponse, error) {
+	req.Stream = false
+	httpResp, key, err := b.open(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	// Parse the response
+	var claudeResp ClaudeResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&claudeResp); err != nil {
+		b.keys.Report(key, httpResp.StatusCode, httpResp.Header, ClaudeUsage{})
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	b.keys.Report(key, httpResp.StatusCode, httpResp.Header, claudeResp.Usage)
+	return &claudeResp, nil
+}
+
+// Check implements healthChecker by listing one model, which costs no
+// tokens but needs a working key
+func (b *AnthropicBackend) Check(ctx context.Context) error {
+	key, err := b.keys.Pick(requestInfoFrom(ctx), nil)
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(b.endpoint, "/messages") + "/models?limit=1"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Api-Key", key.key)
+	req.Header.Set("Anthropic-Version", b.version)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call Claude API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return &upstreamError{Provider: BackendAnthropic, Status: resp.StatusCode, Header: resp.Header, Body: string(bodyBytes)}
+	}
+	return nil
+}
+
+// CountTokens implements tokenCounter with the count_tokens endpoint, which
+// costs no tokens
+func (b *AnthropicBackend) CountTokens(ctx context.Context, req ClaudeRequest) (int, error) {
+	key, err := b.keys.Pick(requestInfoFrom(ctx), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	reqBody, err := json.Marshal(struct {
+		Model    ModelID   `json:"model"`
+		Messages []Message `json:"messages"`
+		System   string    `json:"system,omitempty"`
+	}{req.Model, req.Messages, req.System})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	resp, err := b.send(ctx, b.endpoint+"/count_tokens", key.key, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var count struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&count); err != nil {
+		return 0, fmt.Errorf("failed to decode token count: %w", err)
+	}
+	return count.InputTokens, nil
+}
+
+// Stream implements Backend
+func (b *AnthropicBackend) Stream(ctx context.Context, req ClaudeRequest, onText func(string) error) (*ClaudeResponse, error) {
+	req.Stream = true
+	httpResp, key, err := b.open(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	acc := newStreamAccumulator(onText)
+	err = readSSE(httpResp.Body, acc.Add)
+	resp, respErr := acc.Response()
+	if err == nil {
+		err = respErr
+	}
+
+	b.keys.Report(key, httpResp.StatusCode, httpResp.Header, acc.Usage())
+
+	if err != nil {
+		return nil, acc.Fail(err)
+	}
+	return resp, nil
+}
+
+// open sends a request and returns the successful HTTP response, trying
+// other keys while the failure is specific to the key
+func (b *AnthropicBackend) open(ctx context.Context, claudeReq ClaudeRequest) (*http.Response, *upstreamKey, error) {
+	// Marshal the request body
+	reqBody, err := json.Marshal(claudeReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	info := requestInfoFrom(ctx)
+	tried := make(map[string]bool)
+	var lastErr error
+
+	for {
+		key, err := b.keys.Pick(info, tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, nil, lastErr
+			}
+			return nil, nil, err
+		}
+		tried[key.name] = true
+
+		resp, err := b.send(ctx, b.endpoint, key.key, reqBody)
+		if err == nil {
+			return resp, key, nil
+		}
+		lastErr = err
+
+		var upErr *upstreamError
+		if !errors.As(err, &upErr) {
+			b.keys.Report(key, 0, nil, ClaudeUsage{})
+			return nil, nil, err
+		}
+		b.keys.Report(key, upErr.Status, upErr.Header, ClaudeUsage{})
+
+		// Only key-specific failures are worth retrying with another key
+		if upErr.Status != http.StatusTooManyRequests && upErr.Status != http.StatusUnauthorized && upErr.Status != http.StatusForbidden {
+			return nil, nil, err
+		}
+		log.Printf("API key %q returned status %d, trying another key", key.name, upErr.Status)
+	}
+}
+
+// send makes one request to endpoint with the given key
+func (b *AnthropicBackend) send(ctx context.Context, endpoint, apiKey string, reqBody []byte) (*http.Response, error) {
+	// Create the HTTP request
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Api-Key", apiKey)
+	req.Header.Set("Anthropic-Version", b.version)
+
+	// Send the request
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Claude API: %w", err)
+	}
+
+	// Check for error status code
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, &upstreamError{Provider: BackendAnthropic, Status: resp.StatusCode, Header: resp.Header, Body: string(bodyBytes)}
+	}
+
+	return resp, nil
+}
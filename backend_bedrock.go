@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bedrockAnthropicVersion is the anthropic_version Bedrock requires
+const bedrockAnthropicVersion = "bedrock-2023-05-31"
+
+// BedrockBackend calls Claude through Amazon Bedrock's InvokeModel API,
+// signing requests with AWS Signature Version 4
+type BedrockBackend struct {
+	name     string
+	endpoint string
+	region   string
+	modelIDs map[string]string
+	creds    awsCredentials
+	client   *http.Client
+	now      func() time.Time
+}
+
+// awsCredentials are the static credentials used for signing
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// NewBedrockBackend creates a Bedrock backend. Credentials not set in the
+// config are taken from the standard AWS environment variables.
+func NewBedrockBackend(name string, bc BackendConfig, client *http.Client) (*BedrockBackend, error) {
+	creds := awsCredentials{
+		AccessKeyID:     bc.AccessKeyID,
+		SecretAccessKey: bc.SecretAccessKey,
+		SessionToken:    bc.SessionToken,
+	}
+	if creds.AccessKeyID == "" {
+		creds.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		creds.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		creds.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS credentials not found in config or environment")
+	}
+
+	endpoint := bc.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://bedrock-runtime.%s.amazonaws.com", bc.Region)
+	}
+
+	return &BedrockBackend{
+		name:     name,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		region:   bc.Region,
+		modelIDs: bc.ModelIDs,
+		creds:    creds,
+		client:   client,
+		now:      time.Now,
+	}, nil
+}
+
+// Name implements Backend
+func (b *BedrockBackend) Name() string {
+	return b.name
+}
+
+// Send implements Backend
+func (b *BedrockBackend) Send(ctx context.Context, req ClaudeRequest) (*ClaudeResponse, error) {
+	resp, err := b.invoke(ctx, req, "invoke", "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var claudeResp ClaudeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&claudeResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &claudeResp, nil
+}
+
+// Stream implements Backend
+func (b *BedrockBackend) Stream(ctx context.Context, req ClaudeRequest, onText func(string) error) (*ClaudeResponse, error) {
+	resp, err := b.invoke(ctx, req, "invoke-with-response-stream", "application/vnd.amazon.eventstream")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	acc := newStreamAccumulator(onText)
+	err = readEventStream(resp.Body, func(msg eventStreamMessage) error {
+		switch msg.Headers[":message-type"] {
+		case "event":
+			if msg.Headers[":event-type"] != "chunk" {
+				return nil
+			}
+			var chunk struct {
+				Bytes string `json:"bytes"`
+			}
+			if err := json.Unmarshal(msg.Payload, &chunk); err != nil {
+				return fmt.Errorf("failed to decode chunk: %w", err)
+			}
+			data, err := base64.StdEncoding.DecodeString(chunk.Bytes)
+			if err != nil {
+				return fmt.Errorf("failed to decode chunk: %w", err)
+			}
+			return acc.Add(data)
+		case "exception", "error":
+			return fmt.Errorf("bedrock %s: %s", msg.Headers[":exception-type"], string(msg.Payload))
+		}
+		return nil
+	})
+	var claudeResp *ClaudeResponse
+	if err == nil {
+		claudeResp, err = acc.Response()
+	}
+	if err != nil {
+		return nil, acc.Fail(err)
+	}
+	return claudeResp, nil
+}
+
+// invoke sends a signed InvokeModel request and returns the successful
+// response
+func (b *BedrockBackend) invoke(ctx context.Context, claudeReq ClaudeRequest, action, accept string) (*http.Response, error) {
+	body, err := providerBody(claudeReq, bedrockAnthropicVersion, false)
+	if err != nil {
+		return nil, err
+	}
+
+	modelID := b.modelID(claudeReq.Model)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.URL.Path = "/model/" + modelID + "/" + action
+	req.URL.RawPath = "/model/" + awsURIEncode(modelID) + "/" + action
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", accept)
+
+	signV4(req, body, b.creds, b.region, "bedrock", b.now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Bedrock: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, &upstreamError{Provider: "bedrock", Status: resp.StatusCode, Header: resp.Header, Body: string(bodyBytes)}
+	}
+	return resp, nil
+}
+
+// modelID returns the Bedrock model ID for a Claude model ID, e.g.
+// claude-3-haiku-20240307 becomes anthropic.claude-3-haiku-20240307-v1:0.
+// IDs that already look like Bedrock IDs or ARNs are used as they are.
+func (b *BedrockBackend) modelID(model ModelID) string {
+	if id, ok := b.modelIDs[string(model)]; ok {
+		return id
+	}
+	id := string(model)
+	if strings.Contains(id, ".") && strings.Contains(id, ":") || strings.HasPrefix(id, "arn:") {
+		return id
+	}
+	return "anthropic." + id + "-v1:0"
+}
+
+// signV4 signs a request with AWS Signature Version 4
+func signV4(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	payloadHash := sha256.Sum256(body)
+
+	// Sign the host plus every content-type and x-amz-* header
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Every service except S3 expects the already-escaped path to be
+	// escaped a second time
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsURIEncode(segment)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		strings.Join(segments, "/"),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery builds the sorted, escaped query string SigV4 signs
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, awsURIEncode(key)+"="+awsURIEncode(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode escapes everything except unreserved characters, as SigV4
+// requires
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// eventStreamMessage is one message of an AWS event stream. Only string
+// header values are kept; the others are not used by Bedrock.
+type eventStreamMessage struct {
+	Headers map[string]string
+	Payload []byte
+}
+
+// readEventStream decodes application/vnd.amazon.eventstream messages from
+// r and passes each to fn
+func readEventStream(r io.Reader, fn func(eventStreamMessage) error) error {
+	for {
+		var prelude [12]byte
+		if _, err := io.ReadFull(r, prelude[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read event stream: %w", err)
+		}
+
+		totalLen := binary.BigEndian.Uint32(prelude[0:4])
+		headersLen := binary.BigEndian.Uint32(prelude[4:8])
+		if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+			return fmt.Errorf("event stream prelude checksum mismatch")
+		}
+		if totalLen < 16 || headersLen > totalLen-16 || totalLen > 16*1024*1024 {
+			return fmt.Errorf("invalid event stream message length %d", totalLen)
+		}
+
+		rest := make([]byte, totalLen-12)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return fmt.Errorf("failed to read event stream: %w", err)
+		}
+
+		body := rest[:len(rest)-4]
+		crc := crc32.NewIEEE()
+		crc.Write(prelude[:])
+		crc.Write(body)
+		if crc.Sum32() != binary.BigEndian.Uint32(rest[len(rest)-4:]) {
+			return fmt.Errorf("event stream message checksum mismatch")
+		}
+
+		headers, err := parseEventStreamHeaders(body[:headersLen])
+		if err != nil {
+			return err
+		}
+		if err := fn(eventStreamMessage{Headers: headers, Payload: body[headersLen:]}); err != nil {
+			return err
+		}
+	}
+}
+
+// eventStreamValueSizes gives the size of fixed-length header values by type
+var eventStreamValueSizes = map[byte]int{0: 0, 1: 0, 2: 1, 3: 2, 4: 4, 5: 8, 8: 8, 9: 16}
+
+// parseEventStreamHeaders decodes the headers section of a message
+func parseEventStreamHeaders(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for len(data) > 0 {
+		nameLen := int(data[0])
+		if len(data) < 1+nameLen+1 {
+			return nil, fmt.Errorf("truncated event stream header")
+		}
+		name := string(data[1 : 1+nameLen])
+		valueType := data[1+nameLen]
+		data = data[2+nameLen:]
+
+		switch valueType {
+		case 6, 7:
+			// Byte array and string values are length-prefixed
+			if len(data) < 2 {
+				return nil, fmt.Errorf("truncated event stream header")
+			}
+			valueLen := int(binary.BigEndian.Uint16(data[:2]))
+			if len(data) < 2+valueLen {
+				return nil, fmt.Errorf("truncated event stream header")
+			}
+			if valueType == 7 {
+				headers[name] = string(data[2 : 2+valueLen])
+			}
+			data = data[2+valueLen:]
+		default:
+			size, ok := eventStreamValueSizes[valueType]
+			if !ok || len(data) < size {
+				return nil, fmt.Errorf("invalid event stream header %q", name)
+			}
+			data = data[size:]
+		}
+	}
+	return headers, nil
+}
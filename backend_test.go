@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stream events for a response of "Hello world"
+var testStreamEvents = []string{
+	`{"type":"message_start","message":{"id":"msg_1","role":"assistant","usage":{"input_tokens":12,"output_tokens":1}}}`,
+	`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+	`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+	`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}`,
+	`{"type":"content_block_stop","index":0}`,
+	`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+	`{"type":"message_stop"}`,
+}
+
+// Helper to write the test events as server-sent events
+func writeTestSSE(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range testStreamEvents {
+		var typed struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal([]byte(event), &typed)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typed.Type, event)
+	}
+}
+
+// Helper to check a streamed response
+func checkStreamedResponse(t *testing.T, resp *ClaudeResponse, chunks []string) {
+	t.Helper()
+	if getFirstContentText(resp) != "Hello world" || strings.Join(chunks, "|") != "Hello| world" {
+		t.Errorf("Unexpected stream result %q from chunks %q", getFirstContentText(resp), chunks)
+	}
+	if resp.StopReason != "end_turn" || resp.Usage.InputTokens != 12 || resp.Usage.OutputTokens != 3 {
+		t.Errorf("Unexpected stop reason or usage: %+v", resp)
+	}
+}
+
+// Test the AWS SigV4 "get-vanilla" example from the AWS test suite
+func TestSignV4(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("Unexpected signature:\n got %s\nwant %s", got, expected)
+	}
+}
+
+// Helper to encode an AWS event-stream message with string headers
+func encodeEventStreamMessage(headers map[string]string, payload []byte) []byte {
+	var hdr bytes.Buffer
+	for name, value := range headers {
+		hdr.WriteByte(byte(len(name)))
+		hdr.WriteString(name)
+		hdr.WriteByte(7)
+		binary.Write(&hdr, binary.BigEndian, uint16(len(value)))
+		hdr.WriteString(value)
+	}
+
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.BigEndian, uint32(16+hdr.Len()+len(payload)))
+	binary.Write(&msg, binary.BigEndian, uint32(hdr.Len()))
+	binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()))
+	msg.Write(hdr.Bytes())
+	msg.Write(payload)
+	binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()))
+	return msg.Bytes()
+}
+
+// Test the Bedrock backend against a stand-in Bedrock runtime
+func TestBedrockBackend(t *testing.T) {
+	var paths []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			http.Error(w, `{"message": "missing signature"}`, http.StatusForbidden)
+			return
+		}
+
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["anthropic_version"] != bedrockAnthropicVersion || body["model"] != nil || body["stream"] != nil {
+			http.Error(w, `{"message": "bad body"}`, http.StatusBadRequest)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/invoke-with-response-stream") {
+			w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+			for _, event := range testStreamEvents {
+				payload, _ := json.Marshal(map[string]string{"bytes": base64.StdEncoding.EncodeToString([]byte(event))})
+				w.Write(encodeEventStreamMessage(map[string]string{
+					":message-type": "event",
+					":event-type":   "chunk",
+					":content-type": "application/json",
+				}, payload))
+			}
+			return
+		}
+
+		json.NewEncoder(w).Encode(ClaudeResponse{Content: []ClaudeContent{{Type: "text", Text: "from bedrock"}}})
+	}))
+	defer upstream.Close()
+
+	backend, err := NewBedrockBackend("bedrock", BackendConfig{
+		Type:            BackendBedrock,
+		Region:          "us-east-1",
+		Endpoint:        upstream.URL,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+	}, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+
+	req := ClaudeRequest{Model: testModelHaiku, MaxTokens: 10, Messages: []Message{NewUserTextMessage("hi")}}
+	resp, err := backend.Send(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if getFirstContentText(resp) != "from bedrock" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	if paths[0] != "/model/anthropic.claude-3-haiku-20240307-v1%3A0/invoke" {
+		t.Errorf("Unexpected path %q", paths[0])
+	}
+
+	var chunks []string
+	resp, err = backend.Stream(context.Background(), req, func(text string) error {
+		chunks = append(chunks, text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected stream error: %v", err)
+	}
+	checkStreamedResponse(t, resp, chunks)
+}
+
+// Helper to write a service-account key file for a fresh RSA key
+func writeServiceAccountKey(t *testing.T, tokenURI string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	data, _ := json.Marshal(serviceAccountKey{
+		ClientEmail: "proxy@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    tokenURI,
+	})
+	path := filepath.Join(t.TempDir(), "sa.json")
+	os.WriteFile(path, data, 0o600)
+	return path
+}
+
+// Test the Vertex AI backend against stand-in token and prediction servers
+func TestVertexBackend(t *testing.T) {
+	tokenRequests := 0
+	var paths []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests++
+			r.ParseForm()
+			if parts := strings.Split(r.Form.Get("assertion"), "."); len(parts) != 3 {
+				http.Error(w, "bad assertion", http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "ya29.test", "expires_in": 3600})
+			return
+		}
+
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer ya29.test" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), vertexAnthropicVersion) {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, ":streamRawPredict") {
+			writeTestSSE(w)
+			return
+		}
+		json.NewEncoder(w).Encode(ClaudeResponse{Content: []ClaudeContent{{Type: "text", Text: "from vertex"}}})
+	}))
+	defer upstream.Close()
+
+	backend, err := NewVertexBackend("vertex", BackendConfig{
+		Type:            BackendVertex,
+		Region:          "europe-west1",
+		ProjectID:       "my-project",
+		Endpoint:        upstream.URL,
+		CredentialsFile: writeServiceAccountKey(t, upstream.URL+"/token"),
+	}, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+
+	req := ClaudeRequest{Model: testModelSonnet35, MaxTokens: 10, Messages: []Message{NewUserTextMessage("hi")}}
+	resp, err := backend.Send(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if getFirstContentText(resp) != "from vertex" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	expected := "/v1/projects/my-project/locations/europe-west1/publishers/anthropic/models/claude-3-5-sonnet@20240620:rawPredict"
+	if paths[0] != expected {
+		t.Errorf("Unexpected path %q", paths[0])
+	}
+
+	var chunks []string
+	resp, err = backend.Stream(context.Background(), req, func(text string) error {
+		chunks = append(chunks, text)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected stream error: %v", err)
+	}
+	checkStreamedResponse(t, resp, chunks)
+
+	if tokenRequests != 1 {
+		t.Errorf("Expected the access token to be cached, fetched %d times", tokenRequests)
+	}
+}
+
+// Test that aliases are routed to their configured backend and that
+// /api/generate streams Ollama frames
+func TestBackendRoutingAndStreaming(t *testing.T) {
+	config := testConfig()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ClaudeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream {
+			writeTestSSE(w)
+			return
+		}
+		json.NewEncoder(w).Encode(ClaudeResponse{Content: []ClaudeContent{{Type: "text", Text: "from " + r.URL.Path}}})
+	}))
+	defer upstream.Close()
+
+	config.APIEndpoint = upstream.URL + "/default"
+	config.Backends = map[string]BackendConfig{
+		"eu": {Type: BackendAnthropic, Endpoint: upstream.URL + "/eu"},
+	}
+	config.ModelBackends = map[string]string{"Claude-3-Haiku": "eu"}
+	server := NewServer(config)
+
+	if name := server.backendFor("claude-3-haiku:latest").Name(); name != "eu" {
+		t.Errorf("Expected backend %q for claude-3-haiku, got %q", "eu", name)
+	}
+	if name := server.backendFor("claude").Name(); name != BackendAnthropic {
+		t.Errorf("Expected default backend for claude, got %q", name)
+	}
+
+	body, _ := json.Marshal(OllamaRequest{Model: "claude-3-haiku", Prompt: "hi", Stream: true})
+	recorder := httptest.NewRecorder()
+	server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(body)))
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected two text frames and a final frame, got %q", recorder.Body.String())
+	}
+	var first, last OllamaResponse
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[2]), &last)
+	if first.Response != "Hello" || first.Done {
+		t.Errorf("Unexpected first frame %+v", first)
+	}
+	if !last.Done || len(last.Context) == 0 {
+		t.Errorf("Expected a final frame with context, got %+v", last)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// vertexAnthropicVersion is the anthropic_version Vertex AI requires
+	vertexAnthropicVersion = "vertex-2023-10-16"
+
+	vertexScope           = "https://www.googleapis.com/auth/cloud-platform"
+	googleDefaultTokenURI = "https://oauth2.googleapis.com/token"
+)
+
+// vertexDateSuffix matches the date at the end of a Claude model ID, which
+// Vertex AI separates with "@" instead of "-"
+var vertexDateSuffix = regexp.MustCompile(`-(\d{8})$`)
+
+// VertexBackend calls Claude through Google Vertex AI's rawPredict and
+// streamRawPredict endpoints, authenticating as a service account
+type VertexBackend struct {
+	name      string
+	endpoint  string
+	region    string
+	projectID string
+	modelIDs  map[string]string
+	tokens    *serviceAccountTokenSource
+	client    *http.Client
+}
+
+// NewVertexBackend creates a Vertex AI backend from a service-account
+// credentials file
+func NewVertexBackend(name string, bc BackendConfig, client *http.Client) (*VertexBackend, error) {
+	tokens, err := newServiceAccountTokenSource(bc.CredentialsFile, client)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := bc.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s-aiplatform.googleapis.com", bc.Region)
+	}
+
+	return &VertexBackend{
+		name:      name,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    bc.Region,
+		projectID: bc.ProjectID,
+		modelIDs:  bc.ModelIDs,
+		tokens:    tokens,
+		client:    client,
+	}, nil
+}
+
+// Name implements Backend
+func (b *VertexBackend) Name() string {
+	return b.name
+}
+
+// Send implements Backend
+func (b *VertexBackend) Send(ctx context.Context, req ClaudeRequest) (*ClaudeResponse, error) {
+	req.Stream = false
+	resp, err := b.predict(ctx, req, "rawPredict")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var claudeResp ClaudeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&claudeResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &claudeResp, nil
+}
+
+// Stream implements Backend
+func (b *VertexBackend) Stream(ctx context.Context, req ClaudeRequest, onText func(string) error) (*ClaudeResponse, error) {
+	req.Stream = true
+	resp, err := b.predict(ctx, req, "streamRawPredict")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	acc := newStreamAccumulator(onText)
+	err = readSSE(resp.Body, acc.Add)
+	var claudeResp *ClaudeResponse
+	if err == nil {
+		claudeResp, err = acc.Response()
+	}
+	if err != nil {
+		return nil, acc.Fail(err)
+	}
+	return claudeResp, nil
+}
+
+// predict sends a request to a Vertex AI publisher model method
+func (b *VertexBackend) predict(ctx context.Context, claudeReq ClaudeRequest, method string) (*http.Response, error) {
+	body, err := providerBody(claudeReq, vertexAnthropicVersion, true)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := b.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/locations/%s/publishers/anthropic/models/%s:%s",
+		b.endpoint, url.PathEscape(b.projectID), url.PathEscape(b.region), url.PathEscape(b.modelID(claudeReq.Model)), method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Vertex AI: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusUnauthorized {
+			b.tokens.Invalidate()
+		}
+		return nil, &upstreamError{Provider: "vertex", Status: resp.StatusCode, Header: resp.Header, Body: string(bodyBytes)}
+	}
+	return resp, nil
+}
+
+// modelID returns the Vertex AI model ID for a Claude model ID, e.g.
+// claude-3-haiku-20240307 becomes claude-3-haiku@20240307
+func (b *VertexBackend) modelID(model ModelID) string {
+	if id, ok := b.modelIDs[string(model)]; ok {
+		return id
+	}
+	return vertexDateSuffix.ReplaceAllString(string(model), "@$1")
+}
+
+// serviceAccountKey is the part of a Google service-account key file we use
+type serviceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// serviceAccountTokenSource exchanges a signed JWT for an OAuth access
+// token and caches it until shortly before it expires
+type serviceAccountTokenSource struct {
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURI string
+	client   *http.Client
+	now      func() time.Time
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newServiceAccountTokenSource(path string, client *http.Client) (*serviceAccountTokenSource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+
+	var sa serviceAccountKey
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %w", err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, fmt.Errorf("credentials file is not a service-account key")
+	}
+
+	key, err := parseRSAPrivateKey(sa.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenURI := sa.TokenURI
+	if tokenURI == "" {
+		tokenURI = googleDefaultTokenURI
+	}
+
+	return &serviceAccountTokenSource{
+		email:    sa.ClientEmail,
+		keyID:    sa.PrivateKeyID,
+		key:      key,
+		tokenURI: tokenURI,
+		client:   client,
+		now:      time.Now,
+	}, nil
+}
+
+// Token returns a valid access token, fetching a new one if needed
+func (ts *serviceAccountTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && ts.now().Before(ts.expires) {
+		return ts.token, nil
+	}
+
+	assertion, err := ts.signJWT()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch access token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("token endpoint returned no access token")
+	}
+
+	// Refresh a minute early so a token never expires mid-request
+	ts.token = tokenResp.AccessToken
+	ts.expires = ts.now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - time.Minute)
+	return ts.token, nil
+}
+
+// Invalidate drops the cached token, e.g. after it was rejected
+func (ts *serviceAccountTokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.token = ""
+}
+
+// signJWT creates the RS256-signed assertion for the token exchange
+func (ts *serviceAccountTokenSource) signJWT() (string, error) {
+	now := ts.now()
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if ts.keyID != "" {
+		header["kid"] = ts.keyID
+	}
+	claims := map[string]interface{}{
+		"iss":   ts.email,
+		"scope": vertexScope,
+		"aud":   ts.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token request: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PEM-encoded PKCS#8 or PKCS#1 RSA key
+func parseRSAPrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not an RSA key")
+		}
+		return rsaKey, nil
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breakerBuckets is how many slices the rolling window is divided into
+const breakerBuckets = 10
+
+// breakerOpenError is returned without calling the backend while its
+// breaker is open
+type breakerOpenError struct {
+	Backend    string
+	Model      string
+	RetryAfter time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("backend %q is unavailable for model %s (circuit breaker open)", e.Backend, e.Model)
+}
+
+// retryAfterSecs returns Retry-After in whole seconds, rounding up
+func (e *breakerOpenError) retryAfterSecs() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// breakerSettings are the thresholds shared by every breaker
+type breakerSettings struct {
+	errorRate   float64
+	minRequests int
+	window      time.Duration
+	openFor     time.Duration
+	slowCall    time.Duration
+}
+
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// circuitBreaker tracks one backend and model. It opens when the share of
+// failed or slow calls in the rolling window reaches the error rate, lets
+// one probe through once the open period is over, and closes again when
+// the probe succeeds.
+type circuitBreaker struct {
+	backend string
+	model   string
+
+	state      string
+	openUntil  time.Time
+	probing    bool
+	buckets    [breakerBuckets]breakerBucket
+	trips      int64
+	lastChange time.Time
+}
+
+// BreakerStatus is the state of a breaker as reported by /admin/breakers
+type BreakerStatus struct {
+	Backend        string    `json:"backend"`
+	Model          string    `json:"model"`
+	State          string    `json:"state"`
+	Requests       int       `json:"requests"`
+	Failures       int       `json:"failures"`
+	ErrorRate      float64   `json:"error_rate"`
+	Trips          int64     `json:"trips"`
+	Since          time.Time `json:"since"`
+	RetryAfterSecs int       `json:"retry_after_secs,omitempty"`
+}
+
+// BreakerSet holds a circuit breaker for every backend and model pair that
+// has been used
+type BreakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+	settings breakerSettings
+	now      func() time.Time
+}
+
+// NewBreakerSet creates the breakers from the configuration. A breaker
+// error rate of 0 disables them.
+func NewBreakerSet(config Config) *BreakerSet {
+	return &BreakerSet{
+		breakers: make(map[string]*circuitBreaker),
+		settings: breakerSettings{
+			errorRate:   config.BreakerErrorRate,
+			minRequests: config.BreakerMinRequests,
+			window:      time.Duration(config.BreakerWindowSecs) * time.Second,
+			openFor:     time.Duration(config.BreakerOpenSecs) * time.Second,
+			slowCall:    time.Duration(config.BreakerSlowCallSecs) * time.Second,
+		},
+		now: time.Now,
+	}
+}
+
+// breakerCall is a call admitted by a breaker. The caller reports the first
+// byte of a streamed response and then the outcome.
+type breakerCall struct {
+	set     *BreakerSet
+	breaker *circuitBreaker
+	start   time.Time
+	latency time.Duration
+}
+
+// Allow admits a call to a backend for a model, or returns a
+// breakerOpenError if the breaker is open
+func (bs *BreakerSet) Allow(backend, model string) (*breakerCall, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	now := bs.now()
+	call := &breakerCall{set: bs, start: now}
+	if bs.settings.errorRate <= 0 {
+		return call, nil
+	}
+
+	key := backend + "/" + model
+	cb, ok := bs.breakers[key]
+	if !ok {
+		cb = &circuitBreaker{backend: backend, model: model, state: BreakerClosed, lastChange: now}
+		bs.breakers[key] = cb
+	}
+	call.breaker = cb
+
+	switch cb.state {
+	case BreakerOpen:
+		if now.Before(cb.openUntil) {
+			return nil, &breakerOpenError{Backend: backend, Model: model, RetryAfter: cb.openUntil.Sub(now)}
+		}
+		bs.transition(cb, BreakerHalfOpen, now)
+		cb.probing = true
+	case BreakerHalfOpen:
+		// Only one probe at a time; others wait for its verdict
+		if cb.probing {
+			return nil, &breakerOpenError{Backend: backend, Model: model, RetryAfter: time.Second}
+		}
+		cb.probing = true
+	}
+
+	return call, nil
+}
+
+// FirstByte records the latency of a streamed call when its first text
+// arrives, so that long generations are not mistaken for slow ones
+func (c *breakerCall) FirstByte() {
+	if c.latency == 0 {
+		c.latency = c.set.now().Sub(c.start)
+	}
+}
+
+// Done records the outcome of the call
+func (c *breakerCall) Done(err error) {
+	if c.breaker == nil {
+		return
+	}
+
+	bs := c.set
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	now := bs.now()
+	if c.latency == 0 {
+		c.latency = now.Sub(c.start)
+	}
+	cb := c.breaker
+
+	// A client hanging up says nothing about the backend
+	if errors.Is(err, context.Canceled) {
+		if cb.state == BreakerHalfOpen {
+			cb.probing = false
+		}
+		return
+	}
+
+	failed := isBreakerFailure(err) || (bs.settings.slowCall > 0 && c.latency > bs.settings.slowCall)
+
+	switch cb.state {
+	case BreakerHalfOpen:
+		cb.probing = false
+		if failed {
+			bs.trip(cb, now)
+		} else {
+			cb.buckets = [breakerBuckets]breakerBucket{}
+			bs.transition(cb, BreakerClosed, now)
+		}
+	case BreakerClosed:
+		bucket := bs.bucket(cb, now)
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+		requests, failures := bs.counts(cb, now)
+		if requests >= bs.settings.minRequests && float64(failures)/float64(requests) >= bs.settings.errorRate {
+			bs.trip(cb, now)
+		}
+	}
+}
+
+// isBreakerFailure reports whether an error suggests the backend is
+// unhealthy. Requests rejected for their content do not count.
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		return upErr.Status == http.StatusTooManyRequests || upErr.Status >= 500
+	}
+	return true
+}
+
+// trip opens a breaker for the open period
+func (bs *BreakerSet) trip(cb *circuitBreaker, now time.Time) {
+	cb.openUntil = now.Add(bs.settings.openFor)
+	cb.trips++
+	bs.transition(cb, BreakerOpen, now)
+}
+
+func (bs *BreakerSet) transition(cb *circuitBreaker, state string, now time.Time) {
+	log.Printf("Circuit breaker for backend %q model %s: %s -> %s", cb.backend, cb.model, cb.state, state)
+	cb.state = state
+	cb.lastChange = now
+}
+
+// bucket returns the bucket for now, clearing it if it last held an older
+// slice of time
+func (bs *BreakerSet) bucket(cb *circuitBreaker, now time.Time) *breakerBucket {
+	span := bs.settings.window / breakerBuckets
+	if span <= 0 {
+		span = time.Nanosecond
+	}
+	start := now.Truncate(span)
+	bucket := &cb.buckets[(start.UnixNano()/int64(span))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// counts sums the requests and failures within the window
+func (bs *BreakerSet) counts(cb *circuitBreaker, now time.Time) (requests, failures int) {
+	for _, bucket := range cb.buckets {
+		if now.Sub(bucket.start) < bs.settings.window {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+// Status returns the state of every breaker, sorted by backend and model
+func (bs *BreakerSet) Status() []BreakerStatus {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	now := bs.now()
+	statuses := make([]BreakerStatus, 0, len(bs.breakers))
+	for _, cb := range bs.breakers {
+		requests, failures := bs.counts(cb, now)
+		status := BreakerStatus{
+			Backend:  cb.backend,
+			Model:    cb.model,
+			State:    cb.state,
+			Requests: requests,
+			Failures: failures,
+			Trips:    cb.trips,
+			Since:    cb.lastChange,
+		}
+		if requests > 0 {
+			status.ErrorRate = float64(failures) / float64(requests)
+		}
+		if cb.state == BreakerOpen && now.Before(cb.openUntil) {
+			status.RetryAfterSecs = int(math.Ceil(cb.openUntil.Sub(now).Seconds()))
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Backend != statuses[j].Backend {
+			return statuses[i].Backend < statuses[j].Backend
+		}
+		return statuses[i].Model < statuses[j].Model
+	})
+	return statuses
+}
+
+// WriteMetrics writes the breaker gauges in the Prometheus text format
+func (bs *BreakerSet) WriteMetrics(w io.Writer) {
+	statuses := bs.Status()
+
+	fmt.Fprintln(w, "# HELP ollama_proxy_breaker_state Circuit breaker state (0 closed, 1 half-open, 2 open).")
+	fmt.Fprintln(w, "# TYPE ollama_proxy_breaker_state gauge")
+	for _, status := range statuses {
+		value := 0
+		switch status.State {
+		case BreakerHalfOpen:
+			value = 1
+		case BreakerOpen:
+			value = 2
+		}
+		fmt.Fprintf(w, "ollama_proxy_breaker_state{backend=%q,model=%q} %d\n", status.Backend, status.Model, value)
+	}
+
+	fmt.Fprintln(w, "# HELP ollama_proxy_breaker_error_rate Share of failed calls in the breaker window.")
+	fmt.Fprintln(w, "# TYPE ollama_proxy_breaker_error_rate gauge")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "ollama_proxy_breaker_error_rate{backend=%q,model=%q} %s\n", status.Backend, status.Model, strconv.FormatFloat(status.ErrorRate, 'g', -1, 64))
+	}
+
+	fmt.Fprintln(w, "# HELP ollama_proxy_breaker_trips_total Times the circuit breaker has opened.")
+	fmt.Fprintln(w, "# TYPE ollama_proxy_breaker_trips_total counter")
+	for _, status := range statuses {
+		fmt.Fprintf(w, "ollama_proxy_breaker_trips_total{backend=%q,model=%q} %d\n", status.Backend, status.Model, status.Trips)
+	}
+}
+
+// breakerBackend guards a backend with the breakers for its models
+type breakerBackend struct {
+	Backend
+	breakers *BreakerSet
+}
+
+// withBreakers wraps every backend in its circuit breakers
+func withBreakers(backends map[string]Backend, breakers *BreakerSet) map[string]Backend {
+	wrapped := make(map[string]Backend, len(backends))
+	for name, backend := range backends {
+		wrapped[name] = &breakerBackend{Backend: backend, breakers: breakers}
+	}
+	return wrapped
+}
+
+// Unwrap returns the wrapped backend
+func (b *breakerBackend) Unwrap() Backend {
+	return b.Backend
+}
+
+// Send implements Backend
+func (b *breakerBackend) Send(ctx context.Context, req ClaudeRequest) (*ClaudeResponse, error) {
+	call, err := b.breakers.Allow(b.Name(), string(req.Model))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.Backend.Send(ctx, req)
+	call.Done(err)
+	return resp, err
+}
+
+// Stream implements Backend
+func (b *breakerBackend) Stream(ctx context.Context, req ClaudeRequest, onText func(string) error) (*ClaudeResponse, error) {
+	call, err := b.breakers.Allow(b.Name(), string(req.Model))
+	if err != nil {
+		return nil, err
+	}
+	// Failing to write to the client is not the backend's fault
+	var writeErr error
+	resp, err := b.Backend.Stream(ctx, req, func(text string) error {
+		call.FirstByte()
+		writeErr = onText(text)
+		return writeErr
+	})
+	if writeErr != nil && errors.Is(err, writeErr) {
+		call.Done(context.Canceled)
+	} else {
+		call.Done(err)
+	}
+	return resp, err
+}
+
+// Handle GET /admin/breakers
+func (s *Server) handleBreakerStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Breakers []BreakerStatus `json:"breakers"`
+	}{s.breakers.Status()})
+}
+
+// Handle GET /metrics
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.breakers.WriteMetrics(w)
+	s.requests.WriteMetrics(w)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that a breaker opens on errors, probes once and closes again
+func TestBreakerStates(t *testing.T) {
+	config := testConfig()
+	config.BreakerMinRequests = 4
+	breakers := NewBreakerSet(config)
+	now := time.Unix(1700000000, 0)
+	breakers.now = func() time.Time { return now }
+
+	serverErr := &upstreamError{Status: http.StatusInternalServerError}
+	badRequest := &upstreamError{Status: http.StatusBadRequest}
+
+	// Bad requests are the client's fault and never trip the breaker
+	for i := 0; i < 10; i++ {
+		call, err := breakers.Allow("anthropic", "claude-3-haiku")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		call.Done(badRequest)
+	}
+
+	// Server and network errors count, but stay below the error rate
+	for _, err := range []error{serverErr, nil, serverErr, errors.New("connection refused")} {
+		call, allowErr := breakers.Allow("anthropic", "claude-3-haiku")
+		if allowErr != nil {
+			t.Fatalf("Unexpected error: %v", allowErr)
+		}
+		call.Done(err)
+	}
+	if state := breakers.Status()[0].State; state != BreakerClosed {
+		t.Fatalf("Expected the breaker to stay closed at 3 failures in 14 calls, got %s", state)
+	}
+
+	// A fresh window with only failures trips it
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 4; i++ {
+		call, err := breakers.Allow("anthropic", "claude-3-haiku")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		call.Done(serverErr)
+	}
+
+	_, err := breakers.Allow("anthropic", "claude-3-haiku")
+	var openErr *breakerOpenError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("Expected a breakerOpenError, got %v", err)
+	}
+	if openErr.retryAfterSecs() != 30 {
+		t.Errorf("Expected Retry-After of 30s, got %d", openErr.retryAfterSecs())
+	}
+
+	// Other models on the same backend are unaffected
+	if _, err := breakers.Allow("anthropic", "claude-3-opus"); err != nil {
+		t.Errorf("Expected another model to be allowed, got %v", err)
+	}
+
+	// After the open period one probe goes through and the rest wait
+	now = now.Add(31 * time.Second)
+	probe, err := breakers.Allow("anthropic", "claude-3-haiku")
+	if err != nil {
+		t.Fatalf("Expected a probe to be allowed, got %v", err)
+	}
+	if _, err := breakers.Allow("anthropic", "claude-3-haiku"); err == nil {
+		t.Errorf("Expected a second call to be rejected while probing")
+	}
+
+	// A failed probe opens the breaker again
+	probe.Done(serverErr)
+	if _, err := breakers.Allow("anthropic", "claude-3-haiku"); err == nil {
+		t.Errorf("Expected the breaker to reopen after a failed probe")
+	}
+
+	// A successful probe closes it
+	now = now.Add(31 * time.Second)
+	probe, err = breakers.Allow("anthropic", "claude-3-haiku")
+	if err != nil {
+		t.Fatalf("Expected a probe to be allowed, got %v", err)
+	}
+	probe.Done(nil)
+
+	status := breakers.Status()
+	if status[0].Model != "claude-3-haiku" || status[0].State != BreakerClosed || status[0].Trips != 2 {
+		t.Errorf("Expected a closed breaker with 2 trips, got %+v", status[0])
+	}
+}
+
+// Test that slow calls count as failures
+func TestBreakerSlowCalls(t *testing.T) {
+	config := testConfig()
+	config.BreakerMinRequests = 2
+	config.BreakerSlowCallSecs = 5
+	breakers := NewBreakerSet(config)
+	now := time.Unix(1700000000, 0)
+	breakers.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		call, err := breakers.Allow("bedrock", "claude-3-haiku")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		now = now.Add(10 * time.Second)
+		call.Done(nil)
+	}
+
+	if _, err := breakers.Allow("bedrock", "claude-3-haiku"); err == nil {
+		t.Errorf("Expected slow calls to open the breaker")
+	}
+}
+
+// Test that an open breaker answers with a fast 503 and Retry-After
+func TestGenerateBreakerOpen(t *testing.T) {
+	var calls int32
+	claude := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, `{"type": "error", "error": {"type": "api_error"}}`, http.StatusInternalServerError)
+	}))
+	defer claude.Close()
+
+	config := testConfig()
+	config.APIEndpoint = claude.URL
+	config.BreakerMinRequests = 2
+	server := NewServer(config)
+
+	generate := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		body := `{"model": "claude-3-haiku", "prompt": "hi"}`
+		server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body)))
+		return recorder
+	}
+
+	for i := 0; i < 2; i++ {
+		if recorder := generate(); recorder.Code != http.StatusBadGateway {
+			t.Fatalf("Expected status %d, got %d", http.StatusBadGateway, recorder.Code)
+		}
+	}
+
+	recorder := generate()
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusServiceUnavailable, recorder.Code, recorder.Body.String())
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Expected Retry-After 30, got %q", got)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("Expected the upstream to be called 2 times, got %d", got)
+	}
+
+	// The open breaker shows up in the metrics
+	metrics := httptest.NewRecorder()
+	server.handleMetrics(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	expected := `ollama_proxy_breaker_state{backend="anthropic",model="claude-3-haiku-20240307"} 2`
+	if !strings.Contains(metrics.Body.String(), expected) {
+		t.Errorf("Expected metrics to contain %s, got:\n%s", expected, metrics.Body.String())
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// commands are the subcommands run in place of the server, for checking a
+// configuration before it is deployed
+var commands = map[string]func(args []string, stdout io.Writer) error{
+	"validate":     runValidate,
+	"print-config": runPrintConfig,
+	"models":       runModels,
+}
+
+// modelIDPattern matches the form of Claude model IDs
+var modelIDPattern = regexp.MustCompile(`^claude-[a-z0-9][a-z0-9.-]*$`)
+
+// commandFlags creates the flags shared by every subcommand
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := flags.String("config", "", "Path to configuration file")
+	return flags, configPath
+}
+
+// runValidate loads a configuration and checks it more thoroughly than
+// startup does, failing if there are any problems
+func runValidate(args []string, stdout io.Writer) error {
+	flags, configPath := commandFlags("validate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	problems := checkConfig(config)
+	for _, problem := range problems {
+		fmt.Fprintln(stdout, problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	fmt.Fprintln(stdout, "Configuration is valid")
+	return nil
+}
+
+// checkConfig checks the model IDs and endpoints in a configuration that
+// has already passed validateConfig, which does not look at them
+func checkConfig(config Config) []string {
+	var problems []string
+
+	models, err := NewModelStore(config.ModelsFile)
+	if err != nil {
+		problems = append(problems, err.Error())
+		models, _ = NewModelStore("")
+	}
+	s := &Server{config: config, modelMap: buildModelMap(config), models: models}
+
+	// Settings used as model IDs as they are
+	checkID := func(field, id string) {
+		if target, ok := s.modelMap[normalizeModelName(id)]; ok {
+			problems = append(problems, fmt.Sprintf("%s: %q is an alias, not a model ID; use %q", field, id, target))
+		} else if id != "" && !modelIDPattern.MatchString(id) {
+			problems = append(problems, fmt.Sprintf("%s: %q is not a Claude model ID", field, id))
+		}
+	}
+	// Settings that may also name an alias or custom model
+	checkModel := func(field, name string) {
+		if _, ok := s.modelMap[normalizeModelName(name)]; ok {
+			return
+		}
+		if _, ok := s.models.Get(name); ok {
+			return
+		}
+		if !modelIDPattern.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("%s: %q is neither a model alias nor a Claude model ID", field, name))
+		}
+	}
+	checkURL := func(field, value string) {
+		if value == "" {
+			return
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s: %q is not an http or https URL", field, value))
+		}
+	}
+
+	checkID("default_model", config.DefaultModel)
+	checkID("session_summary_model", config.SessionSummaryModel)
+	checkID("truncation_summary_model", config.TruncationSummaryModel)
+	for _, alias := range sortedKeys(config.ModelBackends) {
+		checkModel("model_backends", alias)
+	}
+	for _, alias := range sortedKeys(config.Fallbacks) {
+		checkModel("fallbacks", alias)
+	}
+	for _, rule := range config.Routes {
+		if rule.Model != "" {
+			checkModel("routes."+rule.Name+".model", rule.Model)
+		}
+	}
+	for _, exp := range config.Experiments {
+		checkModel("experiments."+exp.Name+".alias", exp.Alias)
+		for _, v := range exp.Variants {
+			checkModel("experiments."+exp.Name+".variants."+v.Name+".model", v.Model)
+		}
+		if exp.ShadowModel != "" {
+			checkModel("experiments."+exp.Name+".shadow_model", exp.ShadowModel)
+		}
+	}
+
+	if config.APIEndpoint == "" {
+		problems = append(problems, "api_endpoint: must be set")
+	}
+	checkURL("api_endpoint", config.APIEndpoint)
+	checkURL("embeddings_url", config.EmbeddingsURL)
+	for _, name := range sortedKeys(config.Backends) {
+		bc := config.Backends[name]
+		checkURL("backends."+name+".endpoint", bc.Endpoint)
+		for _, id := range sortedKeys(bc.ModelIDs) {
+			checkID("backends."+name+".model_ids", id)
+		}
+	}
+
+	return problems
+}
+
+// runPrintConfig prints the effective configuration, with secrets masked
+// and the source of each setting
+func runPrintConfig(args []string, stdout io.Writer) error {
+	flags, configPath := commandFlags("print-config")
+	asJSON := flags.Bool("json", false, "Print the configuration and sources as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, sources, err := loadConfigSources(*configPath)
+	if err != nil {
+		return err
+	}
+	fields := configFields(maskSecrets(config))
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Config  map[string]json.RawMessage `json:"config"`
+			Sources map[string]string          `json:"sources"`
+		}{fields, sources})
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tSOURCE\tVALUE")
+	for _, name := range sortedKeys(fields) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, sources[name], fields[name])
+	}
+	return tw.Flush()
+}
+
+// loadConfigSources loads a configuration like LoadConfig and reports where
+// each setting came from: "default", "file" or "env"
+func loadConfigSources(configPath string) (Config, map[string]string, error) {
+	config := DefaultConfig()
+
+	var inFile map[string]json.RawMessage
+	if configPath != "" {
+		data, _, err := readConfigFile(configPath)
+		if err != nil {
+			return config, nil, err
+		}
+		if err := json.Unmarshal(data, &inFile); err != nil {
+			return config, nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		if err := loadConfigFile(&config, configPath); err != nil {
+			return config, nil, err
+		}
+	}
+	fromFile := configFields(config)
+
+	applyEnvVars(&config)
+	fromEnv := configFields(config)
+
+	if err := loadSecretFiles(&config); err != nil {
+		return config, nil, err
+	}
+	if err := validateConfig(config); err != nil {
+		return config, nil, err
+	}
+
+	final := configFields(config)
+	sources := make(map[string]string, len(final))
+	for name := range final {
+		switch {
+		case !bytes.Equal(fromEnv[name], fromFile[name]):
+			sources[name] = "env"
+		case inFile[name] != nil:
+			sources[name] = "file"
+		default:
+			sources[name] = "default"
+		}
+	}
+	// A secret read from a file comes from wherever that file was named
+	for name, value := range final {
+		if source, ok := sources[name+"_file"]; ok && !bytes.Equal(value, fromEnv[name]) {
+			sources[name] = source
+		}
+	}
+	return config, sources, nil
+}
+
+// maskSecrets returns a copy of a configuration with its secrets masked
+func maskSecrets(config Config) Config {
+	config.APIKey = maskSecret(config.APIKey)
+
+	keys := make([]APIKeyConfig, len(config.APIKeys))
+	for i, key := range config.APIKeys {
+		key.Key = maskSecret(key.Key)
+		keys[i] = key
+	}
+	config.APIKeys = keys
+
+	adminKeys := make([]string, len(config.AdminKeys))
+	for i, key := range config.AdminKeys {
+		adminKeys[i] = maskSecret(key)
+	}
+	config.AdminKeys = adminKeys
+
+	backends := make(map[string]BackendConfig, len(config.Backends))
+	for name, bc := range config.Backends {
+		bc.AccessKeyID = maskSecret(bc.AccessKeyID)
+		bc.SecretAccessKey = maskSecret(bc.SecretAccessKey)
+		bc.SessionToken = maskSecret(bc.SessionToken)
+		backends[name] = bc
+	}
+	config.Backends = backends
+
+	config.UpstreamProxy = redactURL(config.UpstreamProxy)
+
+	routes := make([]RouteRule, len(config.Routes))
+	for i, rule := range config.Routes {
+		clients := make([]string, len(rule.Match.Clients))
+		for j, client := range rule.Match.Clients {
+			clients[j] = maskClient(config, client)
+		}
+		rule.Match.Clients = clients
+		routes[i] = rule
+	}
+	config.Routes = routes
+
+	pins := make([]KeyPin, len(config.KeyPins))
+	for i, pin := range config.KeyPins {
+		if pin.Client != "" {
+			pin.Client = maskClient(config, pin.Client)
+		}
+		pins[i] = pin
+	}
+	config.KeyPins = pins
+
+	// Client keys are shown as the labels used in audit records
+	names := make(map[string]string, len(config.ClientNames))
+	for key, name := range config.ClientNames {
+		names[clientLabel(key)] = name
+	}
+	config.ClientNames = names
+
+	return config
+}
+
+// maskClient masks a setting that names a client by key or by name. Keys
+// listed in client_names are shown as their labels, and client names and
+// glob patterns as they are. Anything else may be a raw key and is masked.
+func maskClient(config Config, client string) string {
+	if _, ok := config.ClientNames[client]; ok {
+		return clientLabel(client)
+	}
+	for _, names := range []map[string]string{config.ClientNames, config.TLSClientIdentities} {
+		for _, name := range names {
+			if name == client {
+				return client
+			}
+		}
+	}
+	if strings.ContainsAny(client, "*?[") {
+		return client
+	}
+	return maskSecret(client)
+}
+
+// redactURL hides the user information of a URL, which may hold a password
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return maskSecret(raw)
+	}
+	if u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//****@", 1)
+}
+
+// maskSecret hides all but the last four characters of a long secret
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) < 12 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// runModels prints the model and backend each alias resolves to
+func runModels(args []string, stdout io.Writer) error {
+	flags, configPath := commandFlags("models")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	models, err := NewModelStore(config.ModelsFile)
+	if err != nil {
+		return err
+	}
+	s := &Server{config: config, modelMap: buildModelMap(config), models: models}
+
+	aliases := sortedKeys(s.modelMap)
+	for _, model := range models.List() {
+		aliases = append(aliases, model.Name)
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALIAS\tMODEL\tBACKEND\tFALLBACKS")
+	for _, alias := range aliases {
+		fallbacks := "-"
+		for model, chain := range config.Fallbacks {
+			if normalizeModelName(model) == alias && len(chain) > 0 {
+				fallbacks = strings.Join(chain, ",")
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", alias, s.mapModelName(alias), backendName(config, alias), fallbacks)
+	}
+	return tw.Flush()
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
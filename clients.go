@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// requestInfo describes who made a request and for which alias, so that
+// code below the handlers (key selection, accounting) can act on it
+type requestInfo struct {
+	Client string
+	Alias  string
+
+	// Backend is the backend picked by routing, if any
+	Backend string
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns a context carrying info
+func withRequestInfo(ctx context.Context, info requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom returns the request info carried by ctx, if any
+func requestInfoFrom(ctx context.Context) requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info
+}
+
+// clientKey returns the key a client presented to the proxy, taken from a
+// bearer token or an X-Api-Key header as OpenAI and Anthropic clients send.
+// A client sending neither but presenting a certificate with a mapped
+// identity is keyed by that identity. A header key posing as a certificate
+// identity is ignored; withAuth rejects it.
+func clientKey(r *http.Request) string {
+	if key := headerKey(r); key != "" && !strings.HasPrefix(key, certKeyPrefix) {
+		return key
+	}
+	if identity := certIdentityFrom(r.Context()); identity != "" {
+		return certKeyPrefix + identity
+	}
+	return ""
+}
+
+// headerKey returns the key sent in the Authorization or X-Api-Key header
+func headerKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.Header.Get("X-Api-Key")
+}
+
+// knownClient reports whether key is listed in client_names or stands for
+// the certificate identity the request's connection presented
+func knownClient(r *http.Request, names map[string]string, key string) bool {
+	if _, ok := names[key]; ok {
+		return true
+	}
+	identity := certIdentityFrom(r.Context())
+	return identity != "" && key == certKeyPrefix+identity
+}
+
+// clientName returns the name a client key goes by in reports: its entry in
+// client_names, its certificate identity, a hash of the key if it has
+// neither, or "anonymous"
+func clientName(names map[string]string, key string) string {
+	if key == "" {
+		return "anonymous"
+	}
+	if name, ok := names[key]; ok {
+		return name
+	}
+	if identity, ok := strings.CutPrefix(key, certKeyPrefix); ok {
+		return identity
+	}
+	return clientLabel(key)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Ollama endpoints that have no Claude equivalent but that clients call on
+// connect or before first use. They are answered well enough that those
+// clients keep working.
+
+// Handle GET /api/version
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"version": s.config.OllamaVersion})
+}
+
+// pullProgress is one frame of the /api/pull progress stream
+type pullProgress struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+}
+
+// pullSize is the size reported for the single layer of a pulled model
+const pullSize = 4096
+
+// Handle POST /api/pull. There is nothing to download, so known models
+// succeed immediately after a short, realistic progress stream.
+func (s *Server) handlePull(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model  string `json:"model"`
+		Name   string `json:"name"`
+		Stream *bool  `json:"stream"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := req.Model
+	if name == "" {
+		name = req.Name
+	}
+	if !s.knownModel(name) {
+		writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("pull model manifest: model '%s' not found", name))
+		return
+	}
+
+	if req.Stream != nil && !*req.Stream {
+		writeJSON(w, http.StatusOK, pullProgress{Status: "success"})
+		return
+	}
+
+	sum := sha256.Sum256([]byte(normalizeModelName(name)))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	frames := []pullProgress{
+		{Status: "pulling manifest"},
+		{Status: "pulling " + digest[7:19], Digest: digest, Total: pullSize},
+		{Status: "pulling " + digest[7:19], Digest: digest, Total: pullSize, Completed: pullSize},
+		{Status: "verifying sha256 digest"},
+		{Status: "writing manifest"},
+		{Status: "success"},
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for _, frame := range frames {
+		if err := encoder.Encode(frame); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// knownModel reports whether name is a built-in alias, a custom model, a
+// Claude model ID, or an alias named by backend mappings, experiments or
+// routing rules
+func (s *Server) knownModel(name string) bool {
+	name = normalizeModelName(name)
+	if name == "" {
+		return false
+	}
+	if _, ok := s.modelMap[name]; ok {
+		return true
+	}
+	if _, ok := s.models.Get(name); ok {
+		return true
+	}
+	if strings.HasPrefix(name, "claude-") || s.experimentFor(name) != nil {
+		return true
+	}
+	for alias := range s.config.ModelBackends {
+		if normalizeModelName(alias) == name {
+			return true
+		}
+	}
+	for _, rule := range s.config.Routes {
+		if rule.Model != "" && matchAny(rule.Match.Aliases, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle POST /api/push
+func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
+	writeOllamaError(w, http.StatusNotImplemented, "pushing models is not supported: models are served by the Claude API")
+}
+
+// Handle POST /api/embed and /api/embeddings. Claude has no embeddings API,
+// so these are forwarded unchanged to an Ollama-compatible embeddings
+// server if one is configured.
+func (s *Server) handleEmbed(w http.ResponseWriter, r *http.Request) {
+	if s.config.EmbeddingsURL == "" {
+		writeOllamaError(w, http.StatusNotImplemented, "embeddings are not supported: set embeddings_url to forward them to an embeddings server")
+		return
+	}
+
+	target := strings.TrimSuffix(s.config.EmbeddingsURL, "/") + r.URL.Path
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, target, r.Body)
+	if err != nil {
+		writeOllamaError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("Error calling embeddings backend: %v", err)
+		writeOllamaError(w, http.StatusBadGateway, fmt.Sprintf("embeddings backend error: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test the /api/version stub
+func TestHandleVersion(t *testing.T) {
+	server := NewServer(testConfig())
+	recorder := httptest.NewRecorder()
+	server.handleVersion(recorder, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+
+	var resp map[string]string
+	json.NewDecoder(recorder.Body).Decode(&resp)
+	if resp["version"] != "0.5.7" {
+		t.Errorf("Expected version %q, got %q", "0.5.7", resp["version"])
+	}
+}
+
+// Test that /api/pull streams progress for known models and fails otherwise
+func TestHandlePull(t *testing.T) {
+	server := NewServer(testConfig())
+
+	recorder := httptest.NewRecorder()
+	server.handlePull(recorder, httptest.NewRequest(http.MethodPost, "/api/pull", strings.NewReader(`{"model": "claude-3-haiku:latest"}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	var last pullProgress
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if len(lines) < 3 || last.Status != "success" {
+		t.Errorf("Expected a progress stream ending in success, got %q", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handlePull(recorder, httptest.NewRequest(http.MethodPost, "/api/pull", strings.NewReader(`{"model": "llama3"}`)))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown model, got %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+// Test that embeddings are forwarded when a backend is configured
+func TestHandleEmbed(t *testing.T) {
+	server := NewServer(testConfig())
+	recorder := httptest.NewRecorder()
+	server.handleEmbed(recorder, httptest.NewRequest(http.MethodPost, "/api/embed", strings.NewReader(`{}`)))
+	if recorder.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status %d without a backend, got %d", http.StatusNotImplemented, recorder.Code)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"path": "` + r.URL.Path + `", "body": ` + string(body) + `}`))
+	}))
+	defer backend.Close()
+
+	config := testConfig()
+	config.EmbeddingsURL = backend.URL
+	server = NewServer(config)
+
+	recorder = httptest.NewRecorder()
+	server.handleEmbed(recorder, httptest.NewRequest(http.MethodPost, "/api/embeddings", strings.NewReader(`{"model": "nomic"}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), `"path": "/api/embeddings"`) || !strings.Contains(recorder.Body.String(), `"nomic"`) {
+		t.Errorf("Expected request to be forwarded unchanged, got %s", recorder.Body.String())
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 )
 
 // Config represents the application configuration
@@ -14,24 +17,187 @@ type Config struct {
 	// Server configuration
 	Port string `json:"port"`
 
+	// Addresses to listen on, such as "127.0.0.1:8080", ":8443" or
+	// "unix:/run/proxy.sock", in place of every interface on port
+	Listen []string `json:"listen"`
+
+	// HTTPS on TCP listeners. The certificate files are re-read when they
+	// change. Client certificates are verified against tls_client_ca_file
+	// when tls_client_auth is "request" or "require", and their subjects
+	// map to client identities through tls_client_identities.
+	TLSCertFile         string            `json:"tls_cert_file"`
+	TLSKeyFile          string            `json:"tls_key_file"`
+	TLSClientCAFile     string            `json:"tls_client_ca_file"`
+	TLSClientAuth       string            `json:"tls_client_auth"`
+	TLSClientIdentities map[string]string `json:"tls_client_identities"`
+
+	// On SIGTERM, readiness fails for shutdown_delay_secs while new requests
+	// are still accepted, then in-flight requests get drain_secs to finish
+	// before their upstream calls are cancelled
+	ShutdownDelaySecs int `json:"shutdown_delay_secs"`
+	DrainSecs         int `json:"drain_secs"`
+
+	// How long /readyz caches its upstream checks; 0 disables the checks
+	ReadinessCheckSecs int `json:"readiness_check_secs"`
+
+	// How often the config file is checked for changes; 0 disables the
+	// check, leaving SIGHUP as the only way to reload
+	ConfigWatchSecs int `json:"config_watch_secs"`
+
+	// Inbound access. With require_client_key set, requests other than
+	// health checks, metrics and the UI page need a key listed in
+	// client_names or a client certificate with a mapped identity.
+	// max_concurrent_requests caps the requests in flight; 0 means no cap.
+	RequireClientKey      bool `json:"require_client_key"`
+	MaxConcurrentRequests int  `json:"max_concurrent_requests"`
+
+	// Keys for the /admin/ routes, which show every client's prompts, spend
+	// and key status; with none, the admin routes are turned off.
+	// admin_keys_file holds them one per line.
+	AdminKeys     []string `json:"admin_keys"`
+	AdminKeysFile string   `json:"admin_keys_file"`
+
+	// Request checks: the largest body accepted, 0 meaning no limit, and
+	// whether fields the API does not know are rejected
+	MaxRequestBytes int64 `json:"max_request_bytes"`
+	StrictRequests  bool  `json:"strict_requests"`
+
+	// Context window checks. count_tokens_upstream counts with the
+	// backend's count_tokens API instead of the local estimate, and
+	// context_overflow is "reject" or "truncate" for a request too long for
+	// its model. Truncation follows truncation_strategy and always keeps the
+	// latest truncation_keep_messages.
+	CountTokensUpstream    bool   `json:"count_tokens_upstream"`
+	ContextOverflow        string `json:"context_overflow"`
+	TruncationStrategy     string `json:"truncation_strategy"`
+	TruncationKeepMessages int    `json:"truncation_keep_messages"`
+	TruncationSummaryModel string `json:"truncation_summary_model"`
+
+	// CORS policy for browser clients. Origins are exact, such as
+	// https://app.example.com, wildcard subdomains, such as
+	// https://*.example.com, or "*"; with none, CORS is off.
+	CORSOrigins          []string `json:"cors_origins"`
+	CORSMethods          []string `json:"cors_methods"`
+	CORSHeaders          []string `json:"cors_headers"`
+	CORSAllowCredentials bool     `json:"cors_allow_credentials"`
+	CORSMaxAgeSecs       int      `json:"cors_max_age_secs"`
+
 	// Claude API configuration
 	APIKey             string `json:"api_key"`
+	APIKeyFile         string `json:"api_key_file"`
 	APIVersion         string `json:"api_version"`
 	APIEndpoint        string `json:"api_endpoint"`
 	SystemPrompt       string `json:"system_prompt"`
 	DefaultModel       string `json:"default_model"`
 	RequestTimeoutSecs int    `json:"request_timeout_secs"`
+
+	// System prompts per alias and client, and how the configured prompt is
+	// combined with one the client sends. All prompts are Go templates.
+	SystemPrompts      []SystemPromptRule `json:"system_prompts"`
+	SystemPromptPolicy string             `json:"system_prompt_policy"`
+
+	// Shared HTTP transport for upstream calls. Timeouts of 0 mean none;
+	// request_timeout_secs bounds the whole call.
+	UpstreamProxy                     string `json:"upstream_proxy"`
+	UpstreamCAFile                    string `json:"upstream_ca_file"`
+	UpstreamClientCertFile            string `json:"upstream_client_cert_file"`
+	UpstreamClientKeyFile             string `json:"upstream_client_key_file"`
+	UpstreamMaxIdleConns              int    `json:"upstream_max_idle_conns"`
+	UpstreamMaxIdleConnsPerHost       int    `json:"upstream_max_idle_conns_per_host"`
+	UpstreamMaxConnsPerHost           int    `json:"upstream_max_conns_per_host"`
+	UpstreamIdleConnTimeoutSecs       int    `json:"upstream_idle_conn_timeout_secs"`
+	UpstreamDisableHTTP2              bool   `json:"upstream_disable_http2"`
+	UpstreamConnectTimeoutSecs        int    `json:"upstream_connect_timeout_secs"`
+	UpstreamTLSTimeoutSecs            int    `json:"upstream_tls_timeout_secs"`
+	UpstreamResponseHeaderTimeoutSecs int    `json:"upstream_response_header_timeout_secs"`
+
+	// Pool of named upstream keys used in place of APIKey when set
+	APIKeys           []APIKeyConfig `json:"api_keys"`
+	KeyStrategy       string         `json:"key_strategy"`
+	KeyQuarantineSecs int            `json:"key_quarantine_secs"`
+	KeyPins           []KeyPin       `json:"key_pins"`
+
+	// Additional backends (Bedrock, Vertex AI) and which aliases use them
+	Backends       map[string]BackendConfig `json:"backends"`
+	ModelBackends  map[string]string        `json:"model_backends"`
+	DefaultBackend string                   `json:"default_backend"`
+	Fallbacks      map[string][]string      `json:"fallbacks"`
+
+	// Ordered routing rules that override the model mapping and backend
+	Routes []RouteRule `json:"routes"`
+
+	// A/B experiments and shadow traffic, recorded to the audit file
+	Experiments []Experiment `json:"experiments"`
+	AuditFile   string       `json:"audit_file"`
+
+	// Cost accounting: prices in USD per million tokens keyed by model ID
+	// prefix, names for client keys in reports, and monthly spend caps.
+	// client_key_files adds client names whose keys are read from files.
+	Prices         map[string]ModelPrice `json:"prices"`
+	ClientNames    map[string]string     `json:"client_names"`
+	ClientKeyFiles map[string]string     `json:"client_key_files"`
+	SpendCaps      []SpendCap            `json:"spend_caps"`
+	UsageFile      string                `json:"usage_file"`
+
+	// Circuit breakers per backend and model; an error rate of 0 disables them
+	BreakerErrorRate    float64 `json:"breaker_error_rate"`
+	BreakerMinRequests  int     `json:"breaker_min_requests"`
+	BreakerWindowSecs   int     `json:"breaker_window_secs"`
+	BreakerOpenSecs     int     `json:"breaker_open_secs"`
+	BreakerSlowCallSecs int     `json:"breaker_slow_call_secs"`
+
+	// Ollama context emulation for /api/generate
+	ContextTTLSecs     int `json:"context_ttl_secs"`
+	ContextMaxEntries  int `json:"context_max_entries"`
+	ContextMaxMessages int `json:"context_max_messages"`
+
+	// Server-side conversation sessions
+	SessionDir          string `json:"session_dir"`
+	SessionSummaryModel string `json:"session_summary_model"`
+
+	// Custom models created through /api/create
+	ModelsFile string `json:"models_file"`
+
+	// Ollama client compatibility
+	OllamaVersion string `json:"ollama_version"`
+	EmbeddingsURL string `json:"embeddings_url"`
 }
 
 // DefaultConfig returns the default configuration
 func DefaultConfig() Config {
 	return Config{
-		Port:               "8080",
-		APIVersion:         "2023-06-01",
-		APIEndpoint:        "https://api.anthropic.com/v1/messages",
-		SystemPrompt:       "You are Claude, an AI assistant by Anthropic.",
-		DefaultModel:       "claude-3-5-sonnet-20240620",
-		RequestTimeoutSecs: 60,
+		Port:                        "8080",
+		ConfigWatchSecs:             10,
+		DrainSecs:                   25,
+		MaxRequestBytes:             10 << 20,
+		ContextOverflow:             ContextOverflowReject,
+		TruncationStrategy:          TruncationDropOldest,
+		CORSMethods:                 []string{"GET", "POST", "DELETE"},
+		CORSHeaders:                 []string{"Content-Type", "Authorization", "X-Api-Key", "Anthropic-Version", "X-Request-Id"},
+		CORSMaxAgeSecs:              600,
+		APIVersion:                  "2023-06-01",
+		APIEndpoint:                 "https://api.anthropic.com/v1/messages",
+		SystemPrompt:                "You are Claude, an AI assistant by Anthropic.",
+		SystemPromptPolicy:          SystemPolicyReplace,
+		DefaultModel:                "claude-3-5-sonnet-20240620",
+		RequestTimeoutSecs:          60,
+		UpstreamMaxIdleConns:        100,
+		UpstreamMaxIdleConnsPerHost: 16,
+		UpstreamIdleConnTimeoutSecs: 90,
+		UpstreamConnectTimeoutSecs:  10,
+		UpstreamTLSTimeoutSecs:      10,
+		KeyStrategy:                 KeyStrategyRoundRobin,
+		KeyQuarantineSecs:           60,
+		DefaultBackend:              BackendAnthropic,
+		Prices:                      defaultPrices(),
+		BreakerErrorRate:            0.5,
+		BreakerMinRequests:          10,
+		BreakerWindowSecs:           60,
+		BreakerOpenSecs:             30,
+		ContextTTLSecs:              1800,
+		ContextMaxEntries:           1000,
+		ContextMaxMessages:          50,
+		OllamaVersion:               "0.5.7",
 	}
 }
 
@@ -54,6 +220,11 @@ func LoadConfig(configPath string) (Config, error) {
 	// Override with environment variables
 	applyEnvVars(&config)
 
+	// Read secrets kept in their own files
+	if err := loadSecretFiles(&config); err != nil {
+		return config, err
+	}
+
 	// Validate config
 	if err := validateConfig(config); err != nil {
 		return config, err
@@ -62,33 +233,60 @@ func LoadConfig(configPath string) (Config, error) {
 	return config, nil
 }
 
-// loadConfigFile loads configuration from a JSON file
+// loadConfigFile loads configuration from a JSON, YAML or TOML file. A
+// field the Config does not have is an error rather than being ignored.
 func loadConfigFile(config *Config, configPath string) error {
+	data, expandedPath, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	log.Printf("Loaded configuration from %s", expandedPath)
+	return nil
+}
+
+// readConfigFile reads a config file as JSON, whatever its format, with
+// ${VAR} references replaced. It also returns the file's absolute path.
+func readConfigFile(configPath string) ([]byte, string, error) {
 	// Expand path if needed
 	expandedPath, err := filepath.Abs(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to resolve config path: %w", err)
+		return nil, "", fmt.Errorf("failed to resolve config path: %w", err)
 	}
 
 	// Open file
 	file, err := os.Open(expandedPath)
 	if err != nil {
-		return fmt.Errorf("failed to open config file: %w", err)
+		return nil, "", fmt.Errorf("failed to open config file: %w", err)
 	}
 	defer file.Close()
 
-	// Read and parse JSON
 	bytes, err := io.ReadAll(file)
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+		return nil, "", fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	if err := json.Unmarshal(bytes, config); err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+	// Every format is decoded through JSON so that the json tags name the
+	// fields and unknown ones are caught the same way
+	fields, err := decodeConfigFile(expandedPath, bytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse config file: %w", err)
 	}
-
-	log.Printf("Loaded configuration from %s", expandedPath)
-	return nil
+	fields, err = interpolateEnv(fields, reflect.TypeOf(Config{}))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to interpolate config file: %w", err)
+	}
+	bytes, err = json.Marshal(fields)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode config file: %w", err)
+	}
+	return bytes, expandedPath, nil
 }
 
 // applyEnvVars overrides config with environment variables
@@ -101,6 +299,12 @@ func applyEnvVars(config *Config) {
 	// API config
 	if apiKey := os.Getenv("ANTHROPIC_API_KEY"); apiKey != "" {
 		config.APIKey = apiKey
+		config.APIKeyFile = ""
+	}
+
+	if apiKeyFile := os.Getenv("ANTHROPIC_API_KEY_FILE"); apiKeyFile != "" {
+		config.APIKeyFile = apiKeyFile
+		config.APIKey = ""
 	}
 
 	if apiVersion := os.Getenv("CLAUDE_API_VERSION"); apiVersion != "" {
@@ -119,6 +323,34 @@ func applyEnvVars(config *Config) {
 		config.DefaultModel = defaultModel
 	}
 
+	if sessionDir := os.Getenv("SESSION_DIR"); sessionDir != "" {
+		config.SessionDir = sessionDir
+	}
+
+	if modelsFile := os.Getenv("MODELS_FILE"); modelsFile != "" {
+		config.ModelsFile = modelsFile
+	}
+
+	if embeddingsURL := os.Getenv("EMBEDDINGS_URL"); embeddingsURL != "" {
+		config.EmbeddingsURL = embeddingsURL
+	}
+
+	if auditFile := os.Getenv("AUDIT_FILE"); auditFile != "" {
+		config.AuditFile = auditFile
+	}
+
+	if usageFile := os.Getenv("USAGE_FILE"); usageFile != "" {
+		config.UsageFile = usageFile
+	}
+
+	if proxy := os.Getenv("UPSTREAM_PROXY"); proxy != "" {
+		config.UpstreamProxy = proxy
+	}
+
+	if caFile := os.Getenv("UPSTREAM_CA_FILE"); caFile != "" {
+		config.UpstreamCAFile = caFile
+	}
+
 	if timeoutStr := os.Getenv("REQUEST_TIMEOUT_SECS"); timeoutStr != "" {
 		var timeout int
 		if _, err := fmt.Sscanf(timeoutStr, "%d", &timeout); err == nil && timeout > 0 {
@@ -129,15 +361,230 @@ func applyEnvVars(config *Config) {
 
 // validateConfig validates the configuration
 func validateConfig(config Config) error {
-	// APIKey is required
-	if config.APIKey == "" {
+	// APIKey is required unless a key pool is configured
+	if config.APIKey == "" && len(config.APIKeys) == 0 {
 		return fmt.Errorf("API key is required")
 	}
 
+	if err := validateKeyPool(config); err != nil {
+		return err
+	}
+
+	if err := validateBackends(config); err != nil {
+		return err
+	}
+
+	if err := validateListeners(config); err != nil {
+		return err
+	}
+
+	if err := validateCORS(config); err != nil {
+		return err
+	}
+
+	if err := validateSystemPrompts(config); err != nil {
+		return err
+	}
+
+	if err := validateRoutes(config); err != nil {
+		return err
+	}
+
+	if err := validateExperiments(config); err != nil {
+		return err
+	}
+
+	if err := validateUsage(config); err != nil {
+		return err
+	}
+
+	if err := validateBreakers(config); err != nil {
+		return err
+	}
+
+	if err := validateTransport(config); err != nil {
+		return err
+	}
+
 	// Validate timeout is reasonable
 	if config.RequestTimeoutSecs <= 0 {
 		return fmt.Errorf("request timeout must be positive")
 	}
 
+	if config.ShutdownDelaySecs < 0 || config.DrainSecs < 0 {
+		return fmt.Errorf("shutdown delay and drain period must not be negative")
+	}
+
+	if config.ReadinessCheckSecs < 0 {
+		return fmt.Errorf("readiness check interval must not be negative")
+	}
+
+	if config.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("max concurrent requests must not be negative")
+	}
+
+	if config.MaxRequestBytes < 0 {
+		return fmt.Errorf("max request bytes must not be negative")
+	}
+
+	if err := validateTruncation(config); err != nil {
+		return err
+	}
+
+	for i, key := range config.AdminKeys {
+		if strings.TrimSpace(key) == "" {
+			return fmt.Errorf("admin_keys[%d] must not be empty", i)
+		}
+	}
+
+	if config.RequireClientKey && len(config.ClientNames) == 0 && len(config.TLSClientIdentities) == 0 {
+		return fmt.Errorf("require_client_key needs at least one key in client_names or identity in tls_client_identities")
+	}
+
+	if config.ConfigWatchSecs < 0 {
+		return fmt.Errorf("config watch interval must not be negative")
+	}
+
+	if config.ContextTTLSecs <= 0 {
+		return fmt.Errorf("context TTL must be positive")
+	}
+
+	return nil
+}
+
+// validateKeyPool validates the upstream key pool settings
+func validateKeyPool(config Config) error {
+	names := make(map[string]bool)
+	for i, key := range config.APIKeys {
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("api_keys[%d] needs a name and a key", i)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("duplicate API key name %q", key.Name)
+		}
+		if key.Weight < 0 {
+			return fmt.Errorf("API key %q has a negative weight", key.Name)
+		}
+		names[key.Name] = true
+	}
+
+	switch config.KeyStrategy {
+	case KeyStrategyRoundRobin, KeyStrategyLeastRecentlyLimited, KeyStrategyWeighted:
+	default:
+		return fmt.Errorf("unknown key strategy %q", config.KeyStrategy)
+	}
+
+	if config.KeyQuarantineSecs < 0 {
+		return fmt.Errorf("key quarantine must not be negative")
+	}
+
+	for _, pin := range config.KeyPins {
+		if (pin.Client == "") == (pin.Model == "") {
+			return fmt.Errorf("key pin for %q must set exactly one of client and model", pin.Key)
+		}
+		if !names[pin.Key] {
+			return fmt.Errorf("key pin refers to unknown API key %q", pin.Key)
+		}
+	}
+
+	return nil
+}
+
+// validateBackends checks that backends are complete and that every alias
+// refers to a backend that exists
+func validateBackends(config Config) error {
+	for name, bc := range config.Backends {
+		switch bc.Type {
+		case BackendAnthropic:
+		case BackendBedrock:
+			if bc.Region == "" {
+				return fmt.Errorf("backend %q needs a region", name)
+			}
+		case BackendVertex:
+			if bc.Region == "" || bc.ProjectID == "" || bc.CredentialsFile == "" {
+				return fmt.Errorf("backend %q needs a region, project_id and credentials_file", name)
+			}
+		case BackendOllama:
+			if bc.Endpoint == "" {
+				return fmt.Errorf("backend %q needs an endpoint", name)
+			}
+		default:
+			return fmt.Errorf("backend %q has unknown type %q", name, bc.Type)
+		}
+	}
+
+	exists := func(name string) bool {
+		_, ok := config.Backends[name]
+		return ok || name == BackendAnthropic
+	}
+	isClaude := func(name string) bool {
+		return exists(name) && config.Backends[name].Type != BackendOllama
+	}
+	if !isClaude(config.DefaultBackend) {
+		return fmt.Errorf("default backend %q is not a configured Claude backend", config.DefaultBackend)
+	}
+	for alias, name := range config.ModelBackends {
+		if !isClaude(name) {
+			return fmt.Errorf("model %q uses unknown backend %q", alias, name)
+		}
+	}
+	for alias, chain := range config.Fallbacks {
+		for _, name := range chain {
+			if !exists(name) {
+				return fmt.Errorf("fallback for model %q uses unknown backend %q", alias, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateBreakers validates the circuit breaker thresholds
+func validateBreakers(config Config) error {
+	if config.BreakerErrorRate < 0 || config.BreakerErrorRate > 1 {
+		return fmt.Errorf("breaker error rate must be between 0 and 1")
+	}
+	if config.BreakerErrorRate == 0 {
+		return nil
+	}
+	if config.BreakerMinRequests <= 0 {
+		return fmt.Errorf("breaker minimum requests must be positive")
+	}
+	if config.BreakerWindowSecs <= 0 || config.BreakerOpenSecs <= 0 {
+		return fmt.Errorf("breaker window and open period must be positive")
+	}
+	if config.BreakerSlowCallSecs < 0 {
+		return fmt.Errorf("breaker slow call threshold must not be negative")
+	}
+	return nil
+}
+
+// validateTransport validates the upstream HTTP transport settings
+func validateTransport(config Config) error {
+	if config.UpstreamProxy != "" {
+		proxyURL, err := url.Parse(config.UpstreamProxy)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return fmt.Errorf("upstream proxy %q is not a valid URL", config.UpstreamProxy)
+		}
+	}
+
+	if (config.UpstreamClientCertFile == "") != (config.UpstreamClientKeyFile == "") {
+		return fmt.Errorf("upstream client certificate and key must be set together")
+	}
+
+	for name, value := range map[string]int{
+		"upstream_max_idle_conns":               config.UpstreamMaxIdleConns,
+		"upstream_max_idle_conns_per_host":      config.UpstreamMaxIdleConnsPerHost,
+		"upstream_max_conns_per_host":           config.UpstreamMaxConnsPerHost,
+		"upstream_idle_conn_timeout_secs":       config.UpstreamIdleConnTimeoutSecs,
+		"upstream_connect_timeout_secs":         config.UpstreamConnectTimeoutSecs,
+		"upstream_tls_timeout_secs":             config.UpstreamTLSTimeoutSecs,
+		"upstream_response_header_timeout_secs": config.UpstreamResponseHeaderTimeoutSecs,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+
 	return nil
 }
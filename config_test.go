@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes data to name in a temporary directory and returns its path
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// clearConfigEnv unsets the environment variables that override the config
+// file for the duration of a test
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"ANTHROPIC_API_KEY", "ANTHROPIC_API_KEY_FILE", "CLAUDE_DEFAULT_MODEL", "REQUEST_TIMEOUT_SECS"} {
+		t.Setenv(name, "")
+	}
+}
+
+// Test that YAML and TOML files load the same settings as JSON
+func TestLoadConfigFormats(t *testing.T) {
+	clearConfigEnv(t)
+	files := map[string]string{
+		"config.json": `{"api_key": "sk-test", "request_timeout_secs": 90, "model_backends": {"opus": "anthropic"}}`,
+		"config.yaml": "api_key: sk-test\nrequest_timeout_secs: 90\nmodel_backends:\n  opus: anthropic\n",
+		"config.toml": "api_key = \"sk-test\"\nrequest_timeout_secs = 90\n[model_backends]\nopus = \"anthropic\"\n",
+	}
+
+	for name, data := range files {
+		config, err := LoadConfig(writeFile(t, name, data))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			continue
+		}
+		if config.APIKey != "sk-test" || config.RequestTimeoutSecs != 90 || config.ModelBackends["opus"] != BackendAnthropic {
+			t.Errorf("%s: settings not loaded: %+v", name, config)
+		}
+		if config.DefaultModel != DefaultConfig().DefaultModel {
+			t.Errorf("%s: expected unset fields to keep their defaults", name)
+		}
+	}
+}
+
+// Test that misspelt fields are rejected in every format
+func TestLoadConfigUnknownField(t *testing.T) {
+	clearConfigEnv(t)
+	files := map[string]string{
+		"config.json": `{"api_key": "sk-test", "request_timeout": 90}`,
+		"config.yaml": "api_key: sk-test\nbackends:\n  eu:\n    type: bedrock\n    regoin: eu-west-1\n",
+		"config.toml": "api_key = \"sk-test\"\nrequest_timeout = 90\n",
+	}
+
+	for name, data := range files {
+		_, err := LoadConfig(writeFile(t, name, data))
+		if err == nil || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("%s: expected an unknown field error, got %v", name, err)
+		}
+	}
+}
+
+// Test ${VAR} interpolation, defaults and the error for unset variables
+func TestLoadConfigInterpolation(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("TEST_PROXY_KEY", "sk-from-env")
+	t.Setenv("TEST_PROXY_TIMEOUT", "45")
+
+	path := writeFile(t, "config.yaml", "api_key: ${TEST_PROXY_KEY}\n"+
+		"request_timeout_secs: ${TEST_PROXY_TIMEOUT}\n"+
+		"default_model: ${TEST_PROXY_UNSET:-claude-3-haiku-20240307}\n"+
+		"system_prompt: \"Prices are in $${CURRENCY}\"\n")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.APIKey != "sk-from-env" || config.RequestTimeoutSecs != 45 {
+		t.Errorf("Expected values from the environment, got %q and %d", config.APIKey, config.RequestTimeoutSecs)
+	}
+	if config.DefaultModel != "claude-3-haiku-20240307" {
+		t.Errorf("Expected the default value, got %q", config.DefaultModel)
+	}
+	if config.SystemPrompt != "Prices are in ${CURRENCY}" {
+		t.Errorf("Expected $${ to be a literal, got %q", config.SystemPrompt)
+	}
+
+	// Values are substituted after parsing, so quotes and newlines are kept
+	// as they are in every format
+	t.Setenv("TEST_PROXY_PROMPT", "Say \"hi\"\nthen stop")
+	for name, data := range map[string]string{
+		"config.json": `{"api_key": "sk", "system_prompt": "${TEST_PROXY_PROMPT}", "request_timeout_secs": "${TEST_PROXY_TIMEOUT}"}`,
+		"config.yaml": "api_key: sk\nsystem_prompt: ${TEST_PROXY_PROMPT}\nrequest_timeout_secs: ${TEST_PROXY_TIMEOUT}\n",
+		"config.toml": "api_key = \"sk\"\nsystem_prompt = \"${TEST_PROXY_PROMPT}\"\nrequest_timeout_secs = \"${TEST_PROXY_TIMEOUT}\"\n",
+	} {
+		config, err := LoadConfig(writeFile(t, name, data))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if config.SystemPrompt != "Say \"hi\"\nthen stop" || config.RequestTimeoutSecs != 45 {
+			t.Errorf("%s: expected the value unchanged, got %q and %d", name, config.SystemPrompt, config.RequestTimeoutSecs)
+		}
+	}
+
+	_, err = LoadConfig(writeFile(t, "config.json", `{"api_key": "${TEST_PROXY_UNSET}"}`))
+	if err == nil || !strings.Contains(err.Error(), "TEST_PROXY_UNSET") {
+		t.Errorf("Expected an error naming the unset variable, got %v", err)
+	}
+}
+
+// Test that secrets are read from *_file settings
+func TestLoadConfigSecretFiles(t *testing.T) {
+	clearConfigEnv(t)
+	keyFile := writeFile(t, "api-key", "sk-from-file\n")
+	secretFile := writeFile(t, "aws-secret", "aws-secret\n")
+
+	path := writeFile(t, "config.json", `{
+		"api_key_file": "`+keyFile+`",
+		"backends": {"eu": {"type": "bedrock", "region": "eu-west-1", "access_key_id": "AKIA", "secret_access_key_file": "`+secretFile+`"}}
+	}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.APIKey != "sk-from-file" {
+		t.Errorf("Expected the key from the file, got %q", config.APIKey)
+	}
+	if config.Backends["eu"].SecretAccessKey != "aws-secret" {
+		t.Errorf("Expected the backend secret from the file, got %q", config.Backends["eu"].SecretAccessKey)
+	}
+
+	// The environment takes precedence over the file
+	t.Setenv("ANTHROPIC_API_KEY", "sk-from-env")
+	if config, _ = LoadConfig(path); config.APIKey != "sk-from-env" {
+		t.Errorf("Expected ANTHROPIC_API_KEY to win, got %q", config.APIKey)
+	}
+
+	both := writeFile(t, "both.json", `{"api_keys": [{"name": "a", "key": "sk-a", "key_file": "`+keyFile+`"}]}`)
+	if _, err := LoadConfig(both); err == nil || !strings.Contains(err.Error(), "not both") {
+		t.Errorf("Expected an error for a key and a key file, got %v", err)
+	}
+
+	// Admin keys are read one per line, and client keys each from a file
+	adminFile := writeFile(t, "admin-keys", "sk-admin-one\n\nsk-admin-two\n")
+	clientFile := writeFile(t, "ci-key", "sk-ci\n")
+	path = writeFile(t, "clients.json", `{
+		"admin_keys_file": "`+adminFile+`",
+		"client_names": {"sk-team": "team"},
+		"client_key_files": {"ci": "`+clientFile+`"}
+	}`)
+	if config, err = LoadConfig(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.AdminKeys) != 2 || config.AdminKeys[1] != "sk-admin-two" {
+		t.Errorf("Expected two admin keys from the file, got %v", config.AdminKeys)
+	}
+	if config.ClientNames["sk-ci"] != "ci" || config.ClientNames["sk-team"] != "team" {
+		t.Errorf("Expected the client key from the file alongside client_names, got %v", config.ClientNames)
+	}
+
+	for name, data := range map[string]string{
+		"admin-both.json":  `{"admin_keys": ["sk-admin"], "admin_keys_file": "` + adminFile + `"}`,
+		"client-both.json": `{"client_names": {"sk-ci": "other"}, "client_key_files": {"ci": "` + clientFile + `"}}`,
+	} {
+		if _, err := LoadConfig(writeFile(t, name, data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
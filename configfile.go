@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envRefPattern matches ${VAR} and ${VAR:-default}, and the $${ escape
+var envRefPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// interpolateEnv replaces ${VAR} references in the string values of a
+// decoded config file with the variable's value, or the default given as
+// ${VAR:-default}. Values are substituted after parsing, so they need no
+// quoting or escaping. A string holding a reference may stand for a number
+// or boolean where the Config, walked alongside as t, has one. $${ is a
+// literal ${.
+func interpolateEnv(value interface{}, t reflect.Type) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	elem := func() reflect.Type {
+		if t != nil && (t.Kind() == reflect.Map || t.Kind() == reflect.Slice) {
+			return t.Elem()
+		}
+		return nil
+	}
+
+	var err error
+	switch v := value.(type) {
+	case string:
+		return expandEnv(v, t)
+	case map[string]interface{}:
+		for key, item := range v {
+			itemType := elem()
+			if t != nil && t.Kind() == reflect.Struct {
+				itemType = jsonFieldType(t, key)
+			}
+			if v[key], err = interpolateEnv(item, itemType); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			if v[i], err = interpolateEnv(item, elem()); err != nil {
+				return nil, err
+			}
+		}
+	case []map[string]interface{}:
+		for _, item := range v {
+			if _, err = interpolateEnv(item, elem()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+// expandEnv replaces the references in one string value
+func expandEnv(value string, t reflect.Type) (interface{}, error) {
+	if !envRefPattern.MatchString(value) {
+		return value, nil
+	}
+
+	var missing []string
+	out := envRefPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envRefPattern.FindStringSubmatch(ref)
+		if value, ok := os.LookupEnv(m[1]); ok {
+			return value
+		}
+		if len(m[2]) > 0 {
+			return m[2][2:]
+		}
+		missing = append(missing, m[1])
+		return ref
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+
+	if t != nil && t.Kind() != reflect.String && json.Valid([]byte(out)) {
+		return json.RawMessage(out), nil
+	}
+	return out, nil
+}
+
+// jsonFieldType returns the type of the struct field with the JSON name
+// name, or nil if there is none
+func jsonFieldType(t reflect.Type, name string) reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == name {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+// decodeConfigFile decodes a JSON, YAML or TOML config file into generic
+// values
+func decodeConfigFile(path string, data []byte) (interface{}, error) {
+	var fields map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, err
+		}
+	}
+
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	return fields, nil
+}
+
+// loadSecretFiles fills each secret from its *_file setting. Mounted
+// Kubernetes secrets and Docker secrets end in a newline, which is trimmed.
+func loadSecretFiles(config *Config) error {
+	if err := readSecretFile("api_key", &config.APIKey, config.APIKeyFile); err != nil {
+		return err
+	}
+
+	for i := range config.APIKeys {
+		key := &config.APIKeys[i]
+		if err := readSecretFile(fmt.Sprintf("api_keys[%d].key", i), &key.Key, key.KeyFile); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(config.Backends))
+	for name := range config.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		bc := config.Backends[name]
+		prefix := "backends." + name + "."
+		if err := readSecretFile(prefix+"access_key_id", &bc.AccessKeyID, bc.AccessKeyIDFile); err != nil {
+			return err
+		}
+		if err := readSecretFile(prefix+"secret_access_key", &bc.SecretAccessKey, bc.SecretAccessKeyFile); err != nil {
+			return err
+		}
+		if err := readSecretFile(prefix+"session_token", &bc.SessionToken, bc.SessionTokenFile); err != nil {
+			return err
+		}
+		config.Backends[name] = bc
+	}
+
+	if err := readAdminKeysFile(config); err != nil {
+		return err
+	}
+
+	names = names[:0]
+	for name := range config.ClientKeyFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var key string
+		if err := readSecretFile("client_key_files."+name, &key, config.ClientKeyFiles[name]); err != nil {
+			return err
+		}
+		if _, ok := config.ClientNames[key]; ok {
+			return fmt.Errorf("the key in client_key_files.%s is also listed in client_names", name)
+		}
+		if config.ClientNames == nil {
+			config.ClientNames = make(map[string]string)
+		}
+		config.ClientNames[key] = name
+	}
+
+	return nil
+}
+
+// readAdminKeysFile sets admin_keys from admin_keys_file, one key per line
+func readAdminKeysFile(config *Config) error {
+	if config.AdminKeysFile == "" {
+		return nil
+	}
+	if len(config.AdminKeys) > 0 {
+		return fmt.Errorf("set admin_keys or admin_keys_file, not both")
+	}
+
+	data, err := os.ReadFile(config.AdminKeysFile)
+	if err != nil {
+		return fmt.Errorf("failed to read admin_keys_file: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key := strings.TrimSpace(line); key != "" {
+			config.AdminKeys = append(config.AdminKeys, key)
+		}
+	}
+	if len(config.AdminKeys) == 0 {
+		return fmt.Errorf("admin_keys_file %s is empty", config.AdminKeysFile)
+	}
+	return nil
+}
+
+// readSecretFile sets value from the file at path, if path is set
+func readSecretFile(field string, value *string, path string) error {
+	if path == "" {
+		return nil
+	}
+	if *value != "" {
+		return fmt.Errorf("set %s or %s_file, not both", field, field)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s_file: %w", field, err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return fmt.Errorf("%s_file %s is empty", field, path)
+	}
+	*value = secret
+	return nil
+}
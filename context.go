@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// contextMagic marks a context array as one issued by this proxy. Ollama
+// returns real token IDs here; we return an opaque handle instead.
+const contextMagic = 0x0C1A
+
+// contextEntry holds the conversation behind a context handle
+type contextEntry struct {
+	messages []Message
+	expires  time.Time
+}
+
+// ContextStore emulates Ollama's /api/generate context array by keeping
+// conversation history server-side and handing clients an opaque handle
+type ContextStore struct {
+	mu          sync.Mutex
+	entries     map[uint64]*contextEntry
+	ttl         time.Duration
+	maxEntries  int
+	maxMessages int
+	now         func() time.Time
+}
+
+// NewContextStore creates a context store with the given limits
+func NewContextStore(ttl time.Duration, maxEntries, maxMessages int) *ContextStore {
+	return &ContextStore{
+		entries:     make(map[uint64]*contextEntry),
+		ttl:         ttl,
+		maxEntries:  maxEntries,
+		maxMessages: maxMessages,
+		now:         time.Now,
+	}
+}
+
+// Get returns the messages behind a context handle. The second return value
+// is false if the handle is malformed, unknown or expired.
+func (cs *ContextStore) Get(handle []int) ([]Message, bool) {
+	id, ok := decodeContextHandle(handle)
+	if !ok {
+		return nil, false
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	entry, exists := cs.entries[id]
+	if !exists {
+		return nil, false
+	}
+	if cs.now().After(entry.expires) {
+		delete(cs.entries, id)
+		return nil, false
+	}
+
+	messages := make([]Message, len(entry.messages))
+	copy(messages, entry.messages)
+	return messages, true
+}
+
+// Put stores a conversation and returns a new handle for it. Handles are
+// immutable, so a client can branch a conversation by reusing an old one.
+func (cs *ContextStore) Put(messages []Message) []int {
+	messages = trimHistory(messages, cs.maxMessages)
+	stored := make([]Message, len(messages))
+	copy(stored, messages)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := cs.now()
+	cs.evictLocked(now)
+
+	id := newContextID()
+	for _, exists := cs.entries[id]; exists; _, exists = cs.entries[id] {
+		id = newContextID()
+	}
+	cs.entries[id] = &contextEntry{messages: stored, expires: now.Add(cs.ttl)}
+
+	return encodeContextHandle(id)
+}
+
+// Len returns the number of live entries in the store
+func (cs *ContextStore) Len() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.entries)
+}
+
+// evictLocked drops expired entries, then the entries closest to expiry
+// until there is room for one more. Callers must hold cs.mu.
+func (cs *ContextStore) evictLocked(now time.Time) {
+	for id, entry := range cs.entries {
+		if now.After(entry.expires) {
+			delete(cs.entries, id)
+		}
+	}
+
+	if cs.maxEntries <= 0 {
+		return
+	}
+
+	for len(cs.entries) >= cs.maxEntries {
+		var oldestID uint64
+		var oldest time.Time
+		first := true
+		for id, entry := range cs.entries {
+			if first || entry.expires.Before(oldest) {
+				oldestID, oldest, first = id, entry.expires, false
+			}
+		}
+		delete(cs.entries, oldestID)
+	}
+}
+
+// trimHistory keeps at most max messages, dropping the oldest first. The
+// result always starts with a user message as the Messages API requires.
+func trimHistory(messages []Message, max int) []Message {
+	if max <= 0 || len(messages) <= max {
+		return messages
+	}
+
+	messages = messages[len(messages)-max:]
+	for len(messages) > 0 && messages[0].Role != RoleUser {
+		messages = messages[1:]
+	}
+	return messages
+}
+
+// estimateTokens gives a rough token count for text, using the common
+// approximation of four characters per token
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// estimateMessageTokens gives a rough token count for a message, including
+// a small per-message overhead for role markers
+func estimateMessageTokens(msg Message) int {
+	tokens := 4
+	for _, content := range msg.Content {
+		tokens += estimateTokens(content.Text)
+	}
+	return tokens
+}
+
+// fitMessages returns the longest suffix of messages that, together with
+// reserved tokens, fits in budget. The latest keep messages, and at least the
+// latest one, are always kept and the result starts with a user message.
+func fitMessages(messages []Message, keep, reserved, budget int) []Message {
+	if len(messages) == 0 {
+		return messages
+	}
+	keep = min(max(keep, 1), len(messages))
+
+	start := len(messages) - keep
+	used := reserved
+	for _, msg := range messages[start:] {
+		used += estimateMessageTokens(msg)
+	}
+	for start > 0 {
+		next := used + estimateMessageTokens(messages[start-1])
+		if next > budget {
+			break
+		}
+		used = next
+		start--
+	}
+
+	kept := messages[start:]
+	for len(kept) > 1 && kept[0].Role != RoleUser {
+		kept = kept[1:]
+	}
+	return kept
+}
+
+// newContextID returns a random 62-bit identifier
+func newContextID() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(b[:]) >> 2
+}
+
+// encodeContextHandle splits an ID into 31-bit ints so that the handle
+// survives JSON clients that store numbers as float64
+func encodeContextHandle(id uint64) []int {
+	return []int{contextMagic, int(id >> 31), int(id & 0x7FFFFFFF)}
+}
+
+// decodeContextHandle reverses encodeContextHandle
+func decodeContextHandle(handle []int) (uint64, bool) {
+	if len(handle) != 3 || handle[0] != contextMagic {
+		return 0, false
+	}
+	if handle[1] < 0 || handle[1] > 0x7FFFFFFF || handle[2] < 0 || handle[2] > 0x7FFFFFFF {
+		return 0, false
+	}
+	return uint64(handle[1])<<31 | uint64(handle[2]), true
+}
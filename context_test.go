@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test that handles round-trip through the store
+func TestContextStorePutGet(t *testing.T) {
+	store := NewContextStore(time.Minute, 10, 10)
+
+	messages := []Message{
+		NewUserTextMessage("hello"),
+		NewAssistantTextMessage("hi there"),
+	}
+	handle := store.Put(messages)
+
+	got, ok := store.Get(handle)
+	if !ok {
+		t.Fatalf("Expected handle %v to resolve", handle)
+	}
+	if len(got) != 2 || got[1].Content[0].Text != "hi there" {
+		t.Errorf("Unexpected messages: %+v", got)
+	}
+
+	if _, ok := store.Get([]int{1, 2, 3}); ok {
+		t.Error("Expected foreign context array to be rejected")
+	}
+}
+
+// Test that entries expire after the TTL
+func TestContextStoreExpiry(t *testing.T) {
+	store := NewContextStore(time.Minute, 10, 10)
+	now := time.Date(2025, 3, 26, 17, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	handle := store.Put([]Message{NewUserTextMessage("hello")})
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := store.Get(handle); ok {
+		t.Error("Expected expired handle to be rejected")
+	}
+	if store.Len() != 0 {
+		t.Errorf("Expected expired entry to be removed, have %d", store.Len())
+	}
+}
+
+// Test that the store enforces entry and message limits
+func TestContextStoreLimits(t *testing.T) {
+	store := NewContextStore(time.Minute, 2, 3)
+
+	for i := 0; i < 5; i++ {
+		store.Put([]Message{NewUserTextMessage("hello")})
+	}
+	if store.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", store.Len())
+	}
+
+	handle := store.Put([]Message{
+		NewUserTextMessage("one"),
+		NewAssistantTextMessage("two"),
+		NewUserTextMessage("three"),
+		NewAssistantTextMessage("four"),
+	})
+	got, _ := store.Get(handle)
+
+	// Keeping the last 3 would start on an assistant turn, so it is dropped too
+	if len(got) != 2 || got[0].Content[0].Text != "three" {
+		t.Errorf("Unexpected trimmed history: %+v", got)
+	}
+}
+
+// Test that a context returned by /api/generate carries the conversation
+func TestHandleOllamaGenerate_Context(t *testing.T) {
+	config := testConfig()
+	var lastReq ClaudeRequest
+	newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		lastReq = req
+		return "reply"
+	})
+	server := NewServer(config)
+
+	generate := func(req OllamaRequest) OllamaResponse {
+		body, _ := json.Marshal(req)
+		recorder := httptest.NewRecorder()
+		server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(body)))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+		var resp OllamaResponse
+		json.NewDecoder(recorder.Body).Decode(&resp)
+		return resp
+	}
+
+	first := generate(OllamaRequest{Model: "claude", Prompt: "My name is Ada."})
+	if len(first.Context) == 0 {
+		t.Fatal("Expected a context in the response")
+	}
+
+	generate(OllamaRequest{Model: "claude", Prompt: "What is my name?", Context: first.Context})
+	if len(lastReq.Messages) != 3 {
+		t.Fatalf("Expected 3 messages upstream, got %d", len(lastReq.Messages))
+	}
+	if lastReq.Messages[0].Content[0].Text != "My name is Ada." || lastReq.Messages[1].Role != RoleAssistant {
+		t.Errorf("Unexpected history: %+v", lastReq.Messages)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy decides which browser origins may call the proxy, and how
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+	// wildcards are "scheme://" and ".domain[:port]" pairs from origins
+	// such as https://*.example.com
+	wildcards   [][2]string
+	methods     []string
+	headers     []string
+	credentials bool
+	maxAge      int
+}
+
+// newCORSPolicy builds the policy from a validated configuration
+func newCORSPolicy(config Config) corsPolicy {
+	policy := corsPolicy{
+		origins:     make(map[string]bool),
+		methods:     config.CORSMethods,
+		headers:     config.CORSHeaders,
+		credentials: config.CORSAllowCredentials,
+		maxAge:      config.CORSMaxAgeSecs,
+	}
+	for _, origin := range config.CORSOrigins {
+		origin = strings.ToLower(origin)
+		switch {
+		case origin == "*":
+			policy.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, rest, _ := strings.Cut(origin, "*")
+			policy.wildcards = append(policy.wildcards, [2]string{scheme, rest})
+		default:
+			policy.origins[origin] = true
+		}
+	}
+	return policy
+}
+
+// enabled reports whether any origin is allowed
+func (p corsPolicy) enabled() bool {
+	return p.anyOrigin || len(p.origins) > 0 || len(p.wildcards) > 0
+}
+
+// allowOrigin reports whether a browser on origin may call the proxy. A
+// wildcard matches subdomains at any depth, but not the domain itself.
+func (p corsPolicy) allowOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.anyOrigin || p.origins[origin] {
+		return true
+	}
+	for _, wildcard := range p.wildcards {
+		scheme, suffix := wildcard[0], wildcard[1]
+		host, ok := strings.CutPrefix(origin, scheme)
+		if ok && strings.HasSuffix(host, suffix) && len(host) > len(suffix) && !strings.ContainsAny(host, "/@") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethod reports whether a preflight's requested method is allowed
+func (p corsPolicy) allowMethod(method string) bool {
+	for _, allowed := range p.methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders reports whether every header a preflight asks to send is
+// allowed
+func (p corsPolicy) allowHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, name := range p.headers {
+			if strings.EqualFold(name, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// withCORS applies the CORS policy to every route. Preflight requests are
+// answered here, before authentication, since browsers send them without
+// credentials. Requests from origins the policy does not allow are served
+// without CORS headers, so the browser withholds the response.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := s.cors
+		origin := r.Header.Get("Origin")
+		if origin == "" || !policy.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if !policy.allowOrigin(origin) {
+			if preflight {
+				writeOllamaError(w, http.StatusForbidden, fmt.Sprintf("origin %s is not allowed", origin))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if policy.anyOrigin && !policy.credentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if policy.credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			header.Set("Access-Control-Expose-Headers", requestIDHeader)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !policy.allowMethod(method) {
+			writeOllamaError(w, http.StatusForbidden, fmt.Sprintf("method %s is not allowed", method))
+			return
+		}
+		if requested := r.Header.Get("Access-Control-Request-Headers"); !policy.allowHeaders(requested) {
+			writeOllamaError(w, http.StatusForbidden, fmt.Sprintf("headers %s are not allowed", requested))
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(policy.methods, ", "))
+		if len(policy.headers) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(policy.headers, ", "))
+		}
+		if policy.maxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(policy.maxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// validateCORS validates the CORS policy
+func validateCORS(config Config) error {
+	for _, origin := range config.CORSOrigins {
+		if origin == "*" {
+			if config.CORSAllowCredentials {
+				return fmt.Errorf("cors_origins cannot allow every origin with cors_allow_credentials; list the origins")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("cors_origins entry %q must be an origin such as https://app.example.com or https://*.example.com", origin)
+		}
+		if strings.Contains(strings.Replace(origin, "://*.", "", 1), "*") {
+			return fmt.Errorf("cors_origins entry %q may only use a wildcard for the leftmost subdomain", origin)
+		}
+	}
+	if len(config.CORSOrigins) > 0 && len(config.CORSMethods) == 0 {
+		return fmt.Errorf("cors_methods must not be empty when cors_origins is set")
+	}
+	if config.CORSMaxAgeSecs < 0 {
+		return fmt.Errorf("cors_max_age_secs must not be negative")
+	}
+	return nil
+}
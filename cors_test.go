@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// corsConfig returns a test config allowing the given origins
+func corsConfig(origins ...string) Config {
+	config := testConfig()
+	config.CORSOrigins = origins
+	return config
+}
+
+// Test exact and wildcard subdomain origin matching
+func TestCORSAllowOrigin(t *testing.T) {
+	policy := newCORSPolicy(corsConfig("https://app.example.com", "https://*.example.org", "http://*.local.test:3000"))
+
+	for origin, want := range map[string]bool{
+		"https://app.example.com":      true,
+		"https://APP.example.com":      true,
+		"http://app.example.com":       false,
+		"https://app.example.com:8443": false,
+		"https://other.example.com":    false,
+		"https://a.example.org":        true,
+		"https://a.b.example.org":      true,
+		"https://example.org":          false,
+		"https://evilexample.org":      false,
+		"https://a.example.org.evil":   false,
+		"http://ui.local.test:3000":    true,
+		"http://ui.local.test":         false,
+	} {
+		if got := policy.allowOrigin(origin); got != want {
+			t.Errorf("allowOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+// Test that allowed origins get CORS headers on every route and others do not
+func TestCORSRequests(t *testing.T) {
+	handler := NewServer(corsConfig("https://app.example.com")).Handler()
+
+	allowed := http.Header{"Origin": {"https://app.example.com"}}
+	for _, path := range []string{"/api/version", "/api/tags", "/admin/breakers"} {
+		recorder := get(t, handler, http.MethodGet, path, allowed)
+		if recorder.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+			t.Errorf("Expected %s to allow the origin, got %v", path, recorder.Header())
+		}
+		if !strings.Contains(recorder.Header().Get("Access-Control-Expose-Headers"), requestIDHeader) {
+			t.Errorf("Expected %s to expose the request ID", path)
+		}
+	}
+
+	recorder := get(t, handler, http.MethodGet, "/api/version", http.Header{"Origin": {"https://evil.example"}})
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers for another origin, got %d %v", recorder.Code, recorder.Header())
+	}
+
+	// CORS is off unless origins are configured
+	recorder = get(t, NewServer(testConfig()).Handler(), http.MethodGet, "/api/version", allowed)
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected no CORS headers by default, got %v", recorder.Header())
+	}
+}
+
+// Test preflight handling of methods, headers, credentials and max-age
+func TestCORSPreflight(t *testing.T) {
+	config := corsConfig("https://*.example.com")
+	config.CORSAllowCredentials = true
+	config.RequireClientKey = true
+	config.ClientNames = map[string]string{"team-key": "team"}
+	handler := NewServer(config).Handler()
+
+	preflight := func(origin, method, headers string) *http.Response {
+		header := http.Header{"Origin": {origin}, "Access-Control-Request-Method": {method}}
+		if headers != "" {
+			header.Set("Access-Control-Request-Headers", headers)
+		}
+		return get(t, handler, http.MethodOptions, "/api/generate", header).Result()
+	}
+
+	// Preflights carry no credentials, so they pass before authentication
+	resp := preflight("https://ui.example.com", "POST", "content-type, x-api-key")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 for an allowed preflight, got %d", resp.StatusCode)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://ui.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, POST, DELETE",
+		"Access-Control-Max-Age":           "600",
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("Expected %s %q, got %q", name, want, got)
+		}
+	}
+
+	for _, tc := range []struct{ origin, method, headers string }{
+		{"https://ui.other.com", "POST", ""},
+		{"https://ui.example.com", "PUT", ""},
+		{"https://ui.example.com", "POST", "X-Custom"},
+	} {
+		if resp := preflight(tc.origin, tc.method, tc.headers); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected 403 for %+v, got %d", tc, resp.StatusCode)
+		}
+	}
+}
+
+// Test that invalid CORS settings are rejected
+func TestValidateCORS(t *testing.T) {
+	wildcardCredentials := corsConfig("*")
+	wildcardCredentials.CORSAllowCredentials = true
+	noMethods := corsConfig("https://app.example.com")
+	noMethods.CORSMethods = nil
+
+	for name, config := range map[string]Config{
+		"credentials with *": wildcardCredentials,
+		"no methods":         noMethods,
+		"path":               corsConfig("https://app.example.com/ui"),
+		"scheme":             corsConfig("app.example.com"),
+		"inner wildcard":     corsConfig("https://app.*.example.com"),
+	} {
+		if err := validateCORS(config); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+	if err := validateCORS(corsConfig("*", "https://*.example.com", "http://localhost:3000")); err != nil {
+		t.Errorf("Expected valid origins to pass, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// shadowTimeout bounds a shadow request, which no client is waiting for
+const shadowTimeout = 5 * time.Minute
+
+// maxShadowRequests caps the shadow requests in flight. Shadows sampled
+// beyond it are skipped.
+const maxShadowRequests = 16
+
+// Experiment compares Claude models under real traffic for an alias. It
+// splits requests between variants, mirrors a sample of them to a shadow
+// model, or both. Every call made for an experiment is recorded in the
+// audit store.
+type Experiment struct {
+	Name  string `json:"name"`
+	Alias string `json:"alias"`
+
+	// Variants split traffic by percentage, summing to 100. A client always
+	// gets the same variant.
+	Variants []ExperimentVariant `json:"variants,omitempty"`
+
+	// ShadowModel receives a copy of ShadowPercent of requests. Its output
+	// is recorded but never returned.
+	ShadowModel   string  `json:"shadow_model,omitempty"`
+	ShadowBackend string  `json:"shadow_backend,omitempty"`
+	ShadowPercent float64 `json:"shadow_percent,omitempty"`
+}
+
+// ExperimentVariant is one arm of an experiment
+type ExperimentVariant struct {
+	Name    string `json:"name"`
+	Model   string `json:"model"`
+	Backend string `json:"backend,omitempty"`
+	Percent int    `json:"percent"`
+}
+
+// experimentFor returns the experiment running on an alias, if any
+func (s *Server) experimentFor(alias string) *Experiment {
+	alias = normalizeModelName(alias)
+	for i := range s.config.Experiments {
+		if normalizeModelName(s.config.Experiments[i].Alias) == alias {
+			return &s.config.Experiments[i]
+		}
+	}
+	return nil
+}
+
+// assign picks the variant for a client. Hashing the client with the
+// experiment name keeps assignment sticky without storing it, and
+// independent between experiments.
+func (e *Experiment) assign(client string) *ExperimentVariant {
+	if len(e.Variants) == 0 {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + "\x00" + client))
+	bucket := int(h.Sum32() % 100)
+
+	for i := range e.Variants {
+		bucket -= e.Variants[i].Percent
+		if bucket < 0 {
+			return &e.Variants[i]
+		}
+	}
+	return &e.Variants[len(e.Variants)-1]
+}
+
+// sampleShadow reports whether a request should be mirrored to the shadow
+// model
+func (e *Experiment) sampleShadow() bool {
+	return e.ShadowModel != "" && mathrand.Float64()*100 < e.ShadowPercent
+}
+
+// stickyClient identifies a client for variant assignment: its key if it
+// sent one, otherwise its address
+func stickyClient(r *http.Request, key string) string {
+	if key != "" {
+		return key
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// newAuditID returns a random ID pairing a request with its shadow
+func newAuditID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// recordExperiment records a call made for an experiment
+func (s *Server) recordExperiment(rec AuditRecord, resp *ClaudeResponse, err error) {
+	rec.Time = time.Now()
+	if resp != nil {
+		rec.Usage = resp.Usage
+		rec.Output = getFirstContentText(resp)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := s.audit.Record(rec); err != nil {
+		log.Printf("Error recording experiment %s: %v", rec.Experiment, err)
+	}
+}
+
+// startShadow runs a shadow request in the background unless
+// maxShadowRequests are already in flight
+func (s *Server) startShadow(exp *Experiment, id string, info requestInfo, claudeReq ClaudeRequest) {
+	select {
+	case s.state.shadows <- struct{}{}:
+	default:
+		log.Printf("Experiment %s: %d shadow requests in flight, skipping one", exp.Name, maxShadowRequests)
+		return
+	}
+	// The shadow keeps the Server's stores open, as its request does
+	if !s.inflight.acquire() {
+		<-s.state.shadows
+		return
+	}
+	go func() {
+		defer func() { <-s.state.shadows }()
+		defer s.inflight.release()
+		s.runShadow(exp, id, info, claudeReq)
+	}()
+}
+
+// runShadow sends a copy of a request to the experiment's shadow model and
+// records the outcome. It is detached from the client's request, and is
+// cancelled at shutdown.
+func (s *Server) runShadow(exp *Experiment, id string, info requestInfo, claudeReq ClaudeRequest) {
+	name := exp.ShadowBackend
+	if name == "" {
+		name = s.backendFor(info.Alias).Name()
+	}
+	backend, ok := s.backends[name]
+	if !ok {
+		log.Printf("Experiment %s: unknown shadow backend %q", exp.Name, name)
+		return
+	}
+
+	claudeReq.Model = s.resolveModel(exp.ShadowModel)
+	claudeReq.Messages = append([]Message(nil), claudeReq.Messages...)
+	claudeReq.Stream = false
+
+	ctx, cancel := context.WithTimeout(withRequestInfo(s.state.shadowCtx, info), shadowTimeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := backend.Send(ctx, claudeReq)
+	s.recordExperiment(AuditRecord{
+		ID:         id,
+		Experiment: exp.Name,
+		Variant:    "shadow",
+		Shadow:     true,
+		Client:     clientName(s.config.ClientNames, info.Client),
+		Alias:      info.Alias,
+		Model:      claudeReq.Model,
+		Backend:    name,
+		LatencyMS:  time.Since(start).Milliseconds(),
+	}, resp, err)
+}
+
+// validateExperiments checks experiment definitions
+func validateExperiments(config Config) error {
+	names := make(map[string]bool)
+	aliases := make(map[string]bool)
+	isClaude := func(name string) bool {
+		if name == BackendAnthropic {
+			return true
+		}
+		bc, ok := config.Backends[name]
+		return ok && bc.Type != BackendOllama
+	}
+
+	for i, exp := range config.Experiments {
+		if exp.Name == "" || exp.Alias == "" {
+			return fmt.Errorf("experiments[%d] needs a name and an alias", i)
+		}
+		if names[exp.Name] {
+			return fmt.Errorf("duplicate experiment name %q", exp.Name)
+		}
+		names[exp.Name] = true
+		alias := normalizeModelName(exp.Alias)
+		if aliases[alias] {
+			return fmt.Errorf("alias %q has more than one experiment", exp.Alias)
+		}
+		aliases[alias] = true
+
+		if len(exp.Variants) == 0 && exp.ShadowModel == "" {
+			return fmt.Errorf("experiment %q needs variants or a shadow model", exp.Name)
+		}
+
+		total := 0
+		for _, v := range exp.Variants {
+			if v.Name == "" || v.Model == "" {
+				return fmt.Errorf("experiment %q has a variant without a name or model", exp.Name)
+			}
+			if v.Percent < 0 {
+				return fmt.Errorf("experiment %q variant %q has a negative percent", exp.Name, v.Name)
+			}
+			if v.Backend != "" && !isClaude(v.Backend) {
+				return fmt.Errorf("experiment %q variant %q uses unknown backend %q", exp.Name, v.Name, v.Backend)
+			}
+			total += v.Percent
+		}
+		if len(exp.Variants) > 0 && total != 100 {
+			return fmt.Errorf("experiment %q variant percentages add up to %d, not 100", exp.Name, total)
+		}
+
+		if exp.ShadowPercent < 0 || exp.ShadowPercent > 100 {
+			return fmt.Errorf("experiment %q shadow percent must be between 0 and 100", exp.Name)
+		}
+		if exp.ShadowBackend != "" && !isClaude(exp.ShadowBackend) {
+			return fmt.Errorf("experiment %q uses unknown shadow backend %q", exp.Name, exp.ShadowBackend)
+		}
+	}
+	return nil
+}
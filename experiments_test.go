@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that variant assignment is sticky and follows the percentages
+func TestExperimentAssign(t *testing.T) {
+	exp := Experiment{
+		Name: "sonnet-vs-haiku",
+		Variants: []ExperimentVariant{
+			{Name: "control", Model: "claude-3-5-sonnet-20240620", Percent: 80},
+			{Name: "candidate", Model: "claude-3-haiku-20240307", Percent: 20},
+		},
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		client := fmt.Sprintf("client-%d", i)
+		variant := exp.assign(client)
+		if again := exp.assign(client); again != variant {
+			t.Fatalf("Expected client %s to keep variant %s, got %s", client, variant.Name, again.Name)
+		}
+		counts[variant.Name]++
+	}
+
+	if counts["candidate"] < 1700 || counts["candidate"] > 2300 {
+		t.Errorf("Expected about 2000 of 10000 clients on the candidate, got %d", counts["candidate"])
+	}
+}
+
+// Test validation of experiment definitions
+func TestValidateExperiments(t *testing.T) {
+	variants := []ExperimentVariant{{Name: "a", Model: "claude-3-haiku", Percent: 50}, {Name: "b", Model: "claude-3-opus", Percent: 50}}
+	testCases := []struct {
+		name  string
+		exp   Experiment
+		valid bool
+	}{
+		{"split", Experiment{Name: "e", Alias: "claude", Variants: variants}, true},
+		{"shadow", Experiment{Name: "e", Alias: "claude", ShadowModel: "claude-3-haiku", ShadowPercent: 10}, true},
+		{"no alias", Experiment{Name: "e", Variants: variants}, false},
+		{"nothing to do", Experiment{Name: "e", Alias: "claude"}, false},
+		{"bad total", Experiment{Name: "e", Alias: "claude", Variants: variants[:1]}, false},
+		{"bad shadow percent", Experiment{Name: "e", Alias: "claude", ShadowModel: "claude-3-haiku", ShadowPercent: 150}, false},
+		{"unknown backend", Experiment{Name: "e", Alias: "claude", ShadowModel: "claude-3-haiku", ShadowBackend: "nowhere"}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.Experiments = []Experiment{tc.exp}
+			err := validateExperiments(config)
+			if tc.valid && err != nil {
+				t.Errorf("Expected valid experiment, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+// Test that an experiment serves the variant model, mirrors the request to
+// the shadow model and records both
+func TestExperimentShadow(t *testing.T) {
+	config := testConfig()
+	config.AuditFile = filepath.Join(t.TempDir(), "audit.jsonl")
+	config.Experiments = []Experiment{{
+		Name:          "haiku-candidate",
+		Alias:         "claude",
+		Variants:      []ExperimentVariant{{Name: "candidate", Model: "claude-3-haiku", Percent: 100}},
+		ShadowModel:   "claude-3.5-sonnet",
+		ShadowPercent: 100,
+	}}
+	claude := newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		return "answer from " + string(req.Model)
+	})
+	defer claude.Close()
+	server := NewServer(config)
+
+	body := `{"model": "claude", "prompt": "hi"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer team-a")
+	recorder := httptest.NewRecorder()
+	server.handleOllamaGenerate(recorder, req)
+
+	if !strings.Contains(recorder.Body.String(), "answer from claude-3-haiku-20240307") {
+		t.Fatalf("Expected the candidate's answer, got %s", recorder.Body.String())
+	}
+
+	// The shadow request runs in the background
+	var records []AuditRecord
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if records = server.audit.Recent("haiku-candidate", 10); len(records) == 2 {
+			break
+		}
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 audit records, got %d", len(records))
+	}
+
+	primary, shadow := records[0], records[1]
+	if primary.Variant != "candidate" || primary.Model != "claude-3-haiku-20240307" || primary.Shadow {
+		t.Errorf("Unexpected primary record %+v", primary)
+	}
+	if !shadow.Shadow || shadow.Model != "claude-3-5-sonnet-20240620" || shadow.Output != "answer from claude-3-5-sonnet-20240620" {
+		t.Errorf("Unexpected shadow record %+v", shadow)
+	}
+	if primary.ID != shadow.ID {
+		t.Errorf("Expected the records to share an ID, got %q and %q", primary.ID, shadow.ID)
+	}
+	if primary.Client == "" || primary.Client == "team-a" {
+		t.Errorf("Expected a hashed client label, got %q", primary.Client)
+	}
+
+	// Both records are in the audit file too
+	file, err := os.Open(config.AuditFile)
+	if err != nil {
+		t.Fatalf("Failed to open audit file: %v", err)
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", scanner.Text(), err)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("Expected 2 lines in the audit file, got %d", lines)
+	}
+}
+
+// Test that shadows beyond the cap are skipped and that shutdown cancels
+// the ones in flight and closes the audit file
+func TestShadowLimit(t *testing.T) {
+	config := testConfig()
+	config.AuditFile = filepath.Join(t.TempDir(), "audit.jsonl")
+	started, release := make(chan struct{}, maxShadowRequests+1), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+	config.APIEndpoint = upstream.URL
+	server := NewServer(config)
+
+	exp := &Experiment{Name: "slow", Alias: "claude", ShadowModel: "claude-3-haiku", ShadowPercent: 100}
+	req := ClaudeRequest{Messages: []Message{NewUserTextMessage("hi")}, MaxTokens: 10}
+	for i := 0; i < maxShadowRequests+1; i++ {
+		server.startShadow(exp, fmt.Sprint(i), requestInfo{Alias: "claude"}, req)
+	}
+	for i := 0; i < maxShadowRequests; i++ {
+		<-started
+	}
+	if n := len(server.state.shadows); n != maxShadowRequests {
+		t.Fatalf("Expected %d shadows in flight, got %d", maxShadowRequests, n)
+	}
+
+	server.closeStores(nil)
+	for deadline := time.Now().Add(5 * time.Second); len(server.state.shadows) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	records := server.audit.Recent("slow", 100)
+	if len(records) != maxShadowRequests || records[0].Error == "" {
+		t.Fatalf("Expected %d cancelled shadows, got %+v", maxShadowRequests, records)
+	}
+	if server.audit.file != nil {
+		t.Errorf("Expected the audit file to be closed")
+	}
+}
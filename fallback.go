@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// BackendOllama is the backend type for a real Ollama server. It is only
+// used in fallback chains, and receives the client's original request.
+const BackendOllama = "ollama"
+
+// backendHeader reports which backend served a response
+const backendHeader = "X-Proxy-Backend"
+
+// OllamaUpstream forwards Ollama requests unchanged to an Ollama server
+type OllamaUpstream struct {
+	name     string
+	endpoint string
+	model    string
+	client   *http.Client
+}
+
+// NewOllamaUpstream creates an upstream for the Ollama server at the
+// backend's endpoint. If the backend sets a model, it replaces the model
+// requested by the client.
+func NewOllamaUpstream(name string, bc BackendConfig, client *http.Client) *OllamaUpstream {
+	return &OllamaUpstream{
+		name:     name,
+		endpoint: strings.TrimSuffix(bc.Endpoint, "/"),
+		model:    bc.Model,
+		client:   client,
+	}
+}
+
+// Forward sends the request body to the Ollama server and copies the
+// response, streamed or not, back to the client. The proxy's context handle
+// and session ID are removed first, since Ollama would read the handle as
+// its own token IDs.
+func (u *OllamaUpstream) Forward(ctx context.Context, w http.ResponseWriter, path string, body []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Errorf("failed to decode request: %w", err)
+	}
+	delete(fields, "context")
+	delete(fields, "session_id")
+	if u.model != "" {
+		fields["model"] = u.model
+	}
+	body, _ = json.Marshal(fields)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return &upstreamError{Provider: "ollama", Status: resp.StatusCode, Header: resp.Header, Body: string(bodyBytes)}
+	}
+
+	w.Header().Set(backendHeader, u.name)
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(http.StatusOK)
+
+	// Copy as it arrives so that streamed responses stay streamed
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Error copying response from Ollama upstream %s: %v", u.name, err)
+			return nil
+		}
+	}
+}
+
+// buildOllamaUpstreams creates the Ollama upstreams among the backends
+func buildOllamaUpstreams(config Config, client *http.Client) map[string]*OllamaUpstream {
+	upstreams := make(map[string]*OllamaUpstream)
+	for name, bc := range config.Backends {
+		if bc.Type == BackendOllama {
+			upstreams[name] = NewOllamaUpstream(name, bc, client)
+		}
+	}
+	return upstreams
+}
+
+// backendChain returns the backend serving a request followed by the
+// fallbacks for its alias
+func (s *Server) backendChain(info requestInfo) []string {
+	first := info.Backend
+	if first == "" {
+		first = s.backendFor(info.Alias).Name()
+	}
+	chain := []string{first}
+	alias := normalizeModelName(info.Alias)
+	for model, fallbacks := range s.config.Fallbacks {
+		if normalizeModelName(model) == alias {
+			chain = append(chain, fallbacks...)
+			break
+		}
+	}
+	return chain
+}
+
+// shouldFallback reports whether an error means the backend is unavailable,
+// as opposed to the request being at fault
+func shouldFallback(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		switch {
+		case upErr.Status == http.StatusTooManyRequests,
+			upErr.Status == http.StatusUnauthorized,
+			upErr.Status == http.StatusForbidden,
+			upErr.Status >= 500:
+			return true
+		}
+		return false
+	}
+
+	// Network errors, timeouts and the like
+	return true
+}
+
+// generateWithFallback sends a generate request through the alias's backend
+// chain. If an Ollama upstream serves it, the response has already been
+// written and the returned ClaudeResponse is nil.
+func (s *Server) generateWithFallback(ctx context.Context, w http.ResponseWriter, rawBody []byte, claudeReq ClaudeRequest, stream *ollamaStream) (*ClaudeResponse, error) {
+	chain := s.backendChain(requestInfoFrom(ctx))
+	var lastErr error
+
+	for i, name := range chain {
+		if i > 0 {
+			// Once text has reached the client there is no going back
+			if stream != nil && stream.started {
+				break
+			}
+			log.Printf("Falling back from backend %q to %q: %v", chain[i-1], name, lastErr)
+		}
+
+		if upstream, ok := s.ollamaUpstreams[name]; ok {
+			err := upstream.Forward(ctx, w, "/api/generate", rawBody)
+			if err == nil {
+				return nil, nil
+			}
+			lastErr = err
+		} else if backend, ok := s.backends[name]; ok {
+			w.Header().Set(backendHeader, name)
+			var resp *ClaudeResponse
+			var err error
+			if stream != nil {
+				resp, err = backend.Stream(ctx, claudeReq, stream.Write)
+			} else {
+				resp, err = backend.Send(ctx, claudeReq)
+			}
+			if err == nil {
+				return resp, nil
+			}
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("unknown backend %q", name)
+		}
+
+		if !shouldFallback(lastErr) {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// forwardToOllama sends a request that may not spend on Claude, such as one
+// over its spend cap, to the Ollama upstreams in its alias's backend chain.
+// It reports whether one of them served the request.
+func (s *Server) forwardToOllama(ctx context.Context, w http.ResponseWriter, rawBody []byte) bool {
+	for _, name := range s.backendChain(requestInfoFrom(ctx)) {
+		upstream, ok := s.ollamaUpstreams[name]
+		if !ok {
+			continue
+		}
+		err := upstream.Forward(ctx, w, "/api/generate", rawBody)
+		if err == nil {
+			return true
+		}
+		log.Printf("Ollama upstream %q failed: %v", name, err)
+	}
+	return false
+}
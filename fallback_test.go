@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test which errors trigger a fallback
+func TestShouldFallback(t *testing.T) {
+	testCases := []struct {
+		status   int
+		expected bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusNotFound, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusInternalServerError, true},
+		{529, true},
+	}
+
+	for _, tc := range testCases {
+		if got := shouldFallback(&upstreamError{Status: tc.status}); got != tc.expected {
+			t.Errorf("shouldFallback(status %d) = %v, expected %v", tc.status, got, tc.expected)
+		}
+	}
+}
+
+// Test that a failing Claude backend falls back along the chain to Ollama
+func TestGenerateFallbackToOllama(t *testing.T) {
+	claude := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"type": "error", "error": {"type": "overloaded_error"}}`, 529)
+	}))
+	defer claude.Close()
+
+	var forwarded map[string]interface{}
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/generate" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &forwarded)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model": "llama3", "response": "from ollama", "done": true}`))
+	}))
+	defer ollama.Close()
+
+	config := testConfig()
+	config.APIEndpoint = claude.URL
+	config.Backends = map[string]BackendConfig{
+		"secondary": {Type: BackendAnthropic, Endpoint: claude.URL},
+		"local":     {Type: BackendOllama, Endpoint: ollama.URL, Model: "llama3"},
+	}
+	config.Fallbacks = map[string][]string{"claude": {"secondary", "local"}}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Unexpected config error: %v", err)
+	}
+	server := NewServer(config)
+
+	body := `{"model": "claude", "prompt": "hi", "options": {"temperature": 0.5}}`
+	recorder := httptest.NewRecorder()
+	server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body)))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	if got := recorder.Header().Get(backendHeader); got != "local" {
+		t.Errorf("Expected %s header %q, got %q", backendHeader, "local", got)
+	}
+	if !strings.Contains(recorder.Body.String(), "from ollama") {
+		t.Errorf("Expected the Ollama response, got %s", recorder.Body.String())
+	}
+	if forwarded["model"] != "llama3" || forwarded["prompt"] != "hi" || forwarded["options"] == nil {
+		t.Errorf("Expected the original request with the model replaced, got %v", forwarded)
+	}
+
+	// The proxy's context handle and session ID are not forwarded
+	body = `{"model": "claude", "prompt": "hi", "context": [7, 1, 9], "session_id": "abc"}`
+	if err := server.ollamaUpstreams["local"].Forward(context.Background(), httptest.NewRecorder(), "/api/generate", []byte(body)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := forwarded["context"]; ok || forwarded["session_id"] != nil || forwarded["prompt"] != "hi" {
+		t.Errorf("Expected the context and session to be removed, got %v", forwarded)
+	}
+
+	// Without a fallback chain the error reaches the client
+	recorder = httptest.NewRecorder()
+	reqBody, _ := json.Marshal(OllamaRequest{Model: "claude-3-haiku", Prompt: "hi"})
+	server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(reqBody)))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("Expected status %d, got %d", http.StatusBadGateway, recorder.Code)
+	}
+	if got := recorder.Header().Get(backendHeader); got != BackendAnthropic {
+		t.Errorf("Expected %s header %q, got %q", backendHeader, BackendAnthropic, got)
+	}
+}
+
+// Test that requests over a spend cap go to the alias's Ollama fallback,
+// and are rejected when it fails
+func TestSpendCapFallbackToOllama(t *testing.T) {
+	ollamaUp := true
+	ollama := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ollamaUp {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"model": "llama3", "response": "from ollama", "done": true}`))
+	}))
+	defer ollama.Close()
+
+	config := testConfig()
+	config.Prices = map[string]ModelPrice{"claude-3-haiku": {Input: 1000, Output: 1000}}
+	config.SpendCaps = []SpendCap{{MonthlyUSD: 1}}
+	config.Backends = map[string]BackendConfig{"local": {Type: BackendOllama, Endpoint: ollama.URL}}
+	config.Fallbacks = map[string][]string{"claude-3-haiku": {"local"}}
+	claudeCalls := 0
+	newFakeClaude(t, &config, func(ClaudeRequest) string {
+		claudeCalls++
+		return "from claude"
+	})
+	server := NewServer(config)
+
+	generate := func(model string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		body := `{"model": "` + model + `", "prompt": "hi"}`
+		server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body)))
+		return recorder
+	}
+
+	// The first request spends $1.20, using up the cap
+	if recorder := generate("claude-3-haiku"); recorder.Code != http.StatusOK || claudeCalls != 1 {
+		t.Fatalf("Expected the first request to reach Claude, got %d", recorder.Code)
+	}
+	recorder := generate("claude-3-haiku")
+	if recorder.Code != http.StatusOK || recorder.Header().Get(backendHeader) != "local" || !strings.Contains(recorder.Body.String(), "from ollama") {
+		t.Errorf("Expected the capped request to be served by Ollama, got %d %v %s", recorder.Code, recorder.Header(), recorder.Body.String())
+	}
+	if claudeCalls != 1 {
+		t.Errorf("Expected no further Claude calls, got %d", claudeCalls)
+	}
+
+	// Aliases without a fallback, and failed fallbacks, get a 402
+	if recorder := generate("claude-3-opus"); recorder.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 without a fallback chain, got %d", recorder.Code)
+	}
+	ollamaUp = false
+	if recorder := generate("claude-3-haiku"); recorder.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected 402 when the fallback fails, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Fill-in-the-middle support for code completion clients. Ollama code models
+// do FIM natively with special tokens; Claude does not, so the prefix and
+// suffix are wrapped in an instruction and the answer is prefilled with an
+// opening tag that the stop sequence closes.
+const (
+	fimOpenTag  = "<COMPLETION>"
+	fimCloseTag = "</COMPLETION>"
+
+	// fimMinEcho is the shortest overlap with the surrounding code that is
+	// treated as an echo rather than a coincidence
+	fimMinEcho = 8
+)
+
+const fimInstruction = `You are a code completion engine. Given the code before and after the cursor, write the code that belongs at the cursor.
+Reply with the inserted code only: no explanations, no markdown fences, and do not repeat code from before or after the cursor.
+
+<PREFIX>%s</PREFIX>
+<SUFFIX>%s</SUFFIX>`
+
+// buildFIMMessages creates the messages for a fill-in-the-middle request
+func buildFIMMessages(prefix, suffix string) []Message {
+	return []Message{
+		NewUserTextMessage(fmt.Sprintf(fimInstruction, prefix, suffix)),
+		NewAssistantTextMessage(fimOpenTag),
+	}
+}
+
+// cleanFIMCompletion strips the wrapping Claude sometimes adds around a
+// completion and any context it echoed from the prefix or suffix
+func cleanFIMCompletion(out, prefix, suffix string) string {
+	out = strings.TrimPrefix(out, fimOpenTag)
+	if i := strings.Index(out, fimCloseTag); i >= 0 {
+		out = out[:i]
+	}
+	out = stripCodeFence(out)
+
+	// Drop a leading echo of the end of the prefix
+	if k := longestOverlap(prefix, out); k > 0 && echoed(prefix[len(prefix)-k:], prefix) {
+		out = out[k:]
+	}
+
+	// Drop a trailing echo of the start of the suffix
+	if k := longestOverlap(out, suffix); k > 0 && echoed(suffix[:k], suffix) {
+		out = out[:len(out)-k]
+	}
+
+	return out
+}
+
+// longestOverlap returns the length of the longest suffix of a that is also
+// a prefix of b
+func longestOverlap(a, b string) int {
+	max := len(a)
+	if len(b) < max {
+		max = len(b)
+	}
+	for k := max; k > 0; k-- {
+		if a[len(a)-k:] == b[:k] {
+			return k
+		}
+	}
+	return 0
+}
+
+// echoed reports whether an overlap with context is long enough to be an
+// echo: at least fimMinEcho bytes, or the whole of a non-blank context
+func echoed(overlap, context string) bool {
+	return len(overlap) >= fimMinEcho || (overlap == context && strings.TrimSpace(context) != "")
+}
+
+// stripCodeFence removes a markdown code fence wrapping the whole text
+func stripCodeFence(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") || len(trimmed) < 6 {
+		return text
+	}
+
+	body := strings.TrimSuffix(trimmed, "```")
+	newline := strings.IndexByte(body, '\n')
+	if newline < 0 {
+		return text
+	}
+	return strings.TrimSuffix(body[newline+1:], "\n")
+}
+
+// promptTemplateData holds the variables available to an Ollama template
+type promptTemplateData struct {
+	System   string
+	Prompt   string
+	Suffix   string
+	Response string
+}
+
+// renderPromptTemplate renders an Ollama-style prompt template
+func renderPromptTemplate(text, system, prompt, suffix string) (string, error) {
+	tmpl, err := template.New("prompt").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %w", err)
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, promptTemplateData{System: system, Prompt: prompt, Suffix: suffix}); err != nil {
+		return "", fmt.Errorf("failed to render template: %w", err)
+	}
+	return out.String(), nil
+}
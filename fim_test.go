@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that completions are cleaned of wrapping and echoed context
+func TestCleanFIMCompletion(t *testing.T) {
+	prefix := "func add(a, b int) int {\n\treturn "
+	suffix := "\n}\n"
+
+	testCases := []struct {
+		name     string
+		output   string
+		expected string
+	}{
+		{"Plain", "a + b", "a + b"},
+		{"Closing tag", "a + b</COMPLETION>", "a + b"},
+		{"Code fence", "```go\na + b\n```", "a + b"},
+		{"Echoed prefix", "int {\n\treturn a + b", "a + b"},
+		{"Echoed suffix", "a + b\n}\n", "a + b"},
+		{"Short coincidence", "n + 1", "n + 1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cleanFIMCompletion(tc.output, prefix, suffix); got != tc.expected {
+				t.Errorf("cleanFIMCompletion(%q) = %q, expected %q", tc.output, got, tc.expected)
+			}
+		})
+	}
+}
+
+// Test Ollama template rendering
+func TestRenderPromptTemplate(t *testing.T) {
+	got, err := renderPromptTemplate("[{{ .System }}] {{ .Prompt }}", "sys", "hello", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got != "[sys] hello" {
+		t.Errorf("Expected %q, got %q", "[sys] hello", got)
+	}
+
+	if _, err := renderPromptTemplate("{{ .Prompt", "", "", ""); err == nil {
+		t.Error("Expected an error for an invalid template")
+	}
+}
+
+// Test that a suffix turns /api/generate into a fill-in-the-middle request
+func TestHandleOllamaGenerate_FIM(t *testing.T) {
+	config := testConfig()
+	var lastReq ClaudeRequest
+	newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		lastReq = req
+		return "a + b"
+	})
+	server := NewServer(config)
+
+	body, _ := json.Marshal(OllamaRequest{
+		Model:  "claude-3-haiku",
+		Prompt: "func add(a, b int) int {\n\treturn ",
+		Suffix: "\n}\n",
+		Raw:    true,
+	})
+	recorder := httptest.NewRecorder()
+	server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(body)))
+
+	var resp OllamaResponse
+	json.NewDecoder(recorder.Body).Decode(&resp)
+	if resp.Response != "a + b" {
+		t.Errorf("Expected completion %q, got %q", "a + b", resp.Response)
+	}
+	if resp.Context != nil {
+		t.Error("Expected no context for a raw request")
+	}
+
+	if lastReq.System != "" {
+		t.Errorf("Expected no system prompt for a raw request, got %q", lastReq.System)
+	}
+	if len(lastReq.Messages) != 2 || lastReq.Messages[1].Role != RoleAssistant {
+		t.Fatalf("Expected an instruction and a prefill, got %+v", lastReq.Messages)
+	}
+	if !strings.Contains(lastReq.Messages[0].Content[0].Text, "<SUFFIX>\n}\n</SUFFIX>") {
+		t.Errorf("Expected the suffix in the instruction, got %q", lastReq.Messages[0].Content[0].Text)
+	}
+	if len(lastReq.StopSequences) == 0 || lastReq.StopSequences[0] != fimCloseTag {
+		t.Errorf("Expected %q stop sequence, got %v", fimCloseTag, lastReq.StopSequences)
+	}
+}
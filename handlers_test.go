@@ -109,6 +109,62 @@ func TestServerHTTPHandlers(t *testing.T) {
 	}
 }
 
+// Test that /api/generate streams Ollama NDJSON frames only when asked to
+func TestGenerateStreaming(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ClaudeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream {
+			writeTestSSE(w)
+			return
+		}
+		json.NewEncoder(w).Encode(ClaudeResponse{Type: "message", Role: "assistant", Content: []ClaudeContent{{Type: "text", Text: "Hello world"}}})
+	}))
+	defer upstream.Close()
+	config := testConfig()
+	config.APIEndpoint = upstream.URL
+	handler := NewServer(config).Handler()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body)))
+		return recorder
+	}
+
+	recorder := post(`{"model": "claude", "prompt": "hi", "stream": true}`)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected an NDJSON stream, got %d %v", recorder.Code, recorder.Header())
+	}
+	var frames []OllamaResponse
+	decoder := json.NewDecoder(recorder.Body)
+	for decoder.More() {
+		var frame OllamaResponse
+		if err := decoder.Decode(&frame); err != nil {
+			t.Fatalf("Bad frame: %v", err)
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) != 3 || frames[0].Response != "Hello" || frames[1].Response != " world" || frames[0].Done || frames[1].Done {
+		t.Fatalf("Expected two text frames and a final frame, got %+v", frames)
+	}
+	final := frames[2]
+	if !final.Done || final.Response != "" || len(final.Context) == 0 || final.Model != "claude" {
+		t.Errorf("Expected a final done frame with a context, got %+v", final)
+	}
+
+	// Without stream, or for fill-in-the-middle, the answer is one object
+	for _, body := range []string{
+		`{"model": "claude", "prompt": "hi"}`,
+		`{"model": "claude", "prompt": "func ", "suffix": "}", "stream": true}`,
+	} {
+		recorder = post(body)
+		var resp OllamaResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil || !resp.Done || resp.Response == "" {
+			t.Errorf("Expected a single response object for %s, got %s", body, recorder.Body.String())
+		}
+	}
+}
+
 // Mock time function for deterministic tests
 func serverTimeFunc() time.Time {
 	return time.Date(2025, 3, 26, 17, 0, 0, 0, time.UTC)
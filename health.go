@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds one upstream check
+const healthCheckTimeout = 5 * time.Second
+
+// Backend health states
+const (
+	healthOK        = "ok"
+	healthFailing   = "failing"
+	healthUnchecked = "unchecked"
+)
+
+// healthChecker is implemented by backends that can check their upstream
+// without spending tokens
+type healthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// BackendHealth is the outcome of the last check of a backend
+type BackendHealth struct {
+	Name      string     `json:"name"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	LatencyMS int64      `json:"latency_ms,omitempty"`
+}
+
+// HealthCache caches upstream checks, so that however often probes come
+// each backend is checked at most once per TTL
+type HealthCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	results map[string]BackendHealth
+}
+
+// NewHealthCache creates a cache keeping results for ttl. A TTL of 0
+// disables upstream checks.
+func NewHealthCache(ttl time.Duration) *HealthCache {
+	return &HealthCache{ttl: ttl, results: make(map[string]BackendHealth)}
+}
+
+// Check returns the health of a backend, checking it again once the cached
+// result is older than the TTL
+func (hc *HealthCache) Check(ctx context.Context, name string, backend Backend) BackendHealth {
+	checker, ok := findBackend[healthChecker](backend)
+	if hc.ttl <= 0 || !ok {
+		return BackendHealth{Name: name, Status: healthUnchecked}
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if result, ok := hc.results[name]; ok && time.Since(*result.CheckedAt) < hc.ttl {
+		return result
+	}
+
+	// A probe that gives up should not leave a cancelled check cached
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := checker.Check(ctx)
+
+	result := BackendHealth{Name: name, Status: healthOK, CheckedAt: &start, LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status = healthFailing
+		result.Error = err.Error()
+	}
+	hc.results[name] = result
+	return result
+}
+
+// findBackend looks through backend wrappers for one implementing T, such
+// as a health checker
+func findBackend[T any](backend Backend) (T, bool) {
+	for {
+		if found, ok := backend.(T); ok {
+			return found, true
+		}
+		wrapper, ok := backend.(interface{ Unwrap() Backend })
+		if !ok {
+			var none T
+			return none, false
+		}
+		backend = wrapper.Unwrap()
+	}
+}
+
+// readiness is the body of /readyz
+type readiness struct {
+	Status   string          `json:"status"`
+	Config   configStatus    `json:"config"`
+	Backends []BackendHealth `json:"backends"`
+	Breakers []BreakerStatus `json:"breakers"`
+}
+
+// configStatus describes the live configuration
+type configStatus struct {
+	File        string    `json:"file,omitempty"`
+	LoadedAt    time.Time `json:"loaded_at"`
+	ReloadError string    `json:"reload_error,omitempty"`
+}
+
+// Handle GET /readyz: ready unless the server is draining or the default
+// backend fails its upstream check. Other backends and open breakers are
+// reported without failing readiness, since requests can avoid them.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	config := configStatus{File: s.state.configFile, LoadedAt: s.loadedAt, ReloadError: s.state.reloadError()}
+
+	ready := readiness{Status: "ready", Config: config, Breakers: s.breakers.Status()}
+	for _, name := range sortedKeys(s.backends) {
+		health := s.health.Check(r.Context(), name, s.backends[name])
+		if name == s.config.DefaultBackend && health.Status == healthFailing {
+			ready.Status = "unavailable"
+		}
+		ready.Backends = append(ready.Backends, health)
+	}
+	if s.state.draining.Load() {
+		ready.Status = "draining"
+	}
+
+	status := http.StatusOK
+	if ready.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, ready)
+}
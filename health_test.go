@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// readyz calls /readyz and decodes the response
+func readyz(t *testing.T, reloader *Reloader) (int, readiness) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	reloader.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var ready readiness
+	if err := json.NewDecoder(recorder.Body).Decode(&ready); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return recorder.Code, ready
+}
+
+// Test that readiness checks the upstream, caches the result and fails when
+// the default backend does
+func TestReadyz(t *testing.T) {
+	var calls atomic.Int32
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method != http.MethodGet || r.URL.Path != "/v1/models" || r.Header.Get("X-Api-Key") != "test-api-key" {
+			t.Errorf("Unexpected check request: %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte(`{"data": []}`))
+	}))
+	defer upstream.Close()
+
+	config := testConfig()
+	config.APIEndpoint = upstream.URL + "/v1/messages"
+	config.ReadinessCheckSecs = 60
+	reloader := NewReloader("", NewServer(config))
+
+	code, ready := readyz(t, reloader)
+	if code != http.StatusOK || ready.Status != "ready" {
+		t.Fatalf("Expected ready, got %d %+v", code, ready)
+	}
+	if len(ready.Backends) != 1 || ready.Backends[0].Status != healthOK {
+		t.Errorf("Expected the anthropic backend to be ok, got %+v", ready.Backends)
+	}
+	readyz(t, reloader)
+	if calls.Load() != 1 {
+		t.Errorf("Expected the check to be cached, got %d calls", calls.Load())
+	}
+
+	// A revoked key fails readiness once the cache is fresh
+	status.Store(http.StatusUnauthorized)
+	reloader.current.Store(NewServer(config))
+	code, ready = readyz(t, reloader)
+	if code != http.StatusServiceUnavailable || ready.Status != "unavailable" || ready.Backends[0].Error == "" {
+		t.Errorf("Expected unavailable with an error, got %d %+v", code, ready)
+	}
+
+	reloader.Server().state.draining.Store(true)
+	if code, ready = readyz(t, reloader); code != http.StatusServiceUnavailable || ready.Status != "draining" {
+		t.Errorf("Expected draining, got %d %+v", code, ready)
+	}
+}
+
+// Test that readiness skips upstream checks unless they are enabled, and
+// liveness does not depend on them
+func TestReadyzUnchecked(t *testing.T) {
+	config := testConfig()
+	config.APIEndpoint = "http://127.0.0.1:1/v1/messages"
+	reloader := NewReloader("", NewServer(config))
+
+	code, ready := readyz(t, reloader)
+	if code != http.StatusOK || ready.Backends[0].Status != healthUnchecked {
+		t.Errorf("Expected ready with an unchecked backend, got %d %+v", code, ready)
+	}
+
+	reloader.Server().state.draining.Store(true)
+	recorder := httptest.NewRecorder()
+	reloader.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected liveness to pass while draining, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Key selection strategies
+const (
+	KeyStrategyRoundRobin           = "round-robin"
+	KeyStrategyLeastRecentlyLimited = "least-recently-limited"
+	KeyStrategyWeighted             = "weighted"
+)
+
+// APIKeyConfig is one named upstream API key
+type APIKeyConfig struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	KeyFile string `json:"key_file,omitempty"`
+	Weight  int    `json:"weight"`
+}
+
+// KeyPin routes requests from a client, by key or client name, or for an
+// alias to one upstream key. Exactly one of Client and Model is set.
+type KeyPin struct {
+	Client string `json:"client,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Key    string `json:"key"`
+}
+
+// KeyUsage is the usage accounted to an upstream key
+type KeyUsage struct {
+	Requests     int64 `json:"requests"`
+	Errors       int64 `json:"errors"`
+	RateLimited  int64 `json:"rate_limited"`
+	Unauthorized int64 `json:"unauthorized"`
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+// upstreamKey is an API key in the pool and its state
+type upstreamKey struct {
+	name   string
+	key    string
+	weight int
+
+	// current is the running score for smooth weighted round-robin
+	current int
+
+	quarantinedUntil time.Time
+	lastLimited      time.Time
+	usage            KeyUsage
+}
+
+// KeyPool spreads upstream requests over several API keys, taking keys out
+// of rotation for a while after they are rate limited or rejected
+type KeyPool struct {
+	mu         sync.Mutex
+	keys       []*upstreamKey
+	byName     map[string]*upstreamKey
+	strategy   string
+	quarantine time.Duration
+	pins       []KeyPin
+	names      map[string]string
+	next       int
+	now        func() time.Time
+}
+
+// NewKeyPool creates a key pool from the configuration. A config without
+// api_keys gets a pool holding just api_key (or ANTHROPIC_API_KEY).
+func NewKeyPool(config Config) *KeyPool {
+	pool := &KeyPool{
+		byName:     make(map[string]*upstreamKey),
+		strategy:   config.KeyStrategy,
+		quarantine: time.Duration(config.KeyQuarantineSecs) * time.Second,
+		pins:       config.KeyPins,
+		names:      config.ClientNames,
+		now:        time.Now,
+	}
+
+	keys := config.APIKeys
+	if len(keys) == 0 {
+		apiKey := config.APIKey
+		if apiKey == "" {
+			apiKey = os.Getenv("ANTHROPIC_API_KEY")
+		}
+		if apiKey != "" {
+			keys = []APIKeyConfig{{Name: "default", Key: apiKey}}
+		}
+	}
+
+	for _, kc := range keys {
+		weight := kc.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		key := &upstreamKey{name: kc.Name, key: kc.Key, weight: weight}
+		pool.keys = append(pool.keys, key)
+		pool.byName[kc.Name] = key
+	}
+
+	return pool
+}
+
+// Pick chooses the key for a request, skipping keys already tried. Pinned
+// requests only ever get their pinned key.
+func (kp *KeyPool) Pick(info requestInfo, tried map[string]bool) (*upstreamKey, error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	if len(kp.keys) == 0 {
+		return nil, fmt.Errorf("API key not found in config or environment")
+	}
+
+	if pinned := kp.pinnedLocked(info); pinned != nil {
+		if tried[pinned.name] {
+			return nil, fmt.Errorf("pinned API key %q failed", pinned.name)
+		}
+		return pinned, nil
+	}
+
+	now := kp.now()
+	var available, quarantined []*upstreamKey
+	for _, key := range kp.keys {
+		if tried[key.name] {
+			continue
+		}
+		if now.Before(key.quarantinedUntil) {
+			quarantined = append(quarantined, key)
+		} else {
+			available = append(available, key)
+		}
+	}
+
+	if len(available) == 0 {
+		if len(quarantined) == 0 {
+			return nil, fmt.Errorf("all API keys failed")
+		}
+		// Everything is quarantined; the key due back first is the best bet
+		sort.Slice(quarantined, func(i, j int) bool {
+			return quarantined[i].quarantinedUntil.Before(quarantined[j].quarantinedUntil)
+		})
+		return quarantined[0], nil
+	}
+
+	switch kp.strategy {
+	case KeyStrategyLeastRecentlyLimited:
+		best := available[0]
+		for _, key := range available[1:] {
+			if key.lastLimited.Before(best.lastLimited) {
+				best = key
+			}
+		}
+		return best, nil
+
+	case KeyStrategyWeighted:
+		// Smooth weighted round-robin, as used by nginx
+		total := 0
+		var best *upstreamKey
+		for _, key := range available {
+			key.current += key.weight
+			total += key.weight
+			if best == nil || key.current > best.current {
+				best = key
+			}
+		}
+		best.current -= total
+		return best, nil
+
+	default:
+		// Walk the full key list so that skipped keys keep their turn
+		isAvailable := make(map[*upstreamKey]bool, len(available))
+		for _, key := range available {
+			isAvailable[key] = true
+		}
+		for i := 0; i < len(kp.keys); i++ {
+			key := kp.keys[(kp.next+i)%len(kp.keys)]
+			if isAvailable[key] {
+				kp.next = (kp.next + i + 1) % len(kp.keys)
+				return key, nil
+			}
+		}
+		return available[0], nil
+	}
+}
+
+// pinnedLocked returns the key pinned for a request, if any. Client pins
+// match the client key or its client name, as routing rules do, and take
+// precedence over model pins. Callers must hold kp.mu.
+func (kp *KeyPool) pinnedLocked(info requestInfo) *upstreamKey {
+	name := clientName(kp.names, info.Client)
+	for _, pin := range kp.pins {
+		if pin.Client != "" && (pin.Client == info.Client || info.Client != "" && pin.Client == name) {
+			return kp.byName[pin.Key]
+		}
+	}
+	alias := normalizeModelName(info.Alias)
+	for _, pin := range kp.pins {
+		if pin.Model != "" && normalizeModelName(pin.Model) == alias {
+			return kp.byName[pin.Key]
+		}
+	}
+	return nil
+}
+
+// Report records the outcome of a request made with key. Rate limited and
+// unauthorized keys are quarantined, honouring Retry-After when present.
+func (kp *KeyPool) Report(key *upstreamKey, status int, header http.Header, usage ClaudeUsage) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := kp.now()
+	key.usage.Requests++
+	key.usage.InputTokens += int64(usage.InputTokens)
+	key.usage.OutputTokens += int64(usage.OutputTokens)
+
+	switch {
+	case status == http.StatusTooManyRequests:
+		key.usage.RateLimited++
+		key.lastLimited = now
+		key.quarantinedUntil = now.Add(retryAfter(header, kp.quarantine))
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		key.usage.Unauthorized++
+		key.quarantinedUntil = now.Add(kp.quarantine)
+	case status != http.StatusOK:
+		key.usage.Errors++
+	}
+}
+
+// KeyStatus is the public view of a pooled key, without the secret
+type KeyStatus struct {
+	Name             string     `json:"name"`
+	Weight           int        `json:"weight"`
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+	Usage            KeyUsage   `json:"usage"`
+}
+
+// Status returns the state of every key in the pool
+func (kp *KeyPool) Status() []KeyStatus {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+
+	now := kp.now()
+	statuses := make([]KeyStatus, 0, len(kp.keys))
+	for _, key := range kp.keys {
+		status := KeyStatus{Name: key.name, Weight: key.weight, Usage: key.usage}
+		if now.Before(key.quarantinedUntil) {
+			until := key.quarantinedUntil
+			status.QuarantinedUntil = &until
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// retryAfter parses a Retry-After header in seconds, falling back to def
+func retryAfter(header http.Header, def time.Duration) time.Duration {
+	if header == nil {
+		return def
+	}
+	if secs, err := strconv.Atoi(header.Get("Retry-After")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return def
+}
+
+// Handle GET /admin/keys
+func (s *Server) handleKeyStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Strategy string      `json:"strategy"`
+		Keys     []KeyStatus `json:"keys"`
+	}{s.config.KeyStrategy, s.keys.Status()})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Helper to create a config with a pool of three keys
+func testPoolConfig(strategy string) Config {
+	config := testConfig()
+	config.APIKey = ""
+	config.KeyStrategy = strategy
+	config.APIKeys = []APIKeyConfig{
+		{Name: "a", Key: "key-a", Weight: 3},
+		{Name: "b", Key: "key-b", Weight: 1},
+		{Name: "c", Key: "key-c", Weight: 1},
+	}
+	return config
+}
+
+// Helper to pick n keys and return their names
+func pickNames(t *testing.T, pool *KeyPool, info requestInfo, n int) []string {
+	t.Helper()
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		key, err := pool.Pick(info, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		names = append(names, key.name)
+	}
+	return names
+}
+
+// Test the key selection strategies
+func TestKeyPoolStrategies(t *testing.T) {
+	pool := NewKeyPool(testPoolConfig(KeyStrategyRoundRobin))
+	if got := pickNames(t, pool, requestInfo{}, 4); got[0] != "a" || got[1] != "b" || got[2] != "c" || got[3] != "a" {
+		t.Errorf("Unexpected round-robin order %v", got)
+	}
+
+	pool = NewKeyPool(testPoolConfig(KeyStrategyWeighted))
+	counts := make(map[string]int)
+	for _, name := range pickNames(t, pool, requestInfo{}, 10) {
+		counts[name]++
+	}
+	if counts["a"] != 6 || counts["b"] != 2 || counts["c"] != 2 {
+		t.Errorf("Unexpected weighted distribution %v", counts)
+	}
+
+	pool = NewKeyPool(testPoolConfig(KeyStrategyLeastRecentlyLimited))
+	now := time.Date(2025, 3, 26, 17, 0, 0, 0, time.UTC)
+	pool.now = func() time.Time { return now }
+	pool.Report(pool.byName["a"], http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}}, ClaudeUsage{})
+	now = now.Add(2 * time.Second)
+	pool.Report(pool.byName["b"], http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}}, ClaudeUsage{})
+	now = now.Add(2 * time.Second)
+	if got := pickNames(t, pool, requestInfo{}, 1); got[0] != "c" {
+		t.Errorf("Expected never-limited key c, got %v", got)
+	}
+}
+
+// Test that limited keys are quarantined and pins are honoured
+func TestKeyPoolQuarantineAndPins(t *testing.T) {
+	config := testPoolConfig(KeyStrategyRoundRobin)
+	config.KeyPins = []KeyPin{
+		{Client: "team-b-token", Key: "b"},
+		{Client: "team-a", Key: "a"},
+		{Model: "claude-3-opus", Key: "c"},
+	}
+	config.ClientNames = map[string]string{"team-a-token": "team-a"}
+	pool := NewKeyPool(config)
+	now := time.Date(2025, 3, 26, 17, 0, 0, 0, time.UTC)
+	pool.now = func() time.Time { return now }
+
+	pool.Report(pool.byName["a"], http.StatusUnauthorized, nil, ClaudeUsage{})
+	for _, name := range pickNames(t, pool, requestInfo{}, 4) {
+		if name == "a" {
+			t.Fatal("Expected quarantined key a to be skipped")
+		}
+	}
+
+	now = now.Add(61 * time.Second)
+	if status := pool.Status(); status[0].QuarantinedUntil != nil || status[0].Usage.Unauthorized != 1 {
+		t.Errorf("Expected key a to be back with one rejection, got %+v", status[0])
+	}
+
+	if got := pickNames(t, pool, requestInfo{Client: "team-b-token", Alias: "claude-3-opus"}, 2); got[0] != "b" || got[1] != "b" {
+		t.Errorf("Expected client pin to key b, got %v", got)
+	}
+	if got := pickNames(t, pool, requestInfo{Client: "team-a-token", Alias: "claude-3-opus"}, 1); got[0] != "a" {
+		t.Errorf("Expected client name pin to key a, got %v", got)
+	}
+	if got := pickNames(t, pool, requestInfo{Alias: "Claude-3-Opus"}, 1); got[0] != "c" {
+		t.Errorf("Expected model pin to key c, got %v", got)
+	}
+	if _, err := pool.Pick(requestInfo{Alias: "claude-3-opus"}, map[string]bool{"c": true}); err == nil {
+		t.Error("Expected no failover away from a pinned key")
+	}
+}
+
+// Test that a rate limited key fails over to the next one
+func TestCallClaudeAPIFailover(t *testing.T) {
+	config := testPoolConfig(KeyStrategyRoundRobin)
+	var seen []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Api-Key")
+		seen = append(seen, key)
+		if key == "key-a" {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, `{"type": "error"}`, http.StatusTooManyRequests)
+			return
+		}
+		json.NewEncoder(w).Encode(ClaudeResponse{
+			Content: []ClaudeContent{{Type: "text", Text: "ok"}},
+			Usage:   ClaudeUsage{InputTokens: 10, OutputTokens: 5},
+		})
+	}))
+	defer upstream.Close()
+	config.APIEndpoint = upstream.URL
+	server := NewServer(config)
+
+	resp, err := server.callClaudeAPI(context.Background(), ClaudeRequest{Model: testModelHaiku})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if getFirstContentText(resp) != "ok" || len(seen) != 2 || seen[1] != "key-b" {
+		t.Errorf("Expected failover from key-a to key-b, saw %v", seen)
+	}
+
+	status := server.keys.Status()
+	if status[0].QuarantinedUntil == nil || status[0].Usage.RateLimited != 1 {
+		t.Errorf("Expected key a to be quarantined, got %+v", status[0])
+	}
+	if status[1].Usage.InputTokens != 10 || status[1].Usage.OutputTokens != 5 {
+		t.Errorf("Expected usage accounted to key b, got %+v", status[1].Usage)
+	}
+}
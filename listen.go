@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unixPrefix marks a listen address as a Unix domain socket path
+const unixPrefix = "unix:"
+
+// certCheckInterval is how often the serving certificate files are checked
+// for changes
+const certCheckInterval = 10 * time.Second
+
+// Client certificate modes for tls_client_auth
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+)
+
+// certKeyPrefix marks a client key standing for a certificate identity
+// rather than a key the client sent
+const certKeyPrefix = "cert:"
+
+// listenAddresses returns the addresses to listen on: those in listen, or
+// every interface on port
+func listenAddresses(config Config) []string {
+	if len(config.Listen) > 0 {
+		return config.Listen
+	}
+	return []string{":" + config.Port}
+}
+
+// listen opens a listener for each address. TCP listeners serve HTTPS when
+// a certificate is configured; Unix sockets always serve plain HTTP, since
+// only local processes can reach them.
+func listen(config Config) ([]net.Listener, *tls.Config, error) {
+	tlsConfig, err := serverTLSConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var listeners []net.Listener
+	for _, address := range listenAddresses(config) {
+		ln, err := listenOn(address)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+		}
+		scheme := "http://"
+		switch {
+		case ln.Addr().Network() == "unix":
+			scheme = unixPrefix
+		case tlsConfig != nil:
+			scheme = "https://"
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		log.Printf("Listening on %s%s", scheme, ln.Addr())
+		listeners = append(listeners, ln)
+	}
+	return listeners, tlsConfig, nil
+}
+
+// listenOn opens one listener. A socket file left behind by an earlier run
+// is removed first.
+func listenOn(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// serverTLSConfig builds the TLS configuration for serving, or returns nil
+// if no certificate is configured
+func serverTLSConfig(config Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" {
+		return nil, nil
+	}
+	certs, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	if config.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client CA file %s contains no certificates", config.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	switch config.TLSClientAuth {
+	case ClientAuthRequest:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// certReloader serves a certificate and key from files, loading them again
+// when either changes, so that renewed certificates take effect without a
+// restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	checked  time.Time
+}
+
+// newCertReloader loads the certificate and key, failing if they cannot be
+// loaded
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A renewed pair that
+// fails to load, perhaps because only one file has been written so far, is
+// logged and tried again at the next check; the last good pair is served
+// meanwhile.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.checked) >= certCheckInterval {
+		if err := cr.reload(); err != nil {
+			log.Printf("Warning: Keeping the current TLS certificate: %v", err)
+		}
+	}
+	return cr.cert, nil
+}
+
+// reload loads the pair if either file has changed since the last load.
+// The caller must hold mu, except during construction.
+func (cr *certReloader) reload() error {
+	cr.checked = time.Now()
+	var modTimes [2]time.Time
+	for i, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if cr.cert != nil && modTimes == cr.modTimes {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	if cr.cert != nil {
+		log.Printf("Loaded renewed TLS certificate from %s", cr.certFile)
+	}
+	cr.cert, cr.modTimes = &cert, modTimes
+	return nil
+}
+
+type certIdentityKey struct{}
+
+// certIdentityFrom returns the client identity of the certificate the
+// request's connection presented, if any
+func certIdentityFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(certIdentityKey{}).(string)
+	return identity
+}
+
+// withClientCert maps a verified client certificate to the client identity
+// given for its subject in tls_client_identities. The full subject, such as
+// "CN=ci,O=Example", is looked up first, then the common name alone.
+func (s *Server) withClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(s.config.TLSClientIdentities) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		subject := r.TLS.VerifiedChains[0][0].Subject
+		identity, ok := s.config.TLSClientIdentities[subject.String()]
+		if !ok {
+			identity, ok = s.config.TLSClientIdentities[subject.CommonName]
+		}
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), certIdentityKey{}, identity)))
+	})
+}
+
+// listenerSettings returns the settings that only take effect on a restart
+func listenerSettings(config Config) interface{} {
+	return []interface{}{
+		listenAddresses(config), config.TLSCertFile, config.TLSKeyFile,
+		config.TLSClientCAFile, config.TLSClientAuth,
+	}
+}
+
+// validateListeners validates the listen addresses and TLS settings
+func validateListeners(config Config) error {
+	for _, address := range config.Listen {
+		if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+			if path == "" {
+				return fmt.Errorf("listen address %q has no socket path", address)
+			}
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("listen address %q must be host:port, :port or unix:/path", address)
+		}
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+
+	switch config.TLSClientAuth {
+	case "", ClientAuthNone:
+		if len(config.TLSClientIdentities) > 0 {
+			return fmt.Errorf("tls_client_identities needs tls_client_auth set to %q or %q", ClientAuthRequest, ClientAuthRequire)
+		}
+	case ClientAuthRequest, ClientAuthRequire:
+		if config.TLSCertFile == "" {
+			return fmt.Errorf("tls_client_auth needs tls_cert_file and tls_key_file")
+		}
+		if config.TLSClientCAFile == "" {
+			return fmt.Errorf("tls_client_auth needs tls_client_ca_file")
+		}
+	default:
+		return fmt.Errorf("invalid tls_client_auth %q (must be %s, %s or %s)",
+			config.TLSClientAuth, ClientAuthNone, ClientAuthRequest, ClientAuthRequire)
+	}
+
+	for subject, identity := range config.TLSClientIdentities {
+		if identity == "" {
+			return fmt.Errorf("tls_client_identities entry %q has no identity", subject)
+		}
+	}
+	return nil
+}
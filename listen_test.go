@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveListeners serves handler on the configured listeners until the test
+// ends
+func serveListeners(t *testing.T, config Config, handler http.Handler) []net.Listener {
+	t.Helper()
+	listeners, tlsConfig, err := listen(config)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+	for _, ln := range listeners {
+		go srv.Serve(ln)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return listeners
+}
+
+// Test that HTTPS listeners verify client certificates and map their
+// subjects to client identities
+func TestListenMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	clientCert, clientKeyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writeTestCertificate(t, "proxy", serverCert, serverKey)
+	writeTestCertificate(t, "ci-runner", clientCert, clientKeyFile)
+
+	config := testConfig()
+	config.Listen = []string{"127.0.0.1:0"}
+	config.TLSCertFile, config.TLSKeyFile = serverCert, serverKey
+	config.TLSClientCAFile = clientCert
+	config.TLSClientAuth = ClientAuthRequire
+	config.TLSClientIdentities = map[string]string{"ci-runner": "ci"}
+	config.RequireClientKey = true
+	s := NewServer(config)
+
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientName(s.config.ClientNames, clientKey(r))))
+	}), s.withClientCert, s.withAuth)
+	ln := serveListeners(t, config, handler)[0]
+
+	roots := x509.NewCertPool()
+	pem, _ := os.ReadFile(serverCert)
+	roots.AppendCertsFromPEM(pem)
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load client certificate: %v", err)
+	}
+	url := "https://" + ln.Addr().String() + "/api/generate"
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}}}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ci" {
+		t.Errorf("Expected the certificate to map to ci, got %d %q", resp.StatusCode, body)
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := anonymous.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected the handshake to fail without a client certificate")
+	}
+}
+
+// Test that a renewed certificate is served without a restart
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, "first", certFile, keyFile)
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	commonName := func() string {
+		cert, _ := certs.GetCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+	if name := commonName(); name != "first" {
+		t.Fatalf("Expected the first certificate, got %s", name)
+	}
+
+	writeTestCertificate(t, "second", certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if name := commonName(); name != "first" {
+		t.Errorf("Expected the certificate to be checked at most every %v, got %s", certCheckInterval, name)
+	}
+
+	certs.checked = time.Time{}
+	if name := commonName(); name != "second" {
+		t.Errorf("Expected the renewed certificate, got %s", name)
+	}
+
+	// A broken renewal keeps the last good certificate
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	os.Chtimes(keyFile, later, later)
+	certs.checked = time.Time{}
+	if name := commonName(); name != "second" {
+		t.Errorf("Expected the last good certificate, got %s", name)
+	}
+}
+
+// Test listening on a loopback address and a Unix socket at once
+func TestListenMultiple(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+	config := testConfig()
+	config.Listen = []string{"127.0.0.1:0", unixPrefix + socket}
+	listeners := serveListeners(t, config, NewServer(config).Handler())
+
+	if host, _, _ := net.SplitHostPort(listeners[0].Addr().String()); host != "127.0.0.1" {
+		t.Errorf("Expected to listen on loopback only, got %s", listeners[0].Addr())
+	}
+	resp, err := http.Get("http://" + listeners[0].Addr().String() + "/livez")
+	if err != nil {
+		t.Fatalf("TCP request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err = unixClient.Get("http://proxy/api/version")
+	if err != nil {
+		t.Fatalf("Unix socket request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), config.OllamaVersion) {
+		t.Errorf("Expected the version over the socket, got %s", body)
+	}
+}
+
+// Test validation of the listener settings
+func TestValidateListeners(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(*Config)
+		valid  bool
+	}{
+		{"defaults", func(c *Config) {}, true},
+		{"addresses", func(c *Config) { c.Listen = []string{"127.0.0.1:8080", "[::1]:8080", "unix:/run/proxy.sock"} }, true},
+		{"no port", func(c *Config) { c.Listen = []string{"localhost"} }, false},
+		{"no socket path", func(c *Config) { c.Listen = []string{"unix:"} }, false},
+		{"cert without key", func(c *Config) { c.TLSCertFile = "cert.pem" }, false},
+		{"client auth without TLS", func(c *Config) {
+			c.TLSClientAuth = ClientAuthRequire
+			c.TLSClientCAFile = "ca.pem"
+		}, false},
+		{"client auth without CA", func(c *Config) {
+			c.TLSCertFile, c.TLSKeyFile = "cert.pem", "key.pem"
+			c.TLSClientAuth = ClientAuthRequest
+		}, false},
+		{"unknown client auth", func(c *Config) { c.TLSClientAuth = "optional" }, false},
+		{"identities without client auth", func(c *Config) { c.TLSClientIdentities = map[string]string{"ci": "ci"} }, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			tc.modify(&config)
+			err := validateListeners(config)
+			if tc.valid && err != nil {
+				t.Errorf("Expected valid config, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
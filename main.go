@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -21,17 +23,27 @@ type ModelID string
 
 // Ollama API structures
 type OllamaRequest struct {
-	Model   string        `json:"model"`
-	Prompt  string        `json:"prompt"`
-	Options OllamaOptions `json:"options"`
-	Stream  bool          `json:"stream"`
+	Model    string        `json:"model"`
+	Prompt   string        `json:"prompt"`
+	Suffix   string        `json:"suffix,omitempty"`
+	System   string        `json:"system,omitempty"`
+	Template string        `json:"template,omitempty"`
+	Raw      bool          `json:"raw,omitempty"`
+	Options  OllamaOptions `json:"options"`
+	Stream   bool          `json:"stream"`
+	Context  []int         `json:"context,omitempty"`
+	// SessionID references a server-side session holding the history
+	SessionID string `json:"session_id,omitempty"`
+	// Metadata is available to system prompt templates
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type OllamaOptions struct {
-	Temperature float64 `json:"temperature"`
-	TopP        float64 `json:"top_p"`
-	TopK        int     `json:"top_k"`
-	NumPredict  int     `json:"num_predict"`
+	Temperature float64  `json:"temperature"`
+	TopP        float64  `json:"top_p"`
+	TopK        int      `json:"top_k"`
+	NumPredict  int      `json:"num_predict"`
+	Stop        []string `json:"stop,omitempty"`
 }
 
 type OllamaResponse struct {
@@ -39,6 +51,9 @@ type OllamaResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Response  string    `json:"response"`
 	Done      bool      `json:"done"`
+	// DoneReason is "load" for an empty prompt, which only loads the model
+	DoneReason string `json:"done_reason,omitempty"`
+	Context    []int  `json:"context,omitempty"`
 }
 
 // Claude API request structures
@@ -68,6 +83,9 @@ type ClaudeRequest struct {
 	Temperature *float32 `json:"temperature,omitempty"`
 	TopP        *float32 `json:"top_p,omitempty"`
 	TopK        *int     `json:"top_k,omitempty"`
+
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	Stream        bool     `json:"stream,omitempty"`
 }
 
 type ClaudeContent struct {
@@ -75,12 +93,20 @@ type ClaudeContent struct {
 	Text string `json:"text"`
 }
 
+type ClaudeUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+}
+
 type ClaudeResponse struct {
 	ID         string          `json:"id"`
 	Type       string          `json:"type"`
 	Role       string          `json:"role"`
 	Content    []ClaudeContent `json:"content"`
 	StopReason string          `json:"stop_reason"`
+	Usage      ClaudeUsage     `json:"usage"`
 }
 
 // Server holds the server configuration and dependencies
@@ -88,10 +114,40 @@ type Server struct {
 	config    Config
 	modelMap  map[string]ModelID
 	templates *template.Template
+	contexts  *ContextStore
+	sessions  *SessionStore
+	models    *ModelStore
+	keys      *KeyPool
+	backends  map[string]Backend
+	breakers  *BreakerSet
+	audit     *AuditStore
+	usage     *UsageStore
+	client    *http.Client
+	health    *HealthCache
+	loadedAt  time.Time
+	requests  *RequestMetrics
+	limit     chan struct{}
+	cors      corsPolicy
+	state     *lifecycle
+	handler   http.Handler
+	inflight  inflight
+
+	ollamaUpstreams map[string]*OllamaUpstream
 }
 
 // NewServer creates a new proxy server instance
 func NewServer(config Config) *Server {
+	return newServer(config, nil)
+}
+
+// reconfigure builds a Server for a new configuration. Stores and
+// connection pools whose settings did not change carry over, so sessions,
+// contexts, usage and breaker state survive a reload.
+func (s *Server) reconfigure(config Config) *Server {
+	return newServer(config, s)
+}
+
+func newServer(config Config, prev *Server) *Server {
 	// Try to parse templates from multiple possible locations
 	var tmpl *template.Template
 	var err error
@@ -115,11 +171,126 @@ func NewServer(config Config) *Server {
 		log.Printf("Warning: Failed to parse templates: %v", err)
 	}
 
-	return &Server{
+	// unchanged reports whether the previous server had the same settings
+	unchanged := func(settings func(Config) interface{}) bool {
+		return prev != nil && reflect.DeepEqual(settings(prev.config), settings(config))
+	}
+
+	var contexts *ContextStore
+	if unchanged(func(c Config) interface{} { return [3]int{c.ContextTTLSecs, c.ContextMaxEntries, c.ContextMaxMessages} }) {
+		contexts = prev.contexts
+	} else {
+		contexts = NewContextStore(
+			time.Duration(config.ContextTTLSecs)*time.Second,
+			config.ContextMaxEntries,
+			config.ContextMaxMessages,
+		)
+	}
+
+	var sessions *SessionStore
+	if unchanged(func(c Config) interface{} { return c.SessionDir }) {
+		sessions = prev.sessions
+	} else if sessions, err = NewSessionStore(config.SessionDir); err != nil {
+		log.Printf("Warning: Failed to open session store, keeping sessions in memory: %v", err)
+		sessions, _ = NewSessionStore("")
+	}
+
+	var models *ModelStore
+	if unchanged(func(c Config) interface{} { return c.ModelsFile }) {
+		models = prev.models
+	} else if models, err = NewModelStore(config.ModelsFile); err != nil {
+		log.Printf("Warning: Failed to load custom models, keeping them in memory: %v", err)
+		models, _ = NewModelStore("")
+	}
+
+	var client *http.Client
+	if unchanged(transportSettings) {
+		client = prev.client
+	} else if client, err = newUpstreamClient(config); err != nil {
+		log.Printf("Warning: Failed to set up the upstream transport, using defaults: %v", err)
+		client = &http.Client{Timeout: time.Duration(config.RequestTimeoutSecs) * time.Second}
+	}
+
+	var keys *KeyPool
+	if unchanged(func(c Config) interface{} {
+		return []interface{}{c.APIKey, c.APIKeys, c.KeyStrategy, c.KeyQuarantineSecs, c.KeyPins, c.ClientNames}
+	}) {
+		keys = prev.keys
+	} else {
+		keys = NewKeyPool(config)
+	}
+
+	backends, err := buildBackends(config, keys, client)
+	if err != nil {
+		log.Printf("Warning: Failed to set up backends, using Anthropic only: %v", err)
+		backends, _ = buildBackends(Config{APIEndpoint: config.APIEndpoint, APIVersion: config.APIVersion}, keys, client)
+	}
+
+	var breakers *BreakerSet
+	if unchanged(func(c Config) interface{} {
+		return []interface{}{c.BreakerErrorRate, c.BreakerMinRequests, c.BreakerWindowSecs, c.BreakerOpenSecs, c.BreakerSlowCallSecs}
+	}) {
+		breakers = prev.breakers
+	} else {
+		breakers = NewBreakerSet(config)
+	}
+
+	var usage *UsageStore
+	if unchanged(func(c Config) interface{} { return c.UsageFile }) {
+		usage = prev.usage
+		usage.SetPricing(config.Prices, config.SpendCaps)
+	} else if usage, err = NewUsageStore(config); err != nil {
+		log.Printf("Warning: Failed to load usage, starting from zero in memory: %v", err)
+		config.UsageFile = ""
+		usage, _ = NewUsageStore(config)
+	}
+
+	var audit *AuditStore
+	if unchanged(func(c Config) interface{} { return c.AuditFile }) {
+		audit = prev.audit
+	} else if audit, err = NewAuditStore(config.AuditFile); err != nil {
+		log.Printf("Warning: Failed to open audit file, keeping records in memory: %v", err)
+		audit, _ = NewAuditStore("")
+	}
+
+	// Request metrics and process state belong to the process, not to one
+	// configuration
+	requests, state := NewRequestMetrics(), newLifecycle()
+	if prev != nil {
+		requests, state = prev.requests, prev.state
+	}
+
+	var limit chan struct{}
+	if unchanged(func(c Config) interface{} { return c.MaxConcurrentRequests }) {
+		limit = prev.limit
+	} else if config.MaxConcurrentRequests > 0 {
+		limit = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+
+	s := &Server{
 		config:    config,
 		modelMap:  buildModelMap(config),
 		templates: tmpl,
+		contexts:  contexts,
+		sessions:  sessions,
+		models:    models,
+		keys:      keys,
+		backends:  withUsage(withBreakers(backends, breakers), usage, config.ClientNames),
+		breakers:  breakers,
+		audit:     audit,
+		usage:     usage,
+		client:    client,
+		health:    NewHealthCache(time.Duration(config.ReadinessCheckSecs) * time.Second),
+		loadedAt:  time.Now(),
+		requests:  requests,
+		limit:     limit,
+		cors:      newCORSPolicy(config),
+		state:     state,
+
+		ollamaUpstreams: buildOllamaUpstreams(config, client),
 	}
+	s.handler = s.newHandler()
+	return s
 }
 
 // Builds a map of Ollama model names to Claude model IDs
@@ -142,7 +313,15 @@ func buildModelMap(config Config) map[string]ModelID {
 // Map Ollama model names to Claude model IDs
 func (s *Server) mapModelName(name string) ModelID {
 	// Convert to lowercase for case-insensitive matching
-	name = strings.ToLower(name)
+	name = normalizeModelName(name)
+
+	// Custom models resolve through the alias or model ID they were created from
+	if custom, exists := s.models.Get(name); exists {
+		if model, exists := s.modelMap[normalizeModelName(custom.From)]; exists {
+			return model
+		}
+		return ModelID(custom.From)
+	}
 
 	if model, exists := s.modelMap[name]; exists {
 		return model
@@ -152,6 +331,14 @@ func (s *Server) mapModelName(name string) ModelID {
 	return ModelID(s.config.DefaultModel)
 }
 
+// Returns the context window of a Claude model in tokens
+func contextWindow(model ModelID) int {
+	if strings.HasPrefix(string(model), "claude-2") {
+		return 100000
+	}
+	return 200000
+}
+
 // Create a user message from text
 func NewUserTextMessage(text string) Message {
 	return Message{
@@ -165,56 +352,17 @@ func NewUserTextMessage(text string) Message {
 	}
 }
 
-// Call the Claude API directly
-func (s *Server) callClaudeAPI(ctx context.Context, claudeReq ClaudeRequest) (*ClaudeResponse, error) {
-	// Get API key from environment if not in config
-	apiKey := s.config.APIKey
-	if apiKey == "" {
-		apiKey = os.Getenv("ANTHROPIC_API_KEY")
-		if apiKey == "" {
-			return nil, fmt.Errorf("API key not found in config or environment")
-		}
-	}
-
-	// Marshal the request body
-	reqBody, err := json.Marshal(claudeReq)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	// Create the HTTP request
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.APIEndpoint, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("X-Api-Key", apiKey)
-	req.Header.Set("Anthropic-Version", s.config.APIVersion)
-
-	// Send the request
-	client := &http.Client{Timeout: time.Duration(s.config.RequestTimeoutSecs) * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call Claude API: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Check for error status code
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("claude API returned status %d: %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	// Parse the response
-	var claudeResp ClaudeResponse
-	if err := json.NewDecoder(resp.Body).Decode(&claudeResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+// Create an assistant message from text
+func NewAssistantTextMessage(text string) Message {
+	return Message{
+		Role: RoleAssistant,
+		Content: []MessageContent{
+			{
+				Type: "text",
+				Text: text,
+			},
+		},
 	}
-
-	return &claudeResp, nil
 }
 
 // Extract the first text from a Claude response
@@ -234,25 +382,192 @@ func getFirstContentText(resp *ClaudeResponse) string {
 
 // Handle Ollama-compatible requests
 func (s *Server) handleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
-	// Parse the Ollama request
+	// Parse the Ollama request, keeping the body for Ollama fallbacks
 	var ollamaReq OllamaRequest
-	if err := json.NewDecoder(r.Body).Decode(&ollamaReq); err != nil {
-		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+	rawBody, err := s.decodeRequest(r, &ollamaReq)
+	if err != nil {
+		writeRequestError(w, err)
 		return
 	}
 
-	// Map Ollama model to Claude model
-	claudeModel := s.mapModelName(ollamaReq.Model)
-	log.Printf("Mapped Ollama model '%s' to Claude model '%s'", ollamaReq.Model, claudeModel)
+	// Load the referenced session, if any, once any other turn on it is done
+	var session *Session
+	if ollamaReq.SessionID != "" {
+		defer s.sessions.LockTurn(ollamaReq.SessionID)()
+		var ok bool
+		session, ok = s.ownSession(r, ollamaReq.SessionID)
+		if !ok {
+			writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("session %q not found", ollamaReq.SessionID))
+			return
+		}
+		if ollamaReq.Model == "" {
+			ollamaReq.Model = session.Model
+		}
+	}
+
+	// Reject bad requests before spending any tokens
+	if err := s.validateGenerate(&ollamaReq, session); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	// As in Ollama, an empty prompt only loads the model
+	if ollamaReq.Prompt == "" && ollamaReq.Suffix == "" {
+		writeJSON(w, http.StatusOK, OllamaResponse{
+			Model:      ollamaReq.Model,
+			CreatedAt:  time.Now(),
+			Done:       true,
+			DoneReason: "load",
+		})
+		return
+	}
+
+	// Custom models supply defaults for anything the request leaves unset
+	custom, isCustom := s.models.Get(ollamaReq.Model)
+	if isCustom {
+		applyCustomModel(&ollamaReq, custom)
+	}
+
+	// Expand the context handle back into the prior conversation
+	var history []Message
+	if len(ollamaReq.Context) > 0 {
+		if messages, ok := s.contexts.Get(ollamaReq.Context); ok {
+			history = messages
+		} else {
+			log.Printf("Ignoring unknown or expired context handle %v", ollamaReq.Context)
+		}
+	}
+
+	// New conversations with a custom model start from its seed messages
+	if len(history) == 0 && isCustom {
+		history = append(history, custom.Messages...)
+	}
+
+	// The routing input doubles as what system prompt templates see
+	client := clientKey(r)
+	in := routeInput{
+		Alias:   ollamaReq.Model,
+		Client:  client,
+		Options: ollamaReq.Options,
+		Stream:  ollamaReq.Stream,
+		FIM:     ollamaReq.Suffix != "",
+		Header:  r.Header,
+		Time:    time.Now(),
+	}
+
+	// Combine the system prompt configured for the alias and client with
+	// the one the request or session brings
+	supplied := ollamaReq.System
+	if session != nil {
+		supplied = session.System
+	}
+	system, err := s.systemPrompt(in, ollamaReq.Metadata, supplied)
+	if errors.Is(err, errSystemPromptRejected) {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error building system prompt: %v", err)
+		writeOllamaError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Apply the client's template unless the prompt is raw
+	prompt := ollamaReq.Prompt
+	if ollamaReq.Template != "" && !ollamaReq.Raw && ollamaReq.Suffix == "" {
+		rendered, err := renderPromptTemplate(ollamaReq.Template, system, prompt, ollamaReq.Suffix)
+		if err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		prompt = rendered
+	}
+
+	// Pick the Claude model and backend by the routing rules
+	routeHistory := history
+	if session != nil {
+		routeHistory = session.Messages
+	}
+	in.PromptTokens = estimateTokens(system) + estimateTokens(prompt) + estimateTokens(ollamaReq.Suffix)
+	for _, msg := range routeHistory {
+		in.PromptTokens += estimateMessageTokens(msg)
+	}
+	decision := s.route(in, false)
+	claudeModel := decision.Model
+	if decision.Rule != "" {
+		log.Printf("Route %q sends Ollama model '%s' to Claude model '%s' on backend %q", decision.Rule, ollamaReq.Model, claudeModel, decision.Backend)
+	} else {
+		log.Printf("Mapped Ollama model '%s' to Claude model '%s'", ollamaReq.Model, claudeModel)
+	}
+
+	// An experiment on the alias may swap in the model of the client's variant
+	experiment := s.experimentFor(ollamaReq.Model)
+	variant := "primary"
+	if experiment != nil {
+		if v := experiment.assign(stickyClient(r, client)); v != nil {
+			variant = v.Name
+			claudeModel = s.resolveModel(v.Model)
+			if v.Backend != "" {
+				decision.Backend = v.Backend
+			}
+			log.Printf("Experiment %s assigns variant %s, using Claude model '%s'", experiment.Name, v.Name, claudeModel)
+		}
+	}
+	ctx := withRequestInfo(r.Context(), requestInfo{Client: client, Alias: ollamaReq.Model, Backend: decision.Backend})
+
+	// Once a spend cap covering the request is used up, send it to a local
+	// Ollama fallback if the alias has one, and reject it otherwise
+	if err := s.usage.CheckCaps(clientName(s.config.ClientNames, client), ollamaReq.Model); err != nil {
+		if s.forwardToOllama(ctx, w, rawBody) {
+			log.Printf("Sent request to the Ollama fallback: %v", err)
+			return
+		}
+		log.Printf("Rejecting request: %v", err)
+		writeOllamaError(w, http.StatusPaymentRequired, err.Error())
+		return
+	}
 
 	// Create the Claude message request
 	claudeReq := ClaudeRequest{
-		Model: claudeModel,
-		Messages: []Message{
-			NewUserTextMessage(ollamaReq.Prompt),
-		},
-		System:    s.config.SystemPrompt,
-		MaxTokens: ollamaReq.Options.NumPredict,
+		Model:         claudeModel,
+		Messages:      append(history, NewUserTextMessage(prompt)),
+		System:        system,
+		MaxTokens:     ollamaReq.Options.NumPredict,
+		StopSequences: ollamaReq.Options.Stop,
+	}
+
+	// Fill-in-the-middle requests from code editors are stateless and use
+	// their own prompt in place of any template. Sessions supply their own
+	// history in place of the context handle.
+	compacted := 0
+	if ollamaReq.Suffix != "" {
+		if ollamaReq.Template != "" {
+			log.Printf("Ignoring client template for fill-in-the-middle request")
+		}
+		claudeReq.Messages = buildFIMMessages(ollamaReq.Prompt, ollamaReq.Suffix)
+		claudeReq.StopSequences = append([]string{fimCloseTag}, ollamaReq.Options.Stop...)
+	} else if session != nil {
+		session.Messages = append(session.Messages, NewUserTextMessage(prompt))
+		before := len(session.Messages)
+		s.compactSession(ctx, session, system, claudeModel, claudeReq.MaxTokens)
+		compacted = before - len(session.Messages)
+		claudeReq.Messages = session.Messages
+		claudeReq.System = sessionSystemPrompt(session, system)
+	}
+
+	// Raw prompts are sent as-is, without a system prompt
+	if ollamaReq.Raw {
+		claudeReq.System = ""
+	}
+
+	// Check the request fits the model, truncating old history if configured to
+	applied, err := s.fitContextWindow(ctx, decision.Backend, &claudeReq)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if applied.Dropped > 0 {
+		w.Header().Set(truncationHeader, applied.String())
 	}
 
 	// Set optional parameters
@@ -275,16 +590,72 @@ func (s *Server) handleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Claude API request (via Ollama compat): %s", string(reqJSON))
 	}
 
-	// Send the request to Claude
-	resp, err := s.callClaudeAPI(context.Background(), claudeReq)
+	// Send the request to Claude, streaming Ollama frames back if asked to.
+	// Fill-in-the-middle output is cleaned as a whole, so it is never streamed.
+	var stream *ollamaStream
+	if ollamaReq.Stream && ollamaReq.Suffix == "" {
+		stream = newOllamaStream(w, ollamaReq.Model)
+		claudeReq.Stream = true
+	}
+	start := time.Now()
+	resp, err := s.generateWithFallback(ctx, w, rawBody, claudeReq, stream)
+	if err == nil && resp == nil {
+		// An Ollama fallback has already written the response
+		return
+	}
+
+	// Record calls made for an experiment, and mirror a sample to its shadow
+	if experiment != nil {
+		auditID := newAuditID()
+		s.recordExperiment(AuditRecord{
+			ID:         auditID,
+			Experiment: experiment.Name,
+			Variant:    variant,
+			Client:     clientName(s.config.ClientNames, client),
+			Alias:      ollamaReq.Model,
+			Model:      claudeReq.Model,
+			Backend:    w.Header().Get(backendHeader),
+			LatencyMS:  time.Since(start).Milliseconds(),
+		}, resp, err)
+		if err == nil && experiment.sampleShadow() {
+			s.startShadow(experiment, auditID, requestInfoFrom(ctx), claudeReq)
+		}
+	}
 	if err != nil {
 		log.Printf("Error calling Claude API: %v", err)
+		if stream != nil && stream.started {
+			stream.Error(err)
+			return
+		}
+		var openErr *breakerOpenError
+		if errors.As(err, &openErr) {
+			w.Header().Set("Retry-After", strconv.Itoa(openErr.retryAfterSecs()))
+			http.Error(w, fmt.Sprintf("Service unavailable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, fmt.Sprintf("Claude API error: %v", err), http.StatusBadGateway)
 		return
 	}
 
 	// Extract text from response
 	responseText := getFirstContentText(resp)
+	if ollamaReq.Suffix != "" {
+		responseText = cleanFIMCompletion(responseText, ollamaReq.Prompt, ollamaReq.Suffix)
+	}
+
+	// Record the exchange in the session
+	if session != nil && ollamaReq.Suffix == "" {
+		// Messages appended while the call was in flight are kept; only
+		// the turn itself is added and the compacted messages removed
+		_, err := s.sessions.Update(session.ID, func(stored *Session) {
+			kept := stored.Messages[min(compacted, len(stored.Messages)):]
+			stored.Messages = append(kept, NewUserTextMessage(prompt), NewAssistantTextMessage(responseText))
+			stored.Summary = session.Summary
+		})
+		if err != nil {
+			log.Printf("Error updating session %s: %v", session.ID, err)
+		}
+	}
 
 	// Create Ollama response
 	ollamaResp := OllamaResponse{
@@ -293,12 +664,28 @@ func (s *Server) handleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
 		Response:  responseText,
 		Done:      true,
 	}
+	if session == nil && ollamaReq.Suffix == "" && !ollamaReq.Raw {
+		ollamaResp.Context = s.contexts.Put(append(claudeReq.Messages, NewAssistantTextMessage(responseText)))
+	}
 
 	// Return response
+	if stream != nil {
+		stream.Done(ollamaResp)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ollamaResp)
 }
 
+// Write a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
 // Health check endpoint
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
@@ -357,33 +744,104 @@ func (s *Server) handleUI(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Setup routes and start the server
-func (s *Server) Start(port string) error {
-	// Setup routes
-	http.HandleFunc("/health", s.handleHealth)
-	http.HandleFunc("/", s.handleUI)
+// Handler returns the proxy's HTTP handler: its routes behind the
+// middleware chain. Each Server has its own, so several can run in one
+// process and the proxy can be embedded in other services.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
 
-	// Setup API routes with CORS
-	http.HandleFunc("/api/generate", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+// newHandler builds the routes and wraps them in the middleware chain, the
+// first middleware being the outermost
+func (s *Server) newHandler() http.Handler {
+	return chain(s.routes(),
+		withRequestID,
+		s.withClientCert,
+		s.requests.middleware,
+		withLogging,
+		withRecovery,
+		s.withCORS,
+		s.withAuth,
+		s.withAdmin,
+		s.withLimit,
+		s.withBodyLimit,
+	)
+}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+// routes returns the proxy's routes
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealthDraining)
+	mux.HandleFunc("GET /livez", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("/", s.handleUI)
+	mux.HandleFunc("POST /api/generate", s.handleOllamaGenerate)
+	mux.HandleFunc("/api/generate", methodNotAllowed(http.MethodPost))
+	mux.HandleFunc("POST /api/count_tokens", s.handleCountTokens)
+
+	// Model management routes
+	mux.HandleFunc("GET /api/tags", s.handleTags)
+	mux.HandleFunc("POST /api/create", s.handleCreateModel)
+	mux.HandleFunc("POST /api/copy", s.handleCopyModel)
+	mux.HandleFunc("DELETE /api/delete", s.handleDeleteModel)
+
+	// Compatibility routes for Ollama clients
+	mux.HandleFunc("GET /api/version", s.handleVersion)
+	mux.HandleFunc("POST /api/pull", s.handlePull)
+	mux.HandleFunc("POST /api/push", s.handlePush)
+	mux.HandleFunc("POST /api/embed", s.handleEmbed)
+	mux.HandleFunc("POST /api/embeddings", s.handleEmbed)
+
+	// Admin routes
+	mux.HandleFunc("GET /admin/keys", s.handleKeyStatus)
+	mux.HandleFunc("GET /admin/breakers", s.handleBreakerStatus)
+	mux.HandleFunc("POST /admin/route/explain", s.handleRouteExplain)
+	mux.HandleFunc("GET /admin/audit", s.handleAudit)
+	mux.HandleFunc("GET /admin/usage", s.handleUsage)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+
+	// Session routes
+	mux.HandleFunc("POST /api/sessions", s.handleCreateSession)
+	mux.HandleFunc("GET /api/sessions", s.handleListSessions)
+	mux.HandleFunc("GET /api/sessions/{id}", s.handleGetSession)
+	mux.HandleFunc("DELETE /api/sessions/{id}", s.handleDeleteSession)
+	mux.HandleFunc("POST /api/sessions/{id}/messages", s.handleAppendSessionMessage)
+	return mux
+}
 
-		s.handleOllamaGenerate(w, r)
-	})
+// Start serves the live Server's handler on the configured addresses until
+// shutdown
+func (rl *Reloader) Start() error {
+	listeners, tlsConfig, err := listen(rl.Server().config)
+	if err != nil {
+		return err
+	}
 
-	// Start the server
-	log.Printf("Ollama-Claude proxy listening on port %s...", port)
-	log.Printf("UI available at http://localhost:%s/", port)
-	return http.ListenAndServe(":"+port, nil)
+	// Requests derive their context from base, so that cancelling it at the
+	// end of a drain cancels their upstream calls
+	base, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Handler:     rl.Handler(),
+		TLSConfig:   tlsConfig,
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	log.Printf("Ollama-Claude proxy started; the UI is served at /")
+	return rl.serve(srv, listeners, cancel)
 }
 
 func main() {
+	// Run a subcommand instead of the server if one is named
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			err := command(os.Args[2:], os.Stdout)
+			if err != nil && !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Define command-line flags
 	configPathPtr := flag.String("config", "", "Path to configuration file")
 	flag.Parse()
@@ -394,7 +852,11 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Create and start server
-	server := NewServer(config)
-	log.Fatal(server.Start(config.Port))
+	// Create the server and reload it when the configuration changes
+	reloader := NewReloader(*configPathPtr, NewServer(config))
+	go reloader.Watch(context.Background(), time.Duration(config.ConfigWatchSecs)*time.Second)
+	if err := reloader.Start(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Shut down")
 }
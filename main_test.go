@@ -15,14 +15,62 @@ func testConfig() Config {
 	return Config{
 		APIKey:             "test-api-key",
 		Port:               "8080",
+		DrainSecs:          25,
+		MaxRequestBytes:    10 << 20,
+		ContextOverflow:    ContextOverflowReject,
+		TruncationStrategy: TruncationDropOldest,
+		CORSMethods:        []string{"GET", "POST", "DELETE"},
+		CORSHeaders:        []string{"Content-Type", "Authorization", "X-Api-Key", "Anthropic-Version", "X-Request-Id"},
+		CORSMaxAgeSecs:     600,
 		APIVersion:         "2023-06-01",
 		APIEndpoint:        "https://api.anthropic.com/v1/messages",
 		SystemPrompt:       "You are Claude, an AI assistant by Anthropic.",
+		SystemPromptPolicy: SystemPolicyReplace,
 		DefaultModel:       "claude-3-5-sonnet-20240620",
 		RequestTimeoutSecs: 60,
+		KeyStrategy:        KeyStrategyRoundRobin,
+		KeyQuarantineSecs:  60,
+		DefaultBackend:     BackendAnthropic,
+		BreakerErrorRate:   0.5,
+		BreakerMinRequests: 10,
+		BreakerWindowSecs:  60,
+		BreakerOpenSecs:    30,
+		ContextTTLSecs:     1800,
+		ContextMaxEntries:  1000,
+		ContextMaxMessages: 50,
+		OllamaVersion:      "0.5.7",
 	}
 }
 
+// Helper to start a stand-in Claude API that answers every request with the
+// text returned by reply. The server's endpoint is written into config.
+func newFakeClaude(t *testing.T, config *Config, reply func(ClaudeRequest) string) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ClaudeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := ClaudeResponse{
+			ID:         "msg_test",
+			Type:       "message",
+			Role:       "assistant",
+			Content:    []ClaudeContent{{Type: "text", Text: reply(req)}},
+			StopReason: "end_turn",
+			Usage:      ClaudeUsage{InputTokens: 1000, OutputTokens: 200},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(ts.Close)
+
+	config.APIEndpoint = ts.URL
+	return ts
+}
+
 // Constants for testing
 const (
 	testModelOpus     = ModelID("claude-3-opus-20240229")
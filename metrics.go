@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// requestDurationBuckets are the upper bounds, in seconds, of the request
+// duration histogram. Completions run for seconds to minutes.
+var requestDurationBuckets = []float64{0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// requestKey identifies a series of the request counter
+type requestKey struct {
+	Route  string
+	Method string
+	Status int
+}
+
+// durationHistogram counts request durations into requestDurationBuckets
+type durationHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// RequestMetrics counts the requests the proxy serves and how long they
+// take, by route
+type RequestMetrics struct {
+	mu        sync.Mutex
+	inFlight  int
+	requests  map[requestKey]uint64
+	durations map[string]*durationHistogram
+}
+
+// NewRequestMetrics creates empty request metrics
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*durationHistogram),
+	}
+}
+
+// middleware records each request under the route pattern that served it
+func (rm *RequestMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rm.mu.Lock()
+		rm.inFlight++
+		rm.mu.Unlock()
+
+		sw := wrapWriter(w)
+		start := time.Now()
+		defer func() {
+			// The mux sets the pattern on the request it was given
+			route := r.Pattern
+			if route == "" {
+				route = "unmatched"
+			}
+			rm.observe(route, r.Method, sw.Status(), time.Since(start))
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// observe records one finished request
+func (rm *RequestMetrics) observe(route, method string, status int, elapsed time.Duration) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.inFlight--
+	rm.requests[requestKey{Route: route, Method: method, Status: status}]++
+
+	histogram, ok := rm.durations[route]
+	if !ok {
+		histogram = &durationHistogram{counts: make([]uint64, len(requestDurationBuckets))}
+		rm.durations[route] = histogram
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// WriteMetrics writes the request metrics in the Prometheus text format
+func (rm *RequestMetrics) WriteMetrics(w io.Writer) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ollama_proxy_http_requests_in_flight Requests being served.")
+	fmt.Fprintln(w, "# TYPE ollama_proxy_http_requests_in_flight gauge")
+	fmt.Fprintf(w, "ollama_proxy_http_requests_in_flight %d\n", rm.inFlight)
+
+	keys := make([]requestKey, 0, len(rm.requests))
+	for key := range rm.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Route != keys[j].Route {
+			return keys[i].Route < keys[j].Route
+		}
+		if keys[i].Method != keys[j].Method {
+			return keys[i].Method < keys[j].Method
+		}
+		return keys[i].Status < keys[j].Status
+	})
+	fmt.Fprintln(w, "# HELP ollama_proxy_http_requests_total Requests served, by route, method and status.")
+	fmt.Fprintln(w, "# TYPE ollama_proxy_http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "ollama_proxy_http_requests_total{route=%q,method=%q,status=\"%d\"} %d\n", key.Route, key.Method, key.Status, rm.requests[key])
+	}
+
+	fmt.Fprintln(w, "# HELP ollama_proxy_http_request_duration_seconds Time to serve a request, by route.")
+	fmt.Fprintln(w, "# TYPE ollama_proxy_http_request_duration_seconds histogram")
+	for _, route := range sortedKeys(rm.durations) {
+		histogram := rm.durations[route]
+		for i, bound := range requestDurationBuckets {
+			fmt.Fprintf(w, "ollama_proxy_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, strconv.FormatFloat(bound, 'g', -1, 64), histogram.counts[i])
+		}
+		fmt.Fprintf(w, "ollama_proxy_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, histogram.count)
+		fmt.Fprintf(w, "ollama_proxy_http_request_duration_seconds_sum{route=%q} %s\n", route, strconv.FormatFloat(histogram.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "ollama_proxy_http_request_duration_seconds_count{route=%q} %d\n", route, histogram.count)
+	}
+}
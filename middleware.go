@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// requestIDHeader carries the ID that ties a request to its log lines
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds request IDs accepted from clients
+const maxRequestIDLength = 128
+
+// publicPaths are served without a client key or a concurrency slot, so
+// that probes, scrapes and the UI page keep working
+var publicPaths = map[string]bool{
+	"/":        true,
+	"/health":  true,
+	"/livez":   true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// quietPaths are not logged, since probes and scrapes would drown out the
+// requests worth reading
+var quietPaths = map[string]bool{
+	"/health":  true,
+	"/livez":   true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// middleware wraps a handler with behaviour shared by every route
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in middlewares, the first being the outermost
+func chain(h http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// statusWriter records the status and size of a response. It passes
+// flushes through, so that streams keep working behind it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// wrapWriter returns w as a statusWriter, wrapping it unless it already is
+func wrapWriter(w http.ResponseWriter) *statusWriter {
+	if sw, ok := w.(*statusWriter); ok {
+		return sw
+	}
+	return &statusWriter{ResponseWriter: w}
+}
+
+// WriteHeader implements http.ResponseWriter
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Status returns the response status, 200 if nothing has been written
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID of the request ctx belongs to, if any
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID gives each request an ID, keeping one the client sent if
+// it is reasonable, and returns it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newAuditID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether a client's request ID is safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// withLogging logs each request once it has been served
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if quietPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := wrapWriter(w)
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		log.Printf("[%s] %s %s %d %dB %v", requestIDFrom(r.Context()), r.Method, r.URL.Path,
+			sw.Status(), sw.bytes, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// withRecovery turns a panic in a handler into a 500, so that one bad
+// request does not take the process down
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := wrapWriter(w)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// The server uses this panic to abort a response on purpose
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			log.Printf("[%s] Panic serving %s %s: %v\n%s", requestIDFrom(r.Context()), r.Method, r.URL.Path, v, debug.Stack())
+			if sw.status == 0 {
+				writeOllamaError(sw, http.StatusInternalServerError, "internal server error")
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// withAuth rejects requests without a known client key or certificate
+// identity when require_client_key is set. Keys that pose as a certificate
+// identity are always rejected.
+func (s *Server) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(headerKey(r), certKeyPrefix) && !publicPaths[r.URL.Path] {
+			writeOllamaError(w, http.StatusUnauthorized, "client keys must not start with "+certKeyPrefix)
+			return
+		}
+		// Admin routes have their own keys, checked by withAdmin
+		if !s.config.RequireClientKey || publicPaths[r.URL.Path] || isAdminPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := clientKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeOllamaError(w, http.StatusUnauthorized, "a client key is required")
+			return
+		}
+		if !knownClient(r, s.config.ClientNames, key) {
+			writeOllamaError(w, http.StatusUnauthorized, "unknown client key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminPrefix starts the paths of the admin routes
+const adminPrefix = "/admin/"
+
+// isAdminPath reports whether path is an admin route
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, adminPrefix)
+}
+
+// withAdmin restricts the admin routes to the keys in admin_keys. Without
+// admin keys the routes are turned off, since they expose every client's
+// prompts and spend.
+func (s *Server) withAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(s.config.AdminKeys) == 0 {
+			writeOllamaError(w, http.StatusForbidden, "admin routes are disabled; set admin_keys to enable them")
+			return
+		}
+		key := clientKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeOllamaError(w, http.StatusUnauthorized, "an admin key is required")
+			return
+		}
+		if !s.adminKey(key) {
+			writeOllamaError(w, http.StatusForbidden, "not an admin key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminKey reports whether key is one of the admin keys, comparing in
+// constant time
+func (s *Server) adminKey(key string) bool {
+	found := false
+	for _, admin := range s.config.AdminKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(admin)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// withLimit caps the requests in flight at max_concurrent_requests,
+// turning away the excess rather than queueing it
+func (s *Server) withLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limit == nil || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case s.limit <- struct{}{}:
+			defer func() { <-s.limit }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeOllamaError(w, http.StatusServiceUnavailable, "server busy: too many requests in flight")
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// get makes a request to handler and returns the response
+func get(t *testing.T, handler http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// Test that two servers in one process each serve their own configuration
+func TestHandlerPerServer(t *testing.T) {
+	first, second := testConfig(), testConfig()
+	first.OllamaVersion, second.OllamaVersion = "1.0.0", "2.0.0"
+
+	for _, config := range []Config{first, second} {
+		srv := httptest.NewServer(NewServer(config).Handler())
+		resp, err := http.Get(srv.URL + "/api/version")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		if !strings.Contains(string(body), config.OllamaVersion) {
+			t.Errorf("Expected version %s, got %s", config.OllamaVersion, body)
+		}
+	}
+}
+
+// Test that request IDs are generated, or kept when the client sends one
+func TestRequestID(t *testing.T) {
+	handler := NewServer(testConfig()).Handler()
+
+	if id := get(t, handler, http.MethodGet, "/livez", nil).Header().Get(requestIDHeader); len(id) != 16 {
+		t.Errorf("Expected a generated request ID, got %q", id)
+	}
+	sent := http.Header{requestIDHeader: {"trace-123"}}
+	if id := get(t, handler, http.MethodGet, "/livez", sent).Header().Get(requestIDHeader); id != "trace-123" {
+		t.Errorf("Expected the client's request ID, got %q", id)
+	}
+	bad := http.Header{requestIDHeader: {"bad id\n"}}
+	if id := get(t, handler, http.MethodGet, "/livez", bad).Header().Get(requestIDHeader); id == "bad id\n" || id == "" {
+		t.Errorf("Expected an unsafe request ID to be replaced, got %q", id)
+	}
+}
+
+// Test that a panicking handler gives a 500 instead of crashing
+func TestRecovery(t *testing.T) {
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), withRequestID, withLogging, withRecovery)
+
+	recorder := get(t, handler, http.MethodGet, "/api/tags", nil)
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), `"error"`) {
+		t.Errorf("Expected a 500 with an error body, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// Test that a client key is required when configured, except for probes
+func TestAuth(t *testing.T) {
+	config := testConfig()
+	config.RequireClientKey = true
+	config.ClientNames = map[string]string{"team-key": "team"}
+	handler := NewServer(config).Handler()
+
+	if code := get(t, handler, http.MethodGet, "/api/version", nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a key, got %d", code)
+	}
+	unknown := http.Header{"Authorization": {"Bearer other-key"}}
+	if code := get(t, handler, http.MethodGet, "/api/version", unknown).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown key, got %d", code)
+	}
+	known := http.Header{"X-Api-Key": {"team-key"}}
+	if code := get(t, handler, http.MethodGet, "/api/version", known).Code; code != http.StatusOK {
+		t.Errorf("Expected 200 for a known key, got %d", code)
+	}
+	if code := get(t, handler, http.MethodGet, "/livez", nil).Code; code != http.StatusOK {
+		t.Errorf("Expected probes to need no key, got %d", code)
+	}
+
+	// A header key cannot pose as a certificate identity, with or without
+	// require_client_key
+	spoofed := http.Header{"X-Api-Key": {certKeyPrefix + "anyone"}}
+	if code := get(t, handler, http.MethodGet, "/api/version", spoofed).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a cert: key, got %d", code)
+	}
+	config.RequireClientKey = false
+	if code := get(t, NewServer(config).Handler(), http.MethodGet, "/api/version", spoofed).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a cert: key without require_client_key, got %d", code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/version", nil)
+	req.Header.Set("Authorization", "Bearer "+certKeyPrefix+"anyone")
+	if key := clientKey(req); key != "" || knownClient(req, config.ClientNames, certKeyPrefix+"anyone") {
+		t.Errorf("Expected a cert: header key to be ignored, got %q", key)
+	}
+}
+
+// Test that the admin routes need an admin key, which client keys are not
+func TestAdmin(t *testing.T) {
+	config := testConfig()
+	config.RequireClientKey = true
+	config.ClientNames = map[string]string{"team-key": "team"}
+	if code := get(t, NewServer(config).Handler(), http.MethodGet, "/admin/usage", http.Header{"X-Api-Key": {"team-key"}}).Code; code != http.StatusForbidden {
+		t.Errorf("Expected the admin routes to be off without admin keys, got %d", code)
+	}
+
+	config.AdminKeys = []string{"admin-key"}
+	handler := NewServer(config).Handler()
+	testCases := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"no key", nil, http.StatusUnauthorized},
+		{"client key", http.Header{"X-Api-Key": {"team-key"}}, http.StatusForbidden},
+		{"unknown key", http.Header{"Authorization": {"Bearer other-key"}}, http.StatusForbidden},
+		{"admin key", http.Header{"Authorization": {"Bearer admin-key"}}, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		for _, path := range []string{"/admin/usage", "/admin/audit", "/admin/keys", "/admin/breakers"} {
+			if code := get(t, handler, http.MethodGet, path, tc.header).Code; code != tc.status {
+				t.Errorf("%s: expected %d for %s, got %d", tc.name, tc.status, path, code)
+			}
+		}
+	}
+
+	// The admin key is not a client key for the other routes
+	if code := get(t, handler, http.MethodGet, "/api/version", http.Header{"Authorization": {"Bearer admin-key"}}).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected the admin key to be refused elsewhere, got %d", code)
+	}
+}
+
+// Test that requests beyond the concurrency cap are turned away
+func TestLimit(t *testing.T) {
+	config := testConfig()
+	config.MaxConcurrentRequests = 1
+	s := NewServer(config)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := s.withLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/generate" {
+			close(started)
+			<-release
+		}
+	}))
+	done := make(chan struct{})
+	go func() {
+		get(t, handler, http.MethodPost, "/api/generate", nil)
+		close(done)
+	}()
+	<-started
+
+	recorder := get(t, handler, http.MethodPost, "/api/tags", nil)
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After over the cap, got %d", recorder.Code)
+	}
+	if code := get(t, handler, http.MethodGet, "/livez", nil).Code; code != http.StatusOK {
+		t.Errorf("Expected probes to bypass the cap, got %d", code)
+	}
+	close(release)
+	<-done
+}
+
+// Test that requests are counted by route and survive a reload
+func TestRequestMetrics(t *testing.T) {
+	config := testConfig()
+	reloader := NewReloader("", NewServer(config))
+	handler := reloader.Handler()
+
+	get(t, handler, http.MethodGet, "/api/version", nil)
+	get(t, handler, http.MethodGet, "/no/such/route", nil)
+	config.OllamaVersion = "9.9.9"
+	reloader.current.Store(reloader.Server().reconfigure(config))
+
+	body := get(t, handler, http.MethodGet, "/metrics", nil).Body.String()
+	for _, want := range []string{
+		`ollama_proxy_http_requests_total{route="GET /api/version",method="GET",status="200"} 1`,
+		`ollama_proxy_http_requests_total{route="/",method="GET",status="404"} 1`,
+		`ollama_proxy_http_request_duration_seconds_count{route="GET /api/version"} 1`,
+		`ollama_proxy_http_requests_in_flight 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s in metrics, got:\n%s", want, body)
+		}
+	}
+}
+
+// Test that the wrapped writer still flushes, so streams are not buffered
+func TestStatusWriterFlush(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	var w http.ResponseWriter = wrapWriter(recorder)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatalf("Expected the wrapped writer to be a flusher")
+	}
+	w.Write([]byte("chunk"))
+	flusher.Flush()
+	if !recorder.Flushed {
+		t.Errorf("Expected the flush to reach the underlying writer")
+	}
+}
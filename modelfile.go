@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Modelfile is a parsed Ollama Modelfile
+type Modelfile struct {
+	From       string
+	System     string
+	Template   string
+	Parameters OllamaOptions
+	Messages   []Message
+}
+
+// ParseModelfile parses the subset of the Ollama Modelfile format that makes
+// sense for Claude: FROM, SYSTEM, TEMPLATE, PARAMETER and MESSAGE. ADAPTER
+// and LICENSE are accepted and ignored.
+func ParseModelfile(text string) (*Modelfile, error) {
+	mf := &Modelfile{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		instruction, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+
+		// Triple-quoted values may span several lines
+		if strings.HasPrefix(rest, `"""`) {
+			value, consumed, err := readTripleQuoted(rest, scanner)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			lineNo += consumed
+			rest = value
+		} else {
+			rest = unquote(rest)
+		}
+
+		switch strings.ToUpper(instruction) {
+		case "FROM":
+			mf.From = rest
+		case "SYSTEM":
+			mf.System = rest
+		case "TEMPLATE":
+			mf.Template = rest
+		case "PARAMETER":
+			if err := mf.setParameter(rest); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+		case "MESSAGE":
+			role, content, _ := strings.Cut(rest, " ")
+			switch MessageRole(strings.ToLower(role)) {
+			case RoleUser:
+				mf.Messages = append(mf.Messages, NewUserTextMessage(unquote(strings.TrimSpace(content))))
+			case RoleAssistant:
+				mf.Messages = append(mf.Messages, NewAssistantTextMessage(unquote(strings.TrimSpace(content))))
+			case "system":
+				mf.System = unquote(strings.TrimSpace(content))
+			default:
+				return nil, fmt.Errorf("line %d: unknown message role %q", lineNo, role)
+			}
+		case "ADAPTER", "LICENSE":
+			// Not applicable to Claude
+		default:
+			return nil, fmt.Errorf("line %d: unknown instruction %q", lineNo, instruction)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if mf.From == "" {
+		return nil, fmt.Errorf("no FROM line")
+	}
+	return mf, nil
+}
+
+// setParameter applies a "name value" PARAMETER line
+func (mf *Modelfile) setParameter(param string) error {
+	name, value, _ := strings.Cut(param, " ")
+	value = unquote(strings.TrimSpace(value))
+
+	var err error
+	switch name {
+	case "temperature":
+		mf.Parameters.Temperature, err = strconv.ParseFloat(value, 64)
+	case "top_p":
+		mf.Parameters.TopP, err = strconv.ParseFloat(value, 64)
+	case "top_k":
+		mf.Parameters.TopK, err = strconv.Atoi(value)
+	case "num_predict":
+		mf.Parameters.NumPredict, err = strconv.Atoi(value)
+	case "stop":
+		mf.Parameters.Stop = append(mf.Parameters.Stop, value)
+	default:
+		return fmt.Errorf("unsupported parameter %q", name)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %q", name, value)
+	}
+	return nil
+}
+
+// readTripleQuoted reads a """-delimited value that starts on the current
+// line and may continue on following lines. It returns the value and the
+// number of extra lines consumed.
+func readTripleQuoted(first string, scanner *bufio.Scanner) (string, int, error) {
+	body := strings.TrimPrefix(first, `"""`)
+	if end := strings.Index(body, `"""`); end >= 0 {
+		return body[:end], 0, nil
+	}
+
+	lines := []string{body}
+	consumed := 0
+	for scanner.Scan() {
+		consumed++
+		line := scanner.Text()
+		if end := strings.Index(line, `"""`); end >= 0 {
+			lines = append(lines, line[:end])
+			return strings.Join(lines, "\n"), consumed, nil
+		}
+		lines = append(lines, line)
+	}
+	return "", consumed, fmt.Errorf(`unterminated """ string`)
+}
+
+// unquote strips a single pair of double quotes
+func unquote(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		if s, err := strconv.Unquote(value); err == nil {
+			return s
+		}
+		return value[1 : len(value)-1]
+	}
+	return value
+}
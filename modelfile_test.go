@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+// Test parsing a Modelfile with every supported instruction
+func TestParseModelfile(t *testing.T) {
+	mf, err := ParseModelfile(`# A code reviewer persona
+FROM claude-3.5-sonnet
+SYSTEM """You review Go code.
+Be direct."""
+PARAMETER temperature 0.2
+PARAMETER num_predict 512
+PARAMETER stop "<END>"
+PARAMETER stop "###"
+TEMPLATE {{ .Prompt }}
+MESSAGE user Is this idiomatic?
+MESSAGE assistant "Mostly, yes."
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if mf.From != "claude-3.5-sonnet" {
+		t.Errorf("Expected FROM %q, got %q", "claude-3.5-sonnet", mf.From)
+	}
+	if mf.System != "You review Go code.\nBe direct." {
+		t.Errorf("Unexpected system prompt %q", mf.System)
+	}
+	if mf.Template != "{{ .Prompt }}" {
+		t.Errorf("Unexpected template %q", mf.Template)
+	}
+	if mf.Parameters.Temperature != 0.2 || mf.Parameters.NumPredict != 512 {
+		t.Errorf("Unexpected parameters %+v", mf.Parameters)
+	}
+	if len(mf.Parameters.Stop) != 2 || mf.Parameters.Stop[0] != "<END>" {
+		t.Errorf("Unexpected stop sequences %v", mf.Parameters.Stop)
+	}
+	if len(mf.Messages) != 2 || mf.Messages[1].Content[0].Text != "Mostly, yes." {
+		t.Errorf("Unexpected messages %+v", mf.Messages)
+	}
+
+}
+
+// Test that invalid Modelfiles are rejected
+func TestParseModelfileErrors(t *testing.T) {
+	testCases := []struct {
+		name      string
+		modelfile string
+	}{
+		{"Missing FROM", "SYSTEM hello"},
+		{"Unknown instruction", "FROM claude\nQUANTIZE q4"},
+		{"Bad parameter", "FROM claude\nPARAMETER temperature hot"},
+		{"Unsupported parameter", "FROM claude\nPARAMETER mirostat 1"},
+		{"Unterminated string", "FROM claude\nSYSTEM \"\"\"hello"},
+		{"Bad role", "FROM claude\nMESSAGE tool hi"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParseModelfile(tc.modelfile); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
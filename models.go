@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CustomModel is a named model created from a Modelfile on top of a built-in
+// alias or Claude model ID
+type CustomModel struct {
+	Name       string        `json:"name"`
+	From       string        `json:"from"`
+	System     string        `json:"system,omitempty"`
+	Template   string        `json:"template,omitempty"`
+	Parameters OllamaOptions `json:"parameters"`
+	Messages   []Message     `json:"messages,omitempty"`
+	ModifiedAt time.Time     `json:"modified_at"`
+}
+
+// ModelStore holds custom models and, if path is set, persists them to a
+// JSON file
+type ModelStore struct {
+	mu     sync.RWMutex
+	models map[string]*CustomModel
+	path   string
+}
+
+// NewModelStore creates a model store, loading models from path if it exists
+func NewModelStore(path string) (*ModelStore, error) {
+	store := &ModelStore{
+		models: make(map[string]*CustomModel),
+		path:   path,
+	}
+
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read models file: %w", err)
+	}
+
+	var models []*CustomModel
+	if err := json.Unmarshal(data, &models); err != nil {
+		return nil, fmt.Errorf("failed to parse models file: %w", err)
+	}
+	for _, model := range models {
+		store.models[model.Name] = model
+	}
+
+	log.Printf("Loaded %d custom models from %s", len(models), path)
+	return store, nil
+}
+
+// Get returns a custom model by name
+func (ms *ModelStore) Get(name string) (*CustomModel, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	model, exists := ms.models[normalizeModelName(name)]
+	if !exists {
+		return nil, false
+	}
+	return cloneModel(model), true
+}
+
+// cloneModel copies a model so callers cannot change the stored one
+func cloneModel(model *CustomModel) *CustomModel {
+	clone := *model
+	clone.Parameters.Stop = append([]string(nil), model.Parameters.Stop...)
+	clone.Messages = make([]Message, len(model.Messages))
+	copy(clone.Messages, model.Messages)
+	return &clone
+}
+
+// List returns all custom models sorted by name
+func (ms *ModelStore) List() []*CustomModel {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	models := make([]*CustomModel, 0, len(ms.models))
+	for _, model := range ms.models {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return models
+}
+
+// Put adds or replaces a custom model
+func (ms *ModelStore) Put(model *CustomModel) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	previous, existed := ms.models[model.Name]
+	ms.models[model.Name] = model
+	if err := ms.saveLocked(); err != nil {
+		if existed {
+			ms.models[model.Name] = previous
+		} else {
+			delete(ms.models, model.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes a custom model. It returns false if it did not exist.
+func (ms *ModelStore) Delete(name string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	name = normalizeModelName(name)
+	model, exists := ms.models[name]
+	if !exists {
+		return false, nil
+	}
+
+	delete(ms.models, name)
+	if err := ms.saveLocked(); err != nil {
+		ms.models[name] = model
+		return false, err
+	}
+	return true, nil
+}
+
+// saveLocked writes all models to disk. Callers must hold ms.mu.
+func (ms *ModelStore) saveLocked() error {
+	if ms.path == "" {
+		return nil
+	}
+
+	models := make([]*CustomModel, 0, len(ms.models))
+	for _, model := range ms.models {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+
+	data, err := json.MarshalIndent(models, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal models: %w", err)
+	}
+
+	tmp := ms.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write models file: %w", err)
+	}
+	if err := os.Rename(tmp, ms.path); err != nil {
+		return fmt.Errorf("failed to write models file: %w", err)
+	}
+	return nil
+}
+
+// normalizeModelName lowercases a model name and strips the ":latest" tag
+// Ollama clients add to untagged names
+func normalizeModelName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ":latest")
+}
+
+// newCustomModel builds a custom model from a Modelfile, inheriting the
+// settings of FROM if it is itself a custom model
+func (s *Server) newCustomModel(name string, mf *Modelfile) (*CustomModel, error) {
+	model := &CustomModel{
+		Name:       normalizeModelName(name),
+		From:       mf.From,
+		ModifiedAt: time.Now(),
+	}
+
+	if base, ok := s.models.Get(mf.From); ok {
+		model.From = base.From
+		model.System = base.System
+		model.Template = base.Template
+		model.Parameters = base.Parameters
+		model.Messages = base.Messages
+	} else if _, ok := s.modelMap[normalizeModelName(mf.From)]; !ok && !strings.HasPrefix(mf.From, "claude-") {
+		return nil, fmt.Errorf("model %q not found", mf.From)
+	}
+
+	if _, builtin := s.modelMap[model.Name]; builtin {
+		return nil, fmt.Errorf("cannot overwrite built-in model %q", model.Name)
+	}
+
+	if mf.System != "" {
+		model.System = mf.System
+	}
+	if mf.Template != "" {
+		model.Template = mf.Template
+	}
+	if len(mf.Messages) > 0 {
+		model.Messages = mf.Messages
+	}
+	model.Parameters = mergeOptions(model.Parameters, mf.Parameters)
+
+	return model, nil
+}
+
+// mergeOptions returns base with every option set in override applied
+func mergeOptions(base, override OllamaOptions) OllamaOptions {
+	if override.Temperature != 0 {
+		base.Temperature = override.Temperature
+	}
+	if override.TopP != 0 {
+		base.TopP = override.TopP
+	}
+	if override.TopK != 0 {
+		base.TopK = override.TopK
+	}
+	if override.NumPredict != 0 {
+		base.NumPredict = override.NumPredict
+	}
+	if len(override.Stop) > 0 {
+		base.Stop = override.Stop
+	}
+	return base
+}
+
+// applyCustomModel fills in a request's unset fields from a custom model
+func applyCustomModel(req *OllamaRequest, model *CustomModel) {
+	if req.System == "" {
+		req.System = model.System
+	}
+	if req.Template == "" {
+		req.Template = model.Template
+	}
+	req.Options = mergeOptions(model.Parameters, req.Options)
+}
+
+// createModelRequest is the body of /api/create. Either modelfile or the
+// structured fields may be used.
+type createModelRequest struct {
+	Model      string        `json:"model"`
+	Name       string        `json:"name"`
+	Modelfile  string        `json:"modelfile"`
+	From       string        `json:"from"`
+	System     string        `json:"system"`
+	Template   string        `json:"template"`
+	Parameters OllamaOptions `json:"parameters"`
+	Messages   []struct {
+		Role    MessageRole `json:"role"`
+		Content string      `json:"content"`
+	} `json:"messages"`
+}
+
+// modelFile builds a Modelfile from the request
+func (req *createModelRequest) modelFile() (*Modelfile, error) {
+	if req.Modelfile != "" {
+		return ParseModelfile(req.Modelfile)
+	}
+
+	if req.From == "" {
+		return nil, fmt.Errorf("modelfile or from is required")
+	}
+
+	mf := &Modelfile{
+		From:       req.From,
+		System:     req.System,
+		Template:   req.Template,
+		Parameters: req.Parameters,
+	}
+	for _, msg := range req.Messages {
+		switch msg.Role {
+		case RoleUser:
+			mf.Messages = append(mf.Messages, NewUserTextMessage(msg.Content))
+		case RoleAssistant:
+			mf.Messages = append(mf.Messages, NewAssistantTextMessage(msg.Content))
+		default:
+			return nil, fmt.Errorf("unknown message role %q", msg.Role)
+		}
+	}
+	return mf, nil
+}
+
+// Handle POST /api/create
+func (s *Server) handleCreateModel(w http.ResponseWriter, r *http.Request) {
+	var req createModelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := req.Model
+	if name == "" {
+		name = req.Name
+	}
+	if name == "" {
+		writeOllamaError(w, http.StatusBadRequest, "model is required")
+		return
+	}
+
+	mf, err := req.modelFile()
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	model, err := s.newCustomModel(name, mf)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.models.Put(model); err != nil {
+		log.Printf("Error saving model %s: %v", model.Name, err)
+		writeOllamaError(w, http.StatusInternalServerError, "failed to save model")
+		return
+	}
+
+	log.Printf("Created model '%s' from '%s'", model.Name, model.From)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+// Handle POST /api/copy
+func (s *Server) handleCopyModel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Source == "" || req.Destination == "" {
+		writeOllamaError(w, http.StatusBadRequest, "source and destination are required")
+		return
+	}
+
+	// Copying a custom model inherits its settings; copying a built-in alias
+	// creates a plain alias for it
+	if _, custom := s.models.Get(req.Source); !custom {
+		if _, builtin := s.modelMap[normalizeModelName(req.Source)]; !builtin {
+			writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", req.Source))
+			return
+		}
+	}
+
+	model, err := s.newCustomModel(req.Destination, &Modelfile{From: normalizeModelName(req.Source)})
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.models.Put(model); err != nil {
+		log.Printf("Error saving model %s: %v", model.Name, err)
+		writeOllamaError(w, http.StatusInternalServerError, "failed to save model")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Handle DELETE /api/delete
+func (s *Server) handleDeleteModel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model string `json:"model"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := req.Model
+	if name == "" {
+		name = req.Name
+	}
+
+	if _, builtin := s.modelMap[normalizeModelName(name)]; builtin {
+		writeOllamaError(w, http.StatusBadRequest, fmt.Sprintf("cannot delete built-in model '%s'", name))
+		return
+	}
+
+	deleted, err := s.models.Delete(name)
+	if err != nil {
+		log.Printf("Error deleting model %s: %v", name, err)
+		writeOllamaError(w, http.StatusInternalServerError, "failed to delete model")
+		return
+	}
+	if !deleted {
+		writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", name))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ollamaModelInfo is one entry in the /api/tags response
+type ollamaModelInfo struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt time.Time          `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    ollamaModelDetails `json:"details"`
+}
+
+type ollamaModelDetails struct {
+	Format            string `json:"format"`
+	Family            string `json:"family"`
+	ParameterSize     string `json:"parameter_size"`
+	QuantizationLevel string `json:"quantization_level"`
+}
+
+// Handle GET /api/tags
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request) {
+	models := make([]ollamaModelInfo, 0, len(s.modelMap))
+
+	names := make([]string, 0, len(s.modelMap))
+	for name := range s.modelMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		models = append(models, newOllamaModelInfo(name, string(s.modelMap[name]), time.Time{}))
+	}
+	for _, model := range s.models.List() {
+		models = append(models, newOllamaModelInfo(model.Name, string(s.mapModelName(model.Name)), model.ModifiedAt))
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Models []ollamaModelInfo `json:"models"`
+	}{models})
+}
+
+func newOllamaModelInfo(name, target string, modified time.Time) ollamaModelInfo {
+	digest := sha256.Sum256([]byte(name + "\x00" + target))
+	return ollamaModelInfo{
+		Name:       name,
+		Model:      name,
+		ModifiedAt: modified,
+		Digest:     hex.EncodeToString(digest[:]),
+		Details: ollamaModelDetails{
+			Format: "api",
+			Family: "claude",
+		},
+	}
+}
+
+// writeOllamaError writes an error in Ollama's {"error": "..."} format
+func writeOllamaError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
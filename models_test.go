@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 )
 
@@ -61,3 +66,90 @@ func TestMapModelNameComprehensive(t *testing.T) {
 		})
 	}
 }
+
+// Test creating, copying, listing and deleting custom models
+func TestCustomModelLifecycle(t *testing.T) {
+	config := testConfig()
+	config.ModelsFile = filepath.Join(t.TempDir(), "models.json")
+	var lastReq ClaudeRequest
+	newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		lastReq = req
+		return "reply"
+	})
+	server := NewServer(config)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tags", server.handleTags)
+	mux.HandleFunc("POST /api/create", server.handleCreateModel)
+	mux.HandleFunc("POST /api/copy", server.handleCopyModel)
+	mux.HandleFunc("DELETE /api/delete", server.handleDeleteModel)
+	mux.HandleFunc("/api/generate", server.handleOllamaGenerate)
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(method, path, bytes.NewReader(data)))
+		return recorder
+	}
+
+	resp := do(http.MethodPost, "/api/create", map[string]string{
+		"model":     "reviewer",
+		"modelfile": "FROM claude-3-haiku\nSYSTEM You review code.\nPARAMETER temperature 0.2\nMESSAGE user Hi\nMESSAGE assistant Hello",
+	})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	if resp := do(http.MethodPost, "/api/copy", map[string]string{"source": "reviewer", "destination": "reviewer-copy"}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for copy, got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	do(http.MethodPost, "/api/generate", OllamaRequest{Model: "reviewer-copy:latest", Prompt: "Review this"})
+	if lastReq.Model != testModelHaiku || lastReq.System != "You review code." {
+		t.Errorf("Expected model defaults to apply, got model %q and system %q", lastReq.Model, lastReq.System)
+	}
+	if lastReq.Temperature == nil || *lastReq.Temperature != 0.2 {
+		t.Errorf("Expected temperature 0.2, got %v", lastReq.Temperature)
+	}
+	if len(lastReq.Messages) != 3 {
+		t.Errorf("Expected seed messages before the prompt, got %d messages", len(lastReq.Messages))
+	}
+
+	// Get returns a copy that cannot change the stored model
+	model, _ := server.models.Get("reviewer")
+	model.System = "changed"
+	model.Messages[0] = NewUserTextMessage("changed")
+	if stored, _ := server.models.Get("reviewer"); stored.System != "You review code." || stored.Messages[0].Content[0].Text != "Hi" {
+		t.Errorf("Expected the stored model to be unchanged, got %+v", stored)
+	}
+
+	// Models persist across restarts and are listed in /api/tags
+	recorder := httptest.NewRecorder()
+	NewServer(config).handleTags(recorder, httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+	var tags struct {
+		Models []ollamaModelInfo `json:"models"`
+	}
+	json.NewDecoder(recorder.Body).Decode(&tags)
+	found := 0
+	for _, model := range tags.Models {
+		if model.Name == "reviewer" || model.Name == "reviewer-copy" {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("Expected both custom models in /api/tags, found %d", found)
+	}
+
+	if resp := do(http.MethodDelete, "/api/delete", map[string]string{"model": "reviewer"}); resp.Code != http.StatusOK {
+		t.Errorf("Expected status %d for delete, got %d", http.StatusOK, resp.Code)
+	}
+	if resp := do(http.MethodDelete, "/api/delete", map[string]string{"model": "reviewer"}); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for second delete, got %d", http.StatusNotFound, resp.Code)
+	}
+	if resp := do(http.MethodDelete, "/api/delete", map[string]string{"model": "claude"}); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for built-in delete, got %d", http.StatusBadRequest, resp.Code)
+	}
+	if resp := do(http.MethodPost, "/api/create", map[string]string{"model": "x", "from": "llama3"}); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unknown base, got %d", http.StatusBadRequest, resp.Code)
+	}
+}
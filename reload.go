@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// secretConfigFields are config fields whose values are never logged
+var secretConfigFields = map[string]bool{
+	"api_key":      true,
+	"api_keys":     true,
+	"admin_keys":   true,
+	"client_names": true,
+	"backends":     true,
+}
+
+// redactedConfigFields are config fields logged only once redacted
+var redactedConfigFields = map[string]func(string) string{
+	"upstream_proxy": redactURL,
+}
+
+// Reloader holds the live Server and replaces it when the configuration
+// changes. Each request runs against the Server that was live when it
+// arrived, so in-flight requests finish on the old configuration.
+type Reloader struct {
+	path    string
+	current atomic.Pointer[Server]
+
+	// mu serializes reloads
+	mu   sync.Mutex
+	hash [sha256.Size]byte
+}
+
+// lifecycle is the state of the process, shared by each Server that
+// replaces the last
+type lifecycle struct {
+	configFile string
+
+	// draining is set once shutdown begins
+	draining atomic.Bool
+
+	// shadows holds a slot for each shadow request in flight, and
+	// shadowCtx is their base context, cancelled at shutdown
+	shadows     chan struct{}
+	shadowCtx   context.Context
+	stopShadows context.CancelFunc
+
+	mu        sync.Mutex
+	reloadErr string
+}
+
+func newLifecycle() *lifecycle {
+	lc := &lifecycle{shadows: make(chan struct{}, maxShadowRequests)}
+	lc.shadowCtx, lc.stopShadows = context.WithCancel(context.Background())
+	return lc
+}
+
+// setReloadError records the error from the last reload, if any
+func (lc *lifecycle) setReloadError(err error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.reloadErr = ""
+	if err != nil {
+		lc.reloadErr = err.Error()
+	}
+}
+
+// reloadError returns the error from the last reload, if any
+func (lc *lifecycle) reloadError() string {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.reloadErr
+}
+
+// NewReloader creates a reloader for the config file at path, serving
+// server until the first reload
+func NewReloader(path string, server *Server) *Reloader {
+	rl := &Reloader{path: path}
+	server.state.configFile = path
+	rl.current.Store(server)
+	if data, err := os.ReadFile(path); err == nil {
+		rl.hash = sha256.Sum256(data)
+	}
+	return rl
+}
+
+// Server returns the live Server
+func (rl *Reloader) Server() *Server {
+	return rl.current.Load()
+}
+
+// Reload loads and validates the configuration and, if it is valid, swaps
+// in a Server built from it. An invalid configuration leaves the live one
+// in place.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	old := rl.Server()
+	config, err := LoadConfig(rl.path)
+	old.state.setReloadError(err)
+	if err != nil {
+		return fmt.Errorf("keeping the current configuration: %w", err)
+	}
+
+	changes := diffConfig(old.config, config)
+	if len(changes) == 0 {
+		log.Printf("Configuration reloaded with no changes")
+		return nil
+	}
+	for _, change := range changes {
+		log.Printf("Configuration change: %s", change)
+	}
+	if !reflect.DeepEqual(listenerSettings(config), listenerSettings(old.config)) {
+		log.Printf("Warning: New listen addresses and TLS files take effect after a restart")
+	}
+
+	server := old.reconfigure(config)
+	rl.current.Store(server)
+	old.inflight.retire(func() { old.closeStores(server) })
+	log.Printf("Configuration reloaded with %d changes", len(changes))
+	return nil
+}
+
+// inflight counts the requests, and background work such as shadow
+// requests, still using a Server, so that a replaced Server's stores are
+// closed only once nothing writes to them
+type inflight struct {
+	mu     sync.Mutex
+	active int
+	closed bool
+	onIdle func()
+}
+
+// acquire records a new user of the Server. It fails once the Server has
+// been retired and its last user has finished.
+func (in *inflight) acquire() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		return false
+	}
+	in.active++
+	return true
+}
+
+// release ends a use, running the retirement function if it was the last
+func (in *inflight) release() {
+	in.mu.Lock()
+	in.active--
+	fn := in.idleLocked()
+	in.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// retire runs fn once the Server's current users have finished
+func (in *inflight) retire(fn func()) {
+	in.mu.Lock()
+	in.onIdle = fn
+	fn = in.idleLocked()
+	in.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// idleLocked returns the retirement function if it is due. Callers must
+// hold in.mu.
+func (in *inflight) idleLocked() func() {
+	if in.onIdle == nil || in.active > 0 {
+		return nil
+	}
+	fn := in.onIdle
+	in.onIdle, in.closed = nil, true
+	return fn
+}
+
+// closeStores closes the stores of s that next does not carry over, or all
+// of them if next is nil. A nil next also cancels shadow requests.
+func (s *Server) closeStores(next *Server) {
+	if next == nil {
+		s.state.stopShadows()
+	}
+	if next == nil || next.usage != s.usage {
+		if err := s.usage.Close(); err != nil {
+			log.Printf("Error saving usage: %v", err)
+		}
+	}
+	if next == nil || next.audit != s.audit {
+		if err := s.audit.Close(); err != nil {
+			log.Printf("Error closing audit file: %v", err)
+		}
+	}
+}
+
+// Watch reloads the configuration on SIGHUP and, if interval is positive,
+// whenever the content of the config file changes. Polling the content
+// rather than watching for events also catches Kubernetes ConfigMap
+// updates, which swap a symlink. Watch returns when ctx is done.
+func (rl *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 && rl.path != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading configuration")
+			rl.reloadAndLog()
+		case <-tick:
+			if rl.fileChanged() {
+				log.Printf("Config file %s changed, reloading configuration", rl.path)
+				rl.reloadAndLog()
+			}
+		}
+	}
+}
+
+func (rl *Reloader) reloadAndLog() {
+	if err := rl.Reload(); err != nil {
+		log.Printf("Error reloading configuration: %v", err)
+	}
+}
+
+// fileChanged reports whether the config file's content differs from when
+// it was last seen. A file that fails to load is only reported once.
+func (rl *Reloader) fileChanged() bool {
+	data, err := os.ReadFile(rl.path)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(data)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if hash == rl.hash {
+		return false
+	}
+	rl.hash = hash
+	return true
+}
+
+// Handler returns a handler that serves each request with the handler of
+// the Server live when it arrives. The Server's stores stay open until the
+// request finishes, even if a reload replaces it meanwhile.
+func (rl *Reloader) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for {
+			s := rl.Server()
+			if s.inflight.acquire() {
+				defer s.inflight.release()
+				s.Handler().ServeHTTP(w, r)
+				return
+			}
+		}
+	})
+}
+
+// diffConfig describes the fields that differ between two configurations.
+// Values are shown for simple settings; secrets and nested settings are
+// only named.
+func diffConfig(current, next Config) []string {
+	oldFields, newFields := configFields(current), configFields(next)
+
+	names := make([]string, 0, len(newFields))
+	for name := range newFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+		before, after := oldFields[name], newFields[name]
+		if bytes.Equal(before, after) {
+			continue
+		}
+		if secretConfigFields[name] || !isScalarJSON(before) || !isScalarJSON(after) {
+			changes = append(changes, name+" changed")
+			continue
+		}
+		if redact := redactedConfigFields[name]; redact != nil {
+			before, after = redactJSON(before, redact), redactJSON(after, redact)
+			if bytes.Equal(before, after) {
+				changes = append(changes, name+" changed")
+				continue
+			}
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, before, after))
+	}
+	return changes
+}
+
+// configFields returns each field of a configuration as JSON, by name
+func configFields(config Config) map[string]json.RawMessage {
+	data, _ := json.Marshal(config)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// redactJSON applies redact to a JSON string value
+func redactJSON(value json.RawMessage, redact func(string) string) json.RawMessage {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return value
+	}
+	data, _ := json.Marshal(redact(s))
+	return data
+}
+
+func isScalarJSON(value json.RawMessage) bool {
+	value = bytes.TrimSpace(value)
+	return len(value) > 0 && value[0] != '{' && value[0] != '['
+}
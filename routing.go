@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// RouteRule picks the Claude model and/or backend for requests matching
+// all of its conditions. Rules are evaluated in order and the first match
+// wins; requests matching no rule use the model mapping and
+// model_backends.
+type RouteRule struct {
+	Name  string     `json:"name"`
+	Match RouteMatch `json:"match"`
+
+	// Model is an alias or Claude model ID; Backend names a Claude backend.
+	// At least one is set.
+	Model   string `json:"model,omitempty"`
+	Backend string `json:"backend,omitempty"`
+}
+
+// RouteMatch holds the conditions of a rule. Empty conditions match
+// everything.
+type RouteMatch struct {
+	// Aliases and Clients are glob patterns, e.g. "claude-3*". Clients are
+	// matched against both the client key and its client name, which for a
+	// client certificate is its mapped identity.
+	Aliases []string `json:"aliases,omitempty"`
+	Clients []string `json:"clients,omitempty"`
+
+	// Estimated prompt size in tokens, including system prompt and history
+	MinPromptTokens int `json:"min_prompt_tokens,omitempty"`
+	MaxPromptTokens int `json:"max_prompt_tokens,omitempty"`
+
+	// Options maps an Ollama option (temperature, top_p, top_k,
+	// num_predict) to the range it must fall in
+	Options map[string]OptionRange `json:"options,omitempty"`
+	Stream  *bool                  `json:"stream,omitempty"`
+	FIM     *bool                  `json:"fim,omitempty"`
+
+	// Hours is a local time range such as "09:00-17:00", which may wrap
+	// past midnight. Days lists weekdays as "mon", "tue" and so on.
+	// TimeZone is an IANA name and defaults to the server's zone.
+	Hours    string   `json:"hours,omitempty"`
+	Days     []string `json:"days,omitempty"`
+	TimeZone string   `json:"time_zone,omitempty"`
+
+	// Headers maps header names to glob patterns their value must match
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// OptionRange bounds a numeric option. An option the request leaves unset
+// counts as 0.
+type OptionRange struct {
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// routeInput is what rules are evaluated against
+type routeInput struct {
+	Alias        string
+	Client       string
+	PromptTokens int
+	Options      OllamaOptions
+	Stream       bool
+	FIM          bool
+	Header       http.Header
+	Time         time.Time
+}
+
+// RouteDecision is the outcome of routing a request
+type RouteDecision struct {
+	Rule    string      `json:"rule,omitempty"`
+	Model   ModelID     `json:"model"`
+	Backend string      `json:"backend"`
+	Trace   []RuleTrace `json:"trace,omitempty"`
+}
+
+// RuleTrace explains why a rule did or did not match
+type RuleTrace struct {
+	Rule    string `json:"rule"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// route evaluates the routing rules for a request. With explain set, the
+// decision records why each rule was skipped.
+func (s *Server) route(in routeInput, explain bool) RouteDecision {
+	var decision RouteDecision
+	name := clientName(s.config.ClientNames, in.Client)
+
+	for _, rule := range s.config.Routes {
+		reason := rule.Match.mismatch(in, name)
+		if explain {
+			decision.Trace = append(decision.Trace, RuleTrace{Rule: rule.Name, Matched: reason == "", Reason: reason})
+		}
+		if reason != "" {
+			continue
+		}
+
+		decision.Rule = rule.Name
+		decision.Model = s.mapModelName(in.Alias)
+		if rule.Model != "" {
+			decision.Model = s.resolveModel(rule.Model)
+		}
+		decision.Backend = rule.Backend
+		if decision.Backend == "" {
+			decision.Backend = s.backendFor(in.Alias).Name()
+		}
+		return decision
+	}
+
+	decision.Model = s.mapModelName(in.Alias)
+	decision.Backend = s.backendFor(in.Alias).Name()
+	return decision
+}
+
+// resolveModel returns the Claude model ID for an alias, or the name itself
+// if it is not an alias
+func (s *Server) resolveModel(name string) ModelID {
+	if model, ok := s.modelMap[normalizeModelName(name)]; ok {
+		return model
+	}
+	return ModelID(name)
+}
+
+// mismatch returns why the conditions do not match the input from the
+// named client, or "" if they do
+func (m RouteMatch) mismatch(in routeInput, name string) string {
+	if len(m.Aliases) > 0 && !matchAny(m.Aliases, normalizeModelName(in.Alias)) {
+		return fmt.Sprintf("alias %q is not one of %v", in.Alias, m.Aliases)
+	}
+	if len(m.Clients) > 0 && !matchAny(m.Clients, in.Client) && !matchAny(m.Clients, name) {
+		return "client does not match"
+	}
+
+	if m.MinPromptTokens > 0 && in.PromptTokens < m.MinPromptTokens {
+		return fmt.Sprintf("prompt is %d tokens, under %d", in.PromptTokens, m.MinPromptTokens)
+	}
+	if m.MaxPromptTokens > 0 && in.PromptTokens > m.MaxPromptTokens {
+		return fmt.Sprintf("prompt is %d tokens, over %d", in.PromptTokens, m.MaxPromptTokens)
+	}
+
+	for name, bounds := range m.Options {
+		value, _ := optionValue(in.Options, name)
+		if bounds.Min != nil && value < *bounds.Min {
+			return fmt.Sprintf("option %s is %g, under %g", name, value, *bounds.Min)
+		}
+		if bounds.Max != nil && value > *bounds.Max {
+			return fmt.Sprintf("option %s is %g, over %g", name, value, *bounds.Max)
+		}
+	}
+	if m.Stream != nil && *m.Stream != in.Stream {
+		return fmt.Sprintf("stream is %v", in.Stream)
+	}
+	if m.FIM != nil && *m.FIM != in.FIM {
+		return fmt.Sprintf("fim is %v", in.FIM)
+	}
+
+	if m.Hours != "" || len(m.Days) > 0 {
+		now := in.Time
+		if m.TimeZone != "" {
+			if loc, err := time.LoadLocation(m.TimeZone); err == nil {
+				now = now.In(loc)
+			}
+		}
+		if len(m.Days) > 0 && !matchDay(m.Days, now.Weekday()) {
+			return fmt.Sprintf("%s is not one of %v", strings.ToLower(now.Weekday().String()[:3]), m.Days)
+		}
+		if m.Hours != "" {
+			start, end, _ := parseHours(m.Hours)
+			minute := now.Hour()*60 + now.Minute()
+			inRange := minute >= start && minute < end
+			if start > end {
+				inRange = minute >= start || minute < end
+			}
+			if !inRange {
+				return fmt.Sprintf("%s is outside %s", now.Format("15:04"), m.Hours)
+			}
+		}
+	}
+
+	for name, pattern := range m.Headers {
+		values := in.Header.Values(name)
+		if len(values) == 0 {
+			return fmt.Sprintf("header %s is missing", name)
+		}
+		if !matchAny([]string{pattern}, values[0]) {
+			return fmt.Sprintf("header %s does not match %q", name, pattern)
+		}
+	}
+
+	return ""
+}
+
+// optionValue returns a numeric Ollama option by name
+func optionValue(options OllamaOptions, name string) (float64, bool) {
+	switch name {
+	case "temperature":
+		return options.Temperature, true
+	case "top_p":
+		return options.TopP, true
+	case "top_k":
+		return float64(options.TopK), true
+	case "num_predict":
+		return float64(options.NumPredict), true
+	}
+	return 0, false
+}
+
+// matchAny reports whether value matches any of the glob patterns
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDay(days []string, day time.Weekday) bool {
+	for _, name := range days {
+		if weekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHours parses "HH:MM-HH:MM" into minutes since midnight
+func parseHours(hours string) (start, end int, err error) {
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("hours %q must look like 09:00-17:00", hours)
+	}
+	startTime, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, fmt.Errorf("hours %q must look like 09:00-17:00", hours)
+	}
+	endTime, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, fmt.Errorf("hours %q must look like 09:00-17:00", hours)
+	}
+	return startTime.Hour()*60 + startTime.Minute(), endTime.Hour()*60 + endTime.Minute(), nil
+}
+
+// validateRoutes checks that every rule is well formed and refers to a
+// Claude backend
+func validateRoutes(config Config) error {
+	names := make(map[string]bool)
+	for i, rule := range config.Routes {
+		if rule.Name == "" {
+			return fmt.Errorf("routes[%d] needs a name", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate route name %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.Model == "" && rule.Backend == "" {
+			return fmt.Errorf("route %q must set a model or a backend", rule.Name)
+		}
+		if rule.Backend != "" && rule.Backend != BackendAnthropic {
+			if bc, ok := config.Backends[rule.Backend]; !ok || bc.Type == BackendOllama {
+				return fmt.Errorf("route %q uses unknown backend %q", rule.Name, rule.Backend)
+			}
+		}
+
+		m := rule.Match
+		patterns := append(append([]string{}, m.Aliases...), m.Clients...)
+		for _, pattern := range m.Headers {
+			patterns = append(patterns, pattern)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("route %q has a bad pattern %q", rule.Name, pattern)
+			}
+		}
+		if m.MaxPromptTokens > 0 && m.MinPromptTokens > m.MaxPromptTokens {
+			return fmt.Errorf("route %q has min_prompt_tokens over max_prompt_tokens", rule.Name)
+		}
+		for name := range m.Options {
+			if _, ok := optionValue(OllamaOptions{}, name); !ok {
+				return fmt.Errorf("route %q matches unknown option %q", rule.Name, name)
+			}
+		}
+		if m.Hours != "" {
+			if _, _, err := parseHours(m.Hours); err != nil {
+				return fmt.Errorf("route %q: %w", rule.Name, err)
+			}
+		}
+		for _, day := range m.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("route %q has unknown day %q", rule.Name, day)
+			}
+		}
+		if m.TimeZone != "" {
+			if _, err := time.LoadLocation(m.TimeZone); err != nil {
+				return fmt.Errorf("route %q has unknown time zone %q", rule.Name, m.TimeZone)
+			}
+		}
+	}
+	return nil
+}
+
+// routeExplainRequest is an /api/generate request plus the context a dry
+// run needs to stand in for the real request
+type routeExplainRequest struct {
+	OllamaRequest
+	Client  string            `json:"client,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Time    *time.Time        `json:"time,omitempty"`
+}
+
+// Handle POST /admin/route/explain: a dry run that reports which rule a
+// request would match, and why the others did not
+func (s *Server) handleRouteExplain(w http.ResponseWriter, r *http.Request) {
+	var req routeExplainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+
+	if custom, ok := s.models.Get(req.Model); ok {
+		applyCustomModel(&req.OllamaRequest, custom)
+	}
+
+	in := routeInput{
+		Alias:   req.Model,
+		Client:  req.Client,
+		Options: req.Options,
+		Stream:  req.Stream,
+		FIM:     req.Suffix != "",
+		Header:  make(http.Header),
+		Time:    time.Now(),
+	}
+	if in.Client == "" {
+		in.Client = clientKey(r)
+	}
+	for name, value := range req.Headers {
+		in.Header.Set(name, value)
+	}
+	if req.Time != nil {
+		in.Time = *req.Time
+	}
+
+	// A rejected system prompt still gets a dry run, sized without it
+	system, err := s.systemPrompt(in, req.Metadata, req.System)
+	if err != nil && !errors.Is(err, errSystemPromptRejected) {
+		writeOllamaError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	in.PromptTokens = estimateTokens(system) + estimateTokens(req.Prompt) + estimateTokens(req.Suffix)
+	if history, ok := s.contexts.Get(req.Context); ok && len(req.Context) > 0 {
+		for _, msg := range history {
+			in.PromptTokens += estimateMessageTokens(msg)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, s.route(in, true))
+}
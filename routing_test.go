@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func float64Ptr(v float64) *float64 { return &v }
+func boolPtr(v bool) *bool          { return &v }
+
+// Test that rules are evaluated in order over each kind of condition
+func TestRoute(t *testing.T) {
+	config := testConfig()
+	config.Backends = map[string]BackendConfig{"eu": {Type: BackendAnthropic}}
+	config.ClientNames = map[string]string{"sk-secret-key": "eu-ops"}
+	config.Routes = []RouteRule{
+		{Name: "completions", Match: RouteMatch{FIM: boolPtr(true)}, Model: "claude-3-haiku"},
+		{Name: "team-eu", Match: RouteMatch{Clients: []string{"eu-*"}}, Backend: "eu"},
+		{Name: "canary", Match: RouteMatch{Headers: map[string]string{"X-Canary": "yes"}}, Model: "claude-3-7-sonnet-20240610"},
+		{Name: "long-context", Match: RouteMatch{Aliases: []string{"claude*"}, MinPromptTokens: 50000}, Model: "claude-3.5-sonnet"},
+		{Name: "short", Match: RouteMatch{Aliases: []string{"claude"}, MaxPromptTokens: 500}, Model: "claude-3-haiku"},
+		{Name: "creative", Match: RouteMatch{Options: map[string]OptionRange{"temperature": {Min: float64Ptr(0.9)}}}, Model: "claude-3-opus"},
+		{Name: "night", Match: RouteMatch{Hours: "22:00-06:00", TimeZone: "UTC"}, Model: "claude-3-haiku"},
+	}
+	if err := validateConfig(config); err != nil {
+		t.Fatalf("Unexpected config error: %v", err)
+	}
+	server := NewServer(config)
+
+	noon := time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name    string
+		in      routeInput
+		rule    string
+		model   ModelID
+		backend string
+	}{
+		{"fim", routeInput{Alias: "claude", FIM: true, PromptTokens: 10}, "completions", "claude-3-haiku-20240307", BackendAnthropic},
+		{"client", routeInput{Alias: "claude", Client: "eu-team", PromptTokens: 1000}, "team-eu", "claude-3-opus-20240229", "eu"},
+		{"client name", routeInput{Alias: "claude", Client: "sk-secret-key", PromptTokens: 1000}, "team-eu", "claude-3-opus-20240229", "eu"},
+		{"certificate", routeInput{Alias: "claude", Client: certKeyPrefix + "eu-ci", PromptTokens: 1000}, "team-eu", "claude-3-opus-20240229", "eu"},
+		{"header", routeInput{Alias: "claude", Header: http.Header{"X-Canary": {"yes"}}, PromptTokens: 1000}, "canary", "claude-3-7-sonnet-20240610", BackendAnthropic},
+		{"long", routeInput{Alias: "claude-3-haiku", PromptTokens: 60000}, "long-context", "claude-3-5-sonnet-20240620", BackendAnthropic},
+		{"short", routeInput{Alias: "claude:latest", PromptTokens: 100}, "short", "claude-3-haiku-20240307", BackendAnthropic},
+		{"option", routeInput{Alias: "claude", PromptTokens: 1000, Options: OllamaOptions{Temperature: 1}}, "creative", "claude-3-opus-20240229", BackendAnthropic},
+		{"night", routeInput{Alias: "claude", PromptTokens: 1000, Time: time.Date(2024, 6, 3, 23, 30, 0, 0, time.UTC)}, "night", "claude-3-haiku-20240307", BackendAnthropic},
+		{"no match", routeInput{Alias: "claude", PromptTokens: 1000, Time: noon}, "", "claude-3-opus-20240229", BackendAnthropic},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.in.Header == nil {
+				tc.in.Header = http.Header{}
+			}
+			if tc.in.Time.IsZero() {
+				tc.in.Time = noon
+			}
+			decision := server.route(tc.in, false)
+			if decision.Rule != tc.rule || decision.Model != tc.model || decision.Backend != tc.backend {
+				t.Errorf("Expected rule %q, model %s, backend %s, got %+v", tc.rule, tc.model, tc.backend, decision)
+			}
+		})
+	}
+}
+
+// Test validation of routing rules
+func TestValidateRoutes(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rule  RouteRule
+		valid bool
+	}{
+		{"valid", RouteRule{Name: "r", Model: "claude-3-haiku", Match: RouteMatch{Hours: "09:00-17:00", Days: []string{"Mon"}}}, true},
+		{"no name", RouteRule{Model: "claude-3-haiku"}, false},
+		{"no target", RouteRule{Name: "r"}, false},
+		{"unknown backend", RouteRule{Name: "r", Backend: "nowhere"}, false},
+		{"bad hours", RouteRule{Name: "r", Model: "claude", Match: RouteMatch{Hours: "9am-5pm"}}, false},
+		{"bad day", RouteRule{Name: "r", Model: "claude", Match: RouteMatch{Days: []string{"someday"}}}, false},
+		{"bad option", RouteRule{Name: "r", Model: "claude", Match: RouteMatch{Options: map[string]OptionRange{"seed": {}}}}, false},
+		{"bad pattern", RouteRule{Name: "r", Model: "claude", Match: RouteMatch{Aliases: []string{"claude["}}}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.Routes = []RouteRule{tc.rule}
+			err := validateRoutes(config)
+			if tc.valid && err != nil {
+				t.Errorf("Expected valid rule, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+// Test that generate requests use the routed model and the dry run
+// explains the decision
+func TestRouteGenerateAndExplain(t *testing.T) {
+	config := testConfig()
+	config.Routes = []RouteRule{
+		{Name: "long-context", Match: RouteMatch{MinPromptTokens: 1000}, Model: "claude-3.5-sonnet"},
+		{Name: "short", Match: RouteMatch{MaxPromptTokens: 1000}, Model: "claude-3-haiku"},
+	}
+	var model ModelID
+	claude := newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		model = req.Model
+		return "routed"
+	})
+	defer claude.Close()
+	server := NewServer(config)
+
+	body := `{"model": "claude", "prompt": "hi"}`
+	recorder := httptest.NewRecorder()
+	server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	if model != "claude-3-haiku-20240307" {
+		t.Errorf("Expected the short prompt to go to Haiku, got %s", model)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handleRouteExplain(recorder, httptest.NewRequest(http.MethodPost, "/admin/route/explain", strings.NewReader(body)))
+	var decision RouteDecision
+	if err := json.NewDecoder(recorder.Body).Decode(&decision); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if decision.Rule != "short" || len(decision.Trace) != 2 {
+		t.Fatalf("Expected the short rule with a trace of 2 rules, got %+v", decision)
+	}
+	if decision.Trace[0].Matched || !strings.Contains(decision.Trace[0].Reason, "under 1000") {
+		t.Errorf("Expected the first rule to be skipped for prompt size, got %+v", decision.Trace[0])
+	}
+}
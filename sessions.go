@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is a server-side conversation that clients can reference by ID
+// instead of re-sending the whole history. Only the client that created it
+// can use it.
+type Session struct {
+	ID        string    `json:"id"`
+	Client    string    `json:"client"`
+	Model     string    `json:"model,omitempty"`
+	System    string    `json:"system,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+	Messages  []Message `json:"messages"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SessionStore keeps sessions in memory and, if dir is set, persists each
+// one as a JSON file so that they survive restarts
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	dir      string
+
+	// turns serializes generate requests on each session, so that one
+	// turn's compaction never overlaps another's
+	turnsMu sync.Mutex
+	turns   map[string]*sync.Mutex
+}
+
+// NewSessionStore creates a session store, loading any sessions already
+// persisted in dir
+func NewSessionStore(dir string) (*SessionStore, error) {
+	store := &SessionStore{
+		sessions: make(map[string]*Session),
+		dir:      dir,
+		turns:    make(map[string]*sync.Mutex),
+	}
+
+	if dir == "" {
+		return store, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session %s: %w", path, err)
+		}
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			return nil, fmt.Errorf("failed to parse session %s: %w", path, err)
+		}
+		// Sessions saved before they had owners belong to clients without a key
+		if session.Client == "" {
+			session.Client = clientName(nil, "")
+		}
+		store.sessions[session.ID] = &session
+	}
+
+	log.Printf("Loaded %d sessions from %s", len(store.sessions), dir)
+	return store, nil
+}
+
+// Create adds a new empty session owned by client
+func (ss *SessionStore) Create(client, model, system string) (*Session, error) {
+	now := time.Now()
+	session := &Session{
+		ID:        newSessionID(),
+		Client:    client,
+		Model:     model,
+		System:    system,
+		Messages:  []Message{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if err := ss.saveLocked(session); err != nil {
+		return nil, err
+	}
+	ss.sessions[session.ID] = session
+	return cloneSession(session), nil
+}
+
+// Get returns a copy of a session
+func (ss *SessionStore) Get(id string) (*Session, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	session, exists := ss.sessions[id]
+	if !exists {
+		return nil, false
+	}
+	return cloneSession(session), true
+}
+
+// List returns copies of the sessions owned by client, most recently
+// updated first
+func (ss *SessionStore) List(client string) []*Session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	sessions := make([]*Session, 0)
+	for _, session := range ss.sessions {
+		if session.Client == client {
+			sessions = append(sessions, cloneSession(session))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt)
+	})
+	return sessions
+}
+
+// Update applies fn to a session and persists the result
+func (ss *SessionStore) Update(id string, fn func(*Session)) (*Session, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	session, exists := ss.sessions[id]
+	if !exists {
+		return nil, fmt.Errorf("session %q not found", id)
+	}
+
+	updated := cloneSession(session)
+	fn(updated)
+	updated.UpdatedAt = time.Now()
+
+	if err := ss.saveLocked(updated); err != nil {
+		return nil, err
+	}
+	ss.sessions[id] = updated
+	return cloneSession(updated), nil
+}
+
+// Delete removes a session. It returns false if the session did not exist.
+func (ss *SessionStore) Delete(id string) (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if _, exists := ss.sessions[id]; !exists {
+		return false, nil
+	}
+
+	if ss.dir != "" {
+		if err := os.Remove(ss.sessionPath(id)); err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to delete session: %w", err)
+		}
+	}
+	delete(ss.sessions, id)
+
+	ss.turnsMu.Lock()
+	delete(ss.turns, id)
+	ss.turnsMu.Unlock()
+	return true, nil
+}
+
+// LockTurn waits until no other generate request is running on a session
+// and returns the function that ends this one's turn
+func (ss *SessionStore) LockTurn(id string) func() {
+	ss.turnsMu.Lock()
+	turn, ok := ss.turns[id]
+	if !ok {
+		turn = &sync.Mutex{}
+		ss.turns[id] = turn
+	}
+	ss.turnsMu.Unlock()
+
+	turn.Lock()
+	return turn.Unlock
+}
+
+// saveLocked writes a session to disk. Callers must hold ss.mu.
+func (ss *SessionStore) saveLocked(session *Session) error {
+	if ss.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn session
+	path := ss.sessionPath(session.ID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	return nil
+}
+
+func (ss *SessionStore) sessionPath(id string) string {
+	return filepath.Join(ss.dir, id+".json")
+}
+
+func cloneSession(session *Session) *Session {
+	clone := *session
+	clone.Messages = make([]Message, len(session.Messages))
+	copy(clone.Messages, session.Messages)
+	return &clone
+}
+
+// newSessionID returns a random hex identifier
+func newSessionID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// sessionSystemPrompt adds the summary of truncated turns to a session's
+// system prompt
+func sessionSystemPrompt(session *Session, system string) string {
+	if session.Summary != "" {
+		system = strings.TrimSpace(system + "\n\nSummary of the earlier conversation:\n" + session.Summary)
+	}
+	return system
+}
+
+// compactSession makes a session's history fit the model's context window.
+// Turns that no longer fit are dropped, and if a summary model is configured
+// they are folded into the session summary first.
+func (s *Server) compactSession(ctx context.Context, session *Session, system string, model ModelID, maxTokens int) {
+	budget := contextWindow(model) - maxTokens
+	kept := fitMessages(session.Messages, 1, estimateTokens(sessionSystemPrompt(session, system)), budget)
+	dropped := session.Messages[:len(session.Messages)-len(kept)]
+	if len(dropped) == 0 {
+		return
+	}
+
+	log.Printf("Session %s exceeds context window of %s, dropping %d messages", session.ID, model, len(dropped))
+
+	if s.config.SessionSummaryModel != "" {
+		summary, err := s.summarizeMessages(ctx, s.config.SessionSummaryModel, session.Summary, dropped)
+		if err != nil {
+			log.Printf("Failed to summarise session %s, truncating instead: %v", session.ID, err)
+		} else {
+			session.Summary = summary
+		}
+	}
+	session.Messages = kept
+}
+
+// summarizeMessages asks model to fold messages into an existing summary
+func (s *Server) summarizeMessages(ctx context.Context, model, previous string, messages []Message) (string, error) {
+	var transcript strings.Builder
+	if previous != "" {
+		transcript.WriteString("Existing summary:\n" + previous + "\n\n")
+	}
+	transcript.WriteString("Conversation:\n")
+	for _, msg := range messages {
+		for _, content := range msg.Content {
+			fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, content.Text)
+		}
+	}
+
+	resp, err := s.callClaudeAPI(ctx, ClaudeRequest{
+		Model:     ModelID(model),
+		System:    "Summarise the conversation below in a few short paragraphs, keeping names, facts and decisions the assistant will need later. Reply with the summary only.",
+		Messages:  []Message{NewUserTextMessage(transcript.String())},
+		MaxTokens: 1024,
+	})
+	if err != nil {
+		return "", err
+	}
+	return getFirstContentText(resp), nil
+}
+
+// sessionRequest is the body accepted when creating a session
+type sessionRequest struct {
+	Model  string `json:"model"`
+	System string `json:"system"`
+}
+
+// sessionMessageRequest is the body accepted when appending to a session
+type sessionMessageRequest struct {
+	Role    MessageRole `json:"role"`
+	Content string      `json:"content"`
+}
+
+// sessionOwner returns the client name that owns the sessions a request
+// creates and can use
+func (s *Server) sessionOwner(r *http.Request) string {
+	return clientName(s.config.ClientNames, clientKey(r))
+}
+
+// ownSession returns a session if the request's client owns it. Another
+// client's session is reported as missing, so that IDs cannot be probed.
+func (s *Server) ownSession(r *http.Request, id string) (*Session, bool) {
+	session, ok := s.sessions.Get(id)
+	if !ok || session.Client != s.sessionOwner(r) {
+		return nil, false
+	}
+	return session, true
+}
+
+// Handle POST /api/sessions
+func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	var req sessionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	session, err := s.sessions.Create(s.sessionOwner(r), req.Model, req.System)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// Handle GET /api/sessions
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Sessions []*Session `json:"sessions"`
+	}{s.sessions.List(s.sessionOwner(r))})
+}
+
+// Handle GET /api/sessions/{id}
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.ownSession(r, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// Handle POST /api/sessions/{id}/messages
+func (s *Server) handleAppendSessionMessage(w http.ResponseWriter, r *http.Request) {
+	var req sessionMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var msg Message
+	switch req.Role {
+	case RoleUser:
+		msg = NewUserTextMessage(req.Content)
+	case RoleAssistant:
+		msg = NewAssistantTextMessage(req.Content)
+	default:
+		http.Error(w, fmt.Sprintf("Bad request: role must be %q or %q", RoleUser, RoleAssistant), http.StatusBadRequest)
+		return
+	}
+
+	id := r.PathValue("id")
+	if _, ok := s.ownSession(r, id); !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	session, err := s.sessions.Update(id, func(session *Session) {
+		session.Messages = append(session.Messages, msg)
+	})
+	if err != nil {
+		log.Printf("Error updating session %s: %v", id, err)
+		http.Error(w, "Failed to update session", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// Handle DELETE /api/sessions/{id}
+func (s *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, ok := s.ownSession(r, id); !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	deleted, err := s.sessions.Delete(id)
+	if err != nil {
+		log.Printf("Error deleting session: %v", err)
+		http.Error(w, "Failed to delete session", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
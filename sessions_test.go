@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that sessions persist to disk and are reloaded
+func TestSessionStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewSessionStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	session, err := store.Create("team-a", "claude", "Be brief.")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if _, err := store.Update(session.ID, func(s *Session) {
+		s.Messages = append(s.Messages, NewUserTextMessage("hello"))
+	}); err != nil {
+		t.Fatalf("Failed to update session: %v", err)
+	}
+
+	reloaded, err := NewSessionStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to reload store: %v", err)
+	}
+	got, ok := reloaded.Get(session.ID)
+	if !ok {
+		t.Fatal("Expected session to survive reload")
+	}
+	if got.System != "Be brief." || len(got.Messages) != 1 {
+		t.Errorf("Unexpected reloaded session: %+v", got)
+	}
+
+	if deleted, _ := reloaded.Delete(session.ID); !deleted {
+		t.Error("Expected delete to succeed")
+	}
+	if again, _ := NewSessionStore(dir); len(again.List("team-a")) != 0 {
+		t.Error("Expected session file to be removed")
+	}
+}
+
+// Test that the session routes and session_id on /api/generate work together
+func TestSessionAPI(t *testing.T) {
+	config := testConfig()
+	var lastReq ClaudeRequest
+	newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		lastReq = req
+		return "reply"
+	})
+	server := NewServer(config)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/sessions", server.handleCreateSession)
+	mux.HandleFunc("GET /api/sessions/{id}", server.handleGetSession)
+	mux.HandleFunc("POST /api/sessions/{id}/messages", server.handleAppendSessionMessage)
+	mux.HandleFunc("/api/generate", server.handleOllamaGenerate)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+
+	resp := do(http.MethodPost, "/api/sessions", `{"model": "claude-3-haiku", "system": "Be brief."}`)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, resp.Code)
+	}
+	var session Session
+	json.NewDecoder(resp.Body).Decode(&session)
+
+	if resp := do(http.MethodPost, "/api/sessions/"+session.ID+"/messages", `{"role": "user", "content": "My name is Ada."}`); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+	do(http.MethodPost, "/api/sessions/"+session.ID+"/messages", `{"role": "assistant", "content": "Hello Ada."}`)
+
+	body, _ := json.Marshal(OllamaRequest{Prompt: "What is my name?", SessionID: session.ID})
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	if lastReq.Model != testModelHaiku || lastReq.System != "Be brief." {
+		t.Errorf("Expected session model and system, got %q and %q", lastReq.Model, lastReq.System)
+	}
+	if len(lastReq.Messages) != 3 {
+		t.Errorf("Expected 3 messages upstream, got %d", len(lastReq.Messages))
+	}
+
+	resp = do(http.MethodGet, "/api/sessions/"+session.ID, "")
+	json.NewDecoder(resp.Body).Decode(&session)
+	if len(session.Messages) != 4 || session.Messages[3].Content[0].Text != "reply" {
+		t.Errorf("Expected the exchange to be recorded, got %+v", session.Messages)
+	}
+
+	if resp := do(http.MethodGet, "/api/sessions/missing", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown session, got %d", http.StatusNotFound, resp.Code)
+	}
+}
+
+// Test that a client can only see and use its own sessions
+func TestSessionOwnership(t *testing.T) {
+	config := testConfig()
+	config.ClientNames = map[string]string{"key-a": "team-a", "key-b": "team-b"}
+	newFakeClaude(t, &config, func(ClaudeRequest) string { return "reply" })
+	handler := NewServer(config).Handler()
+
+	do := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	var session Session
+	json.NewDecoder(do("key-a", http.MethodPost, "/api/sessions", `{"model": "claude"}`).Body).Decode(&session)
+	if session.Client != "team-a" {
+		t.Fatalf("Expected the session to belong to team-a, got %+v", session)
+	}
+
+	var list struct {
+		Sessions []Session `json:"sessions"`
+	}
+	json.NewDecoder(do("key-b", http.MethodGet, "/api/sessions", "").Body).Decode(&list)
+	if len(list.Sessions) != 0 {
+		t.Errorf("Expected team-b to see no sessions, got %+v", list.Sessions)
+	}
+	for _, attempt := range []struct{ method, path, body string }{
+		{http.MethodGet, "/api/sessions/" + session.ID, ""},
+		{http.MethodPost, "/api/sessions/" + session.ID + "/messages", `{"role": "user", "content": "hi"}`},
+		{http.MethodDelete, "/api/sessions/" + session.ID, ""},
+		{http.MethodPost, "/api/generate", `{"prompt": "hi", "session_id": "` + session.ID + `"}`},
+	} {
+		if code := do("key-b", attempt.method, attempt.path, attempt.body).Code; code != http.StatusNotFound {
+			t.Errorf("Expected 404 for team-b on %s %s, got %d", attempt.method, attempt.path, code)
+		}
+	}
+
+	json.NewDecoder(do("key-a", http.MethodGet, "/api/sessions", "").Body).Decode(&list)
+	if len(list.Sessions) != 1 || len(list.Sessions[0].Messages) != 0 {
+		t.Errorf("Expected team-a's session to be listed and unchanged, got %+v", list.Sessions)
+	}
+	if code := do("key-a", http.MethodDelete, "/api/sessions/"+session.ID, "").Code; code != http.StatusNoContent {
+		t.Errorf("Expected team-a to delete its session, got %d", code)
+	}
+}
+
+// Test that messages appended to a session during a generate call, and
+// concurrent generate calls, are not lost
+func TestSessionConcurrentTurns(t *testing.T) {
+	config := testConfig()
+	started, release := make(chan string, 2), make(chan struct{})
+	newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		prompt := req.Messages[len(req.Messages)-1].Content[0].Text
+		started <- prompt
+		<-release
+		return "reply to " + prompt
+	})
+	server := NewServer(config)
+	handler := server.Handler()
+	session, _ := server.sessions.Create("anonymous", "claude", "")
+
+	generate := func(prompt string, done chan<- struct{}) {
+		body, _ := json.Marshal(OllamaRequest{Prompt: prompt, SessionID: session.ID})
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(body)))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+		close(done)
+	}
+	first, second := make(chan struct{}), make(chan struct{})
+	go generate("first", first)
+	<-started
+
+	// Append a note while the first call is in flight, and queue a second turn
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/sessions/"+session.ID+"/messages", strings.NewReader(`{"role": "user", "content": "note"}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the append to succeed, got %d", recorder.Code)
+	}
+	go generate("second", second)
+
+	release <- struct{}{}
+	<-first
+	if prompt := <-started; prompt != "second" {
+		t.Errorf("Expected the second turn to start after the first, got %q", prompt)
+	}
+	release <- struct{}{}
+	<-second
+
+	got, _ := server.sessions.Get(session.ID)
+	var texts []string
+	for _, msg := range got.Messages {
+		texts = append(texts, msg.Content[0].Text)
+	}
+	want := "note|first|reply to first|second|reply to second"
+	if strings.Join(texts, "|") != want {
+		t.Errorf("Expected %s, got %s", want, strings.Join(texts, "|"))
+	}
+}
+
+// Test that long histories are truncated to fit the context window
+func TestCompactSession(t *testing.T) {
+	server := NewServer(testConfig())
+
+	long := strings.Repeat("x", 500000)
+	session := &Session{Messages: []Message{
+		NewUserTextMessage(long),
+		NewAssistantTextMessage(long),
+		NewUserTextMessage("latest"),
+	}}
+
+	server.compactSession(context.Background(), session, server.config.SystemPrompt, testModelSonnet35, 1024)
+	if len(session.Messages) != 1 || session.Messages[0].Content[0].Text != "latest" {
+		t.Errorf("Expected only the latest message to remain, got %d messages", len(session.Messages))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownGrace is how long handlers get to write their error once their
+// upstream calls are cancelled
+const shutdownGrace = 2 * time.Second
+
+// serve runs srv on listeners until one fails or SIGTERM or SIGINT
+// arrives, then drains it. cancel must cancel the base context of srv's
+// requests. A graceful shutdown returns nil.
+func (rl *Reloader) serve(srv *http.Server, listeners []net.Listener, cancel context.CancelFunc) error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	defer func() { rl.Server().closeStores(nil) }()
+
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func() { errs <- srv.Serve(ln) }()
+	}
+
+	select {
+	case err := <-errs:
+		cancel()
+		srv.Close()
+		return err
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	}
+	rl.drain(srv, cancel, signals)
+	return nil
+}
+
+// drain shuts srv down. Readiness fails first, so that load balancers stop
+// sending requests during the shutdown delay; then the listener closes and
+// in-flight requests, streams included, get the drain period to finish.
+// Requests still running after that have their upstream calls cancelled.
+// Another signal skips straight to cancelling.
+func (rl *Reloader) drain(srv *http.Server, cancel context.CancelFunc, signals <-chan os.Signal) {
+	defer cancel()
+	s := rl.Server()
+	config := s.config
+	s.state.draining.Store(true)
+
+	if delay := time.Duration(config.ShutdownDelaySecs) * time.Second; delay > 0 {
+		log.Printf("Failing readiness for %v before closing the listener", delay)
+		select {
+		case <-time.After(delay):
+		case <-signals:
+			log.Printf("Received another signal, skipping the shutdown delay")
+		}
+	}
+
+	ctx, stop := context.WithTimeout(context.Background(), time.Duration(config.DrainSecs)*time.Second)
+	defer stop()
+	go func() {
+		select {
+		case <-signals:
+			log.Printf("Received another signal, cancelling in-flight requests")
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+
+	log.Printf("Waiting up to %ds for in-flight requests to finish", config.DrainSecs)
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		log.Printf("All requests finished")
+		return
+	}
+
+	log.Printf("Drain period over, cancelling in-flight requests")
+	cancel()
+	grace, stopGrace := context.WithTimeout(context.Background(), shutdownGrace)
+	defer stopGrace()
+	if err := srv.Shutdown(grace); errors.Is(err, context.DeadlineExceeded) {
+		srv.Close()
+	}
+}
+
+// handleHealthDraining fails while the server is draining, so that it drops
+// out of load balancing
+func (s *Server) handleHealthDraining(w http.ResponseWriter, r *http.Request) {
+	if s.state.draining.Load() {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.handleHealth(w, r)
+}
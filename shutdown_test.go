@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// startDrainServer serves handler on a local port with a cancellable base
+// context, as Start does
+func startDrainServer(t *testing.T, handler http.HandlerFunc) (*http.Server, string, context.CancelFunc) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	base, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return srv, "http://" + ln.Addr().String(), cancel
+}
+
+// Test that in-flight requests finish during the drain and readiness fails
+func TestDrainFinishesRequests(t *testing.T) {
+	config := testConfig()
+	config.DrainSecs = 5
+	reloader := NewReloader("", NewServer(config))
+
+	started, release := make(chan struct{}), make(chan struct{})
+	srv, url, cancel := startDrainServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	result := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		result <- string(body)
+	}()
+	<-started
+
+	drained := make(chan struct{})
+	go func() {
+		reloader.drain(srv, cancel, make(chan os.Signal))
+		close(drained)
+	}()
+
+	for !reloader.Server().state.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	recorder := httptest.NewRecorder()
+	reloader.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readiness to fail while draining, got %d", recorder.Code)
+	}
+
+	close(release)
+	if body := <-result; body != "done" {
+		t.Errorf("Expected the in-flight request to finish, got %q", body)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the drain to end once the request finished")
+	}
+}
+
+// Test that requests still running after the drain period are cancelled
+func TestDrainCancelsRequests(t *testing.T) {
+	config := testConfig()
+	config.DrainSecs = 1
+	reloader := NewReloader("", NewServer(config))
+
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	srv, url, cancel := startDrainServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(cancelled)
+	})
+	go http.Get(url)
+	<-started
+
+	start := time.Now()
+	reloader.drain(srv, cancel, make(chan os.Signal))
+	select {
+	case <-cancelled:
+	default:
+		t.Errorf("Expected the request context to be cancelled")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > time.Second+shutdownGrace+time.Second {
+		t.Errorf("Expected the drain to last about a second, took %v", elapsed)
+	}
+}
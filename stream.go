@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// claudeStreamEvent is one event of a streaming Messages API response. The
+// same events are delivered over SSE by Anthropic and Vertex AI and inside
+// AWS event-stream frames by Bedrock.
+type claudeStreamEvent struct {
+	Type    string `json:"type"`
+	Message *struct {
+		ID    string      `json:"id"`
+		Role  string      `json:"role"`
+		Usage ClaudeUsage `json:"usage"`
+	} `json:"message,omitempty"`
+	Delta *struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta,omitempty"`
+	Usage *ClaudeUsage `json:"usage,omitempty"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// streamAccumulator assembles a ClaudeResponse from stream events
+type streamAccumulator struct {
+	resp   ClaudeResponse
+	text   strings.Builder
+	onText func(string) error
+	done   bool
+}
+
+func newStreamAccumulator(onText func(string) error) *streamAccumulator {
+	return &streamAccumulator{
+		resp:   ClaudeResponse{Type: "message", Role: "assistant"},
+		onText: onText,
+	}
+}
+
+// Add handles the JSON payload of one stream event
+func (sa *streamAccumulator) Add(data []byte) error {
+	var event claudeStreamEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return fmt.Errorf("failed to decode stream event: %w", err)
+	}
+
+	switch event.Type {
+	case "message_start":
+		if event.Message != nil {
+			sa.resp.ID = event.Message.ID
+			sa.resp.Usage = event.Message.Usage
+		}
+	case "content_block_delta":
+		if event.Delta != nil && event.Delta.Type == "text_delta" {
+			sa.text.WriteString(event.Delta.Text)
+			if err := sa.onText(event.Delta.Text); err != nil {
+				return err
+			}
+		}
+	case "message_delta":
+		if event.Delta != nil && event.Delta.StopReason != "" {
+			sa.resp.StopReason = event.Delta.StopReason
+		}
+		if event.Usage != nil {
+			sa.resp.Usage.OutputTokens = event.Usage.OutputTokens
+		}
+	case "message_stop":
+		sa.done = true
+	case "error":
+		if event.Error != nil {
+			return fmt.Errorf("stream error: %s: %s", event.Error.Type, event.Error.Message)
+		}
+		return fmt.Errorf("stream error")
+	}
+	return nil
+}
+
+// Response returns the assembled response once the stream has finished
+func (sa *streamAccumulator) Response() (*ClaudeResponse, error) {
+	if !sa.done {
+		return nil, fmt.Errorf("stream ended before message_stop")
+	}
+	sa.resp.Content = []ClaudeContent{{Type: "text", Text: sa.text.String()}}
+	return &sa.resp, nil
+}
+
+// Usage returns the usage reported so far. Output tokens are estimated from
+// the text received when a failed stream never reported them.
+func (sa *streamAccumulator) Usage() ClaudeUsage {
+	usage := sa.resp.Usage
+	usage.OutputTokens = max(usage.OutputTokens, estimateTokens(sa.text.String()))
+	return usage
+}
+
+// Fail returns err for a stream that failed, carrying the usage reported
+// before the failure if there was any
+func (sa *streamAccumulator) Fail(err error) error {
+	usage := sa.Usage()
+	if usage == (ClaudeUsage{}) {
+		return err
+	}
+	return &partialStreamError{err: err, usage: usage}
+}
+
+// partialStreamError is the error of a stream that failed after the
+// upstream started billing for it, so that its usage is still accounted
+type partialStreamError struct {
+	err   error
+	usage ClaudeUsage
+}
+
+func (e *partialStreamError) Error() string { return e.err.Error() }
+
+func (e *partialStreamError) Unwrap() error { return e.err }
+
+// readSSE feeds the data of each server-sent event in r to fn
+func readSSE(r io.Reader, fn func([]byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				if err := fn([]byte(data.String())); err != nil {
+					return err
+				}
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if data.Len() > 0 {
+		return fn([]byte(data.String()))
+	}
+	return nil
+}
+
+// ollamaStream writes a response as Ollama's newline-delimited JSON frames
+type ollamaStream struct {
+	w       http.ResponseWriter
+	model   string
+	encoder *json.Encoder
+	started bool
+}
+
+func newOllamaStream(w http.ResponseWriter, model string) *ollamaStream {
+	return &ollamaStream{w: w, model: model, encoder: json.NewEncoder(w)}
+}
+
+// Write sends one piece of text as an unfinished frame
+func (st *ollamaStream) Write(text string) error {
+	if text == "" {
+		return nil
+	}
+	return st.send(OllamaResponse{Model: st.model, CreatedAt: time.Now(), Response: text})
+}
+
+// Done sends the final frame
+func (st *ollamaStream) Done(final OllamaResponse) error {
+	final.Response = ""
+	final.Done = true
+	return st.send(final)
+}
+
+// Error reports an error after the stream has started
+func (st *ollamaStream) Error(err error) {
+	st.send(map[string]string{"error": err.Error()})
+}
+
+func (st *ollamaStream) send(v interface{}) error {
+	if !st.started {
+		st.w.Header().Set("Content-Type", "application/x-ndjson")
+		st.started = true
+	}
+	if err := st.encoder.Encode(v); err != nil {
+		return err
+	}
+	if flusher, ok := st.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Policies for combining the configured system prompt with one the client
+// sends
+const (
+	SystemPolicyReplace = "replace" // the client's prompt replaces ours
+	SystemPolicyPrepend = "prepend" // ours goes before the client's
+	SystemPolicyAppend  = "append"  // ours goes after the client's
+	SystemPolicyReject  = "reject"  // requests with their own prompt fail
+)
+
+// errSystemPromptRejected is returned for a client system prompt under the
+// reject policy
+var errSystemPromptRejected = errors.New("system prompts are not accepted for this model")
+
+// SystemPromptRule sets the system prompt for requests matching an alias
+// and/or client. Rules are checked in order and the first match wins;
+// requests matching none use system_prompt.
+type SystemPromptRule struct {
+	// Aliases and Clients are glob patterns. Clients are matched against
+	// both the client key and its name in client_names.
+	Aliases []string `json:"aliases,omitempty"`
+	Clients []string `json:"clients,omitempty"`
+
+	// Prompt is a Go template rendered with systemPromptData
+	Prompt string `json:"prompt"`
+
+	// Policy overrides system_prompt_policy for matching requests
+	Policy string `json:"policy,omitempty"`
+}
+
+// systemPromptData is what system prompt templates can refer to, e.g.
+// "Today is {{.Date}}" or {{.Header "X-Team"}}
+type systemPromptData struct {
+	Date     string
+	Time     time.Time
+	Client   string
+	Alias    string
+	Stream   bool
+	FIM      bool
+	Metadata map[string]string
+
+	header http.Header
+}
+
+// Header returns the value of a request header
+func (d systemPromptData) Header(name string) string {
+	return d.header.Get(name)
+}
+
+// systemPrompt returns the system prompt for a request: the configured one
+// for its alias and client, rendered and merged with supplied, the prompt
+// the client sent
+func (s *Server) systemPrompt(in routeInput, metadata map[string]string, supplied string) (string, error) {
+	text, policy := s.systemPromptFor(in.Alias, in.Client)
+
+	configured, err := renderSystemPrompt(text, systemPromptData{
+		Date:     in.Time.Format("2006-01-02"),
+		Time:     in.Time,
+		Client:   clientName(s.config.ClientNames, in.Client),
+		Alias:    in.Alias,
+		Stream:   in.Stream,
+		FIM:      in.FIM,
+		Metadata: metadata,
+		header:   in.Header,
+	})
+	if err != nil {
+		return "", err
+	}
+	return mergeSystemPrompt(configured, supplied, policy)
+}
+
+// systemPromptFor returns the prompt template and merge policy configured
+// for an alias and client key
+func (s *Server) systemPromptFor(alias, client string) (string, string) {
+	alias = normalizeModelName(alias)
+	name := clientName(s.config.ClientNames, client)
+	for _, rule := range s.config.SystemPrompts {
+		if len(rule.Aliases) > 0 && !matchAny(rule.Aliases, alias) {
+			continue
+		}
+		if len(rule.Clients) > 0 && !matchAny(rule.Clients, client) && !matchAny(rule.Clients, name) {
+			continue
+		}
+		policy := rule.Policy
+		if policy == "" {
+			policy = s.config.SystemPromptPolicy
+		}
+		return rule.Prompt, policy
+	}
+	return s.config.SystemPrompt, s.config.SystemPromptPolicy
+}
+
+// renderSystemPrompt renders a system prompt template
+func renderSystemPrompt(text string, data systemPromptData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("system").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid system prompt template: %w", err)
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render system prompt: %w", err)
+	}
+	return out.String(), nil
+}
+
+// mergeSystemPrompt combines the configured system prompt with the one the
+// client supplied, as the policy says
+func mergeSystemPrompt(configured, supplied, policy string) (string, error) {
+	if supplied == "" {
+		return configured, nil
+	}
+	if configured == "" && policy != SystemPolicyReject {
+		return supplied, nil
+	}
+
+	switch policy {
+	case SystemPolicyPrepend:
+		return configured + "\n\n" + supplied, nil
+	case SystemPolicyAppend:
+		return supplied + "\n\n" + configured, nil
+	case SystemPolicyReject:
+		return "", errSystemPromptRejected
+	default:
+		return supplied, nil
+	}
+}
+
+// validateSystemPrompts checks system prompt templates and policies
+func validateSystemPrompts(config Config) error {
+	validPolicy := func(policy string) bool {
+		switch policy {
+		case SystemPolicyReplace, SystemPolicyPrepend, SystemPolicyAppend, SystemPolicyReject:
+			return true
+		}
+		return false
+	}
+
+	if !validPolicy(config.SystemPromptPolicy) {
+		return fmt.Errorf("unknown system prompt policy %q", config.SystemPromptPolicy)
+	}
+	if _, err := template.New("system").Parse(config.SystemPrompt); err != nil {
+		return fmt.Errorf("invalid system prompt template: %w", err)
+	}
+
+	for i, rule := range config.SystemPrompts {
+		if rule.Policy != "" && !validPolicy(rule.Policy) {
+			return fmt.Errorf("system_prompts[%d] has unknown policy %q", i, rule.Policy)
+		}
+		if _, err := template.New("system").Parse(rule.Prompt); err != nil {
+			return fmt.Errorf("system_prompts[%d] has an invalid template: %w", i, err)
+		}
+		for _, pattern := range append(append([]string{}, rule.Aliases...), rule.Clients...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("system_prompts[%d] has a bad pattern %q", i, pattern)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that rules pick prompts by alias and client, falling back to the
+// default
+func TestSystemPromptFor(t *testing.T) {
+	config := testConfig()
+	config.ClientNames = map[string]string{"sk-ci": "ci"}
+	config.SystemPrompts = []SystemPromptRule{
+		{Aliases: []string{"claude-3-haiku"}, Clients: []string{"ci"}, Prompt: "haiku for ci", Policy: SystemPolicyReject},
+		{Aliases: []string{"claude-3-haiku"}, Prompt: "haiku"},
+		{Clients: []string{"sk-eu-*"}, Prompt: "eu"},
+	}
+	server := NewServer(config)
+
+	tests := []struct {
+		alias, client  string
+		prompt, policy string
+	}{
+		{"claude-3-haiku", "sk-ci", "haiku for ci", SystemPolicyReject},
+		{"claude-3-haiku:latest", "sk-other", "haiku", SystemPolicyReplace},
+		{"claude", "sk-eu-1", "eu", SystemPolicyReplace},
+		{"claude", "sk-ci", config.SystemPrompt, SystemPolicyReplace},
+	}
+	for _, tt := range tests {
+		prompt, policy := server.systemPromptFor(tt.alias, tt.client)
+		if prompt != tt.prompt || policy != tt.policy {
+			t.Errorf("%s/%s: expected %q (%s), got %q (%s)", tt.alias, tt.client, tt.prompt, tt.policy, prompt, policy)
+		}
+	}
+}
+
+// Test that templates can use the date, client, alias, metadata and headers
+func TestSystemPromptTemplate(t *testing.T) {
+	config := testConfig()
+	config.ClientNames = map[string]string{"sk-ci": "ci"}
+	config.SystemPrompt = `Today is {{.Date}}. You serve {{.Client}} on {{.Alias}} for {{.Metadata.project}}{{with .Header "X-Team"}} in team {{.}}{{end}}.`
+	server := NewServer(config)
+
+	header := make(http.Header)
+	header.Set("X-Team", "search")
+	in := routeInput{
+		Alias:  "claude",
+		Client: "sk-ci",
+		Header: header,
+		Time:   time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	system, err := server.systemPrompt(in, map[string]string{"project": "atlas"}, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "Today is 2024-06-01. You serve ci on claude for atlas in team search."
+	if system != expected {
+		t.Errorf("Expected %q, got %q", expected, system)
+	}
+}
+
+// Test each merge policy
+func TestMergeSystemPrompt(t *testing.T) {
+	tests := []struct {
+		policy, expected string
+	}{
+		{SystemPolicyReplace, "client"},
+		{SystemPolicyPrepend, "ours\n\nclient"},
+		{SystemPolicyAppend, "client\n\nours"},
+	}
+	for _, tt := range tests {
+		merged, err := mergeSystemPrompt("ours", "client", tt.policy)
+		if err != nil || merged != tt.expected {
+			t.Errorf("%s: expected %q, got %q (%v)", tt.policy, tt.expected, merged, err)
+		}
+	}
+
+	if merged, err := mergeSystemPrompt("ours", "", SystemPolicyReject); err != nil || merged != "ours" {
+		t.Errorf("Expected requests without a system prompt to pass, got %q (%v)", merged, err)
+	}
+	if _, err := mergeSystemPrompt("ours", "client", SystemPolicyReject); err != errSystemPromptRejected {
+		t.Errorf("Expected the client prompt to be rejected, got %v", err)
+	}
+}
+
+// Test that the generate handler sends the merged prompt and rejects
+// prompts under the reject policy
+func TestGenerateSystemPromptPolicy(t *testing.T) {
+	config := testConfig()
+	config.SystemPromptPolicy = SystemPolicyPrepend
+	config.SystemPrompts = []SystemPromptRule{{Aliases: []string{"claude-3-haiku"}, Prompt: "Locked.", Policy: SystemPolicyReject}}
+
+	var system string
+	newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		system = req.System
+		return "ok"
+	})
+	server := NewServer(config)
+
+	generate := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		server.handleOllamaGenerate(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body)))
+		return recorder
+	}
+
+	if resp := generate(`{"model": "claude", "prompt": "hi", "system": "Be brief.", "stream": false}`); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	if system != config.SystemPrompt+"\n\nBe brief." {
+		t.Errorf("Expected the configured prompt before the client's, got %q", system)
+	}
+
+	resp := generate(`{"model": "claude-3-haiku", "prompt": "hi", "system": "Be brief.", "stream": false}`)
+	if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "not accepted") {
+		t.Errorf("Expected the system prompt to be rejected, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+// Test that bad templates and policies fail validation
+func TestValidateSystemPrompts(t *testing.T) {
+	bad := []func(*Config){
+		func(c *Config) { c.SystemPrompt = "Today is {{.Date" },
+		func(c *Config) { c.SystemPromptPolicy = "merge" },
+		func(c *Config) { c.SystemPrompts = []SystemPromptRule{{Prompt: "x", Policy: "merge"}} },
+		func(c *Config) { c.SystemPrompts = []SystemPromptRule{{Prompt: "{{end}}"}} },
+		func(c *Config) { c.SystemPrompts = []SystemPromptRule{{Aliases: []string{"["}, Prompt: "x"}} },
+	}
+	for i, mutate := range bad {
+		config := testConfig()
+		mutate(&config)
+		if err := validateSystemPrompts(config); err == nil {
+			t.Errorf("Case %d: expected a validation error", i)
+		}
+	}
+	if err := validateSystemPrompts(testConfig()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Where a token count came from
+const (
+	tokenSourceUpstream = "upstream"
+	tokenSourceEstimate = "estimate"
+)
+
+// What to do with a request whose history overflows the context window
+const (
+	ContextOverflowReject   = "reject"
+	ContextOverflowTruncate = "truncate"
+)
+
+// tokenCounter is implemented by backends that can count the input tokens
+// of a request without running it
+type tokenCounter interface {
+	CountTokens(ctx context.Context, req ClaudeRequest) (int, error)
+}
+
+// estimateRequestTokens gives a rough count of the input tokens of a request
+func estimateRequestTokens(req ClaudeRequest) int {
+	tokens := estimateTokens(req.System)
+	for _, msg := range req.Messages {
+		tokens += estimateMessageTokens(msg)
+	}
+	return tokens
+}
+
+// countTokens counts the input tokens of req on the named backend. Unless
+// upstream is set, or the backend cannot count, the local estimate is
+// used; an upstream failure also falls back to it and is returned.
+func (s *Server) countTokens(ctx context.Context, backend string, req ClaudeRequest, upstream bool) (int, string, error) {
+	if upstream {
+		if counter, ok := findBackend[tokenCounter](s.backends[backend]); ok {
+			tokens, err := counter.CountTokens(ctx, req)
+			if err == nil {
+				return tokens, tokenSourceUpstream, nil
+			}
+			log.Printf("Counting tokens upstream failed, using the estimate: %v", err)
+			return estimateRequestTokens(req), tokenSourceEstimate, err
+		}
+	}
+	return estimateRequestTokens(req), tokenSourceEstimate, nil
+}
+
+// fitContextWindow checks that req fits its model's context window with
+// room for max_tokens. When context_overflow is "truncate" an overflowing
+// history is truncated by the configured strategy, which is returned;
+// otherwise, or if the kept messages are still too long, the request is
+// rejected.
+func (s *Server) fitContextWindow(ctx context.Context, backend string, req *ClaudeRequest) (truncation, error) {
+	window := contextWindow(req.Model)
+	tokens, source, _ := s.countTokens(ctx, backend, *req, s.config.CountTokensUpstream)
+	if tokens+req.MaxTokens <= window {
+		return truncation{}, nil
+	}
+
+	if s.config.ContextOverflow == ContextOverflowTruncate && len(req.Messages) > 1 {
+		// Truncation works on estimates, scaled to the measured count so
+		// that it aims at the real size
+		scale := 1.0
+		if tokens > 0 {
+			scale = float64(estimateRequestTokens(*req)) / float64(tokens)
+		}
+		reserved := estimateTokens(req.System) + int(float64(req.MaxTokens)*scale)
+		total := len(req.Messages)
+		applied := s.truncateHistory(ctx, req, reserved, int(float64(window)*scale))
+		if applied.Dropped > 0 {
+			log.Printf("Truncated %d of %d messages with %s to fit the %d token context window of %s",
+				applied.Dropped, total, applied.Strategy, window, req.Model)
+			tokens, source, _ = s.countTokens(ctx, backend, *req, s.config.CountTokensUpstream)
+			if tokens+req.MaxTokens <= window {
+				return applied, nil
+			}
+		}
+	}
+
+	size := fmt.Sprintf("about %d", tokens)
+	if source == tokenSourceUpstream {
+		size = fmt.Sprintf("%d", tokens)
+	}
+	if req.MaxTokens > 0 {
+		return truncation{}, badRequest("prompt is %s tokens, which with num_predict %d exceeds the %d token context window of %s",
+			size, req.MaxTokens, window, req.Model)
+	}
+	return truncation{}, badRequest("prompt is %s tokens, which exceeds the %d token context window of %s", size, window, req.Model)
+}
+
+// countTokensRequest accepts Ollama generate and chat requests, OpenAI chat
+// completions and Anthropic messages. Content and system prompts may be
+// strings or lists of content blocks.
+type countTokensRequest struct {
+	Model    string            `json:"model"`
+	Prompt   string            `json:"prompt"`
+	Suffix   string            `json:"suffix"`
+	System   json.RawMessage   `json:"system"`
+	Context  []int             `json:"context"`
+	Metadata map[string]string `json:"metadata"`
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+// countTokensResponse is the body of a token count
+type countTokensResponse struct {
+	Model         string  `json:"model"`
+	ClaudeModel   ModelID `json:"claude_model"`
+	Backend       string  `json:"backend"`
+	InputTokens   int     `json:"input_tokens"`
+	Source        string  `json:"source"`
+	ContextWindow int     `json:"context_window"`
+	UpstreamError string  `json:"upstream_error,omitempty"`
+}
+
+// Handle POST /api/count_tokens: count the input tokens of a request as it
+// would be sent to Claude, using the backend's count_tokens API and falling
+// back to a local estimate
+func (s *Server) handleCountTokens(w http.ResponseWriter, r *http.Request) {
+	var req countTokensRequest
+	if _, err := s.decodeRequest(r, &req); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if req.Model == "" {
+		writeOllamaError(w, http.StatusBadRequest, "model is required")
+		return
+	}
+	if !s.knownModel(req.Model) {
+		writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model %q not found", req.Model))
+		return
+	}
+
+	system, err := contentText(req.System)
+	if err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid system: "+err.Error())
+		return
+	}
+	var messages []Message
+	for i, msg := range req.Messages {
+		text, err := contentText(msg.Content)
+		if err != nil {
+			writeOllamaError(w, http.StatusBadRequest, fmt.Sprintf("invalid messages[%d].content: %v", i, err))
+			return
+		}
+		switch MessageRole(msg.Role) {
+		case RoleUser:
+			messages = append(messages, NewUserTextMessage(text))
+		case RoleAssistant:
+			messages = append(messages, NewAssistantTextMessage(text))
+		case "system", "developer":
+			system = strings.TrimSpace(system + "\n\n" + text)
+		default:
+			writeOllamaError(w, http.StatusBadRequest, fmt.Sprintf("messages[%d] has unsupported role %q", i, msg.Role))
+			return
+		}
+	}
+
+	in := routeInput{
+		Alias:  req.Model,
+		Client: clientKey(r),
+		FIM:    req.Suffix != "",
+		Header: r.Header,
+		Time:   time.Now(),
+	}
+
+	// Generate requests get the system prompt and history the proxy would
+	// add; chat requests are counted as they are
+	if req.Prompt != "" || req.Suffix != "" {
+		if history, ok := s.contexts.Get(req.Context); ok && len(req.Context) > 0 {
+			messages = append(messages, history...)
+		}
+		if req.Suffix != "" {
+			messages = append(messages, buildFIMMessages(req.Prompt, req.Suffix)...)
+		} else {
+			messages = append(messages, NewUserTextMessage(req.Prompt))
+		}
+		if system, err = s.systemPrompt(in, req.Metadata, system); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+	}
+	if len(messages) == 0 {
+		writeOllamaError(w, http.StatusBadRequest, "prompt or messages is required")
+		return
+	}
+
+	claudeReq := ClaudeRequest{Messages: messages, System: system}
+	in.PromptTokens = estimateRequestTokens(claudeReq)
+	decision := s.route(in, false)
+	claudeReq.Model = decision.Model
+
+	ctx := withRequestInfo(r.Context(), requestInfo{Client: in.Client, Alias: req.Model, Backend: decision.Backend})
+	tokens, source, err := s.countTokens(ctx, decision.Backend, claudeReq, true)
+	resp := countTokensResponse{
+		Model:         req.Model,
+		ClaudeModel:   decision.Model,
+		Backend:       decision.Backend,
+		InputTokens:   tokens,
+		Source:        source,
+		ContextWindow: contextWindow(decision.Model),
+	}
+	if err != nil {
+		resp.UpstreamError = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// contentText returns the text of a system prompt or message content given
+// as a string or as a list of content blocks. Blocks other than text, such
+// as images, are not counted.
+func contentText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var blocks []MessageContent
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", fmt.Errorf("expected a string or a list of content blocks")
+	}
+	var parts []string
+	for _, block := range blocks {
+		if block.Type == "text" {
+			parts = append(parts, block.Text)
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
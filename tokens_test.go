@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newFakeCounter starts a fake Claude API whose count_tokens endpoint
+// answers with count, or fails when count returns a negative number
+func newFakeCounter(t *testing.T, config *Config, count func(ClaudeRequest) int) *[]ClaudeRequest {
+	t.Helper()
+	var counted []ClaudeRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ClaudeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !strings.HasSuffix(r.URL.Path, "/count_tokens") {
+			json.NewEncoder(w).Encode(ClaudeResponse{Type: "message", Role: "assistant", Content: []ClaudeContent{{Type: "text", Text: "ok"}}})
+			return
+		}
+		counted = append(counted, req)
+		tokens := count(req)
+		if tokens < 0 {
+			http.Error(w, `{"type":"error","error":{"type":"overloaded_error"}}`, 529)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int{"input_tokens": tokens})
+	}))
+	t.Cleanup(ts.Close)
+	config.APIEndpoint = ts.URL
+	return &counted
+}
+
+// postCountTokens sends body to /api/count_tokens and decodes the count
+func postCountTokens(t *testing.T, s *Server, body string) (countTokensResponse, *httptest.ResponseRecorder) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/count_tokens", strings.NewReader(body)))
+	var resp countTokensResponse
+	json.Unmarshal(recorder.Body.Bytes(), &resp)
+	return resp, recorder
+}
+
+// Test counting each request shape with the upstream API
+func TestCountTokens(t *testing.T) {
+	config := testConfig()
+	counted := newFakeCounter(t, &config, func(req ClaudeRequest) int { return 7 * len(req.Messages) })
+	s := NewServer(config)
+
+	testCases := []struct {
+		name     string
+		body     string
+		messages int
+		system   string
+	}{
+		{"ollama generate", `{"model": "claude", "prompt": "hi", "system": "be brief"}`, 1, "be brief"},
+		{"ollama chat", `{"model": "claude", "messages": [{"role": "system", "content": "be brief"}, {"role": "user", "content": "hi"}, {"role": "assistant", "content": "hello"}, {"role": "user", "content": "bye"}]}`, 3, "be brief"},
+		{"openai blocks", `{"model": "claude", "messages": [{"role": "developer", "content": "be brief"}, {"role": "user", "content": [{"type": "text", "text": "hi"}]}]}`, 1, "be brief"},
+		{"anthropic", `{"model": "claude", "system": [{"type": "text", "text": "be brief"}], "messages": [{"role": "user", "content": "hi"}]}`, 1, "be brief"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, recorder := postCountTokens(t, s, tc.body)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+			}
+			if resp.InputTokens != 7*tc.messages || resp.Source != tokenSourceUpstream {
+				t.Errorf("Expected %d upstream tokens, got %+v", 7*tc.messages, resp)
+			}
+			if resp.ClaudeModel != s.mapModelName("claude") || resp.ContextWindow != 200000 {
+				t.Errorf("Unexpected model or window: %+v", resp)
+			}
+			last := (*counted)[len(*counted)-1]
+			if !strings.Contains(last.System, tc.system) {
+				t.Errorf("Expected system %q to be counted, got %q", tc.system, last.System)
+			}
+		})
+	}
+
+	for _, body := range []string{
+		`{"model": "claude"}`,
+		`{"model": "claude", "messages": [{"role": "tool", "content": "x"}]}`,
+		`{"model": "claude", "messages": [{"role": "user", "content": 3}]}`,
+	} {
+		if _, recorder := postCountTokens(t, s, body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, recorder.Code)
+		}
+	}
+	if _, recorder := postCountTokens(t, s, `{"model": "llama3", "prompt": "hi"}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown model, got %d", recorder.Code)
+	}
+}
+
+// Test that a failing upstream count falls back to the estimate
+func TestCountTokensFallback(t *testing.T) {
+	config := testConfig()
+	newFakeCounter(t, &config, func(ClaudeRequest) int { return -1 })
+
+	resp, recorder := postCountTokens(t, NewServer(config), `{"model": "claude", "messages": [{"role": "user", "content": "`+strings.Repeat("x", 400)+`"}]}`)
+	if recorder.Code != http.StatusOK || resp.Source != tokenSourceEstimate || resp.UpstreamError == "" {
+		t.Fatalf("Expected an estimate with the upstream error, got %d %+v", recorder.Code, resp)
+	}
+	if resp.InputTokens != 104 {
+		t.Errorf("Expected an estimate of 104 tokens, got %d", resp.InputTokens)
+	}
+}
+
+// Test rejecting and truncating histories that overflow the context window
+func TestFitContextWindow(t *testing.T) {
+	history := func() []Message {
+		var messages []Message
+		for i := 0; i < 10; i++ {
+			messages = append(messages, NewUserTextMessage(strings.Repeat("x", 40000)), NewAssistantTextMessage("ok"))
+		}
+		return append(messages, NewUserTextMessage("latest"))
+	}
+
+	// Counted upstream, each message costs 15000 tokens, so 21 messages
+	// overflow a 200000 token window
+	config := testConfig()
+	config.CountTokensUpstream = true
+	counted := newFakeCounter(t, &config, func(req ClaudeRequest) int { return 15000 * len(req.Messages) })
+	s := NewServer(config)
+	ctx := context.Background()
+
+	req := ClaudeRequest{Model: testModelSonnet35, Messages: history()}
+	_, err := s.fitContextWindow(ctx, BackendAnthropic, &req)
+	if err == nil || !strings.Contains(err.Error(), "prompt is 315000 tokens") {
+		t.Errorf("Expected an exact count in the rejection, got %v", err)
+	}
+	if len(req.Messages) != 21 || len(*counted) != 1 {
+		t.Errorf("Expected the request to be left alone after one count, got %d messages, %d counts", len(req.Messages), len(*counted))
+	}
+
+	config.ContextOverflow = ContextOverflowTruncate
+	s = NewServer(config)
+	req = ClaudeRequest{Model: testModelSonnet35, Messages: history(), MaxTokens: 1000}
+	if _, err := s.fitContextWindow(ctx, BackendAnthropic, &req); err != nil {
+		t.Fatalf("Expected the history to be truncated, got %v", err)
+	}
+	if len(req.Messages) >= 21 || 15000*len(req.Messages)+1000 > 200000 {
+		t.Errorf("Expected the history to fit, got %d messages", len(req.Messages))
+	}
+	if last := req.Messages[len(req.Messages)-1]; last.Content[0].Text != "latest" || req.Messages[0].Role != RoleUser {
+		t.Errorf("Expected the latest turn to be kept and the history to start with a user turn, got %+v", req.Messages)
+	}
+
+	// A single message too long for the window cannot be truncated
+	req = ClaudeRequest{Model: testModelSonnet35, Messages: []Message{NewUserTextMessage("huge")}, MaxTokens: 190000}
+	if _, err := s.fitContextWindow(ctx, BackendAnthropic, &req); err == nil || !strings.Contains(err.Error(), "num_predict 190000") {
+		t.Errorf("Expected a rejection, got %v", err)
+	}
+}
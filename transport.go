@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// newUpstreamClient creates the HTTP client shared by every upstream call.
+// Its transport keeps connections alive across requests, so the pool sizes
+// and timeouts here apply to all backends.
+func newUpstreamClient(config Config) (*http.Client, error) {
+	tlsConfig, err := upstreamTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if config.UpstreamProxy != "" {
+		proxyURL, err := url.Parse(config.UpstreamProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.UpstreamConnectTimeoutSecs) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Duration(config.UpstreamTLSTimeoutSecs) * time.Second,
+		ResponseHeaderTimeout: time.Duration(config.UpstreamResponseHeaderTimeoutSecs) * time.Second,
+		MaxIdleConns:          config.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   config.UpstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.UpstreamMaxConnsPerHost,
+		IdleConnTimeout:       time.Duration(config.UpstreamIdleConnTimeoutSecs) * time.Second,
+		ExpectContinueTimeout: time.Second,
+		// A custom dialer and TLS config turn off HTTP/2 unless asked for
+		ForceAttemptHTTP2: !config.UpstreamDisableHTTP2,
+	}
+	if config.UpstreamDisableHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(config.RequestTimeoutSecs) * time.Second,
+	}, nil
+}
+
+// transportSettings returns the settings newUpstreamClient depends on
+func transportSettings(config Config) interface{} {
+	return []interface{}{
+		config.RequestTimeoutSecs, config.UpstreamProxy, config.UpstreamCAFile,
+		config.UpstreamClientCertFile, config.UpstreamClientKeyFile,
+		config.UpstreamMaxIdleConns, config.UpstreamMaxIdleConnsPerHost, config.UpstreamMaxConnsPerHost,
+		config.UpstreamIdleConnTimeoutSecs, config.UpstreamDisableHTTP2, config.UpstreamConnectTimeoutSecs,
+		config.UpstreamTLSTimeoutSecs, config.UpstreamResponseHeaderTimeoutSecs,
+	}
+}
+
+// upstreamTLSConfig loads the CA bundle and client certificate, if any
+func upstreamTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.UpstreamCAFile != "" {
+		pem, err := os.ReadFile(config.UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA file: %w", err)
+		}
+		// Trust the bundle in addition to the system roots, so that an egress
+		// gateway's CA does not break calls that bypass it
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstream CA file %s contains no certificates", config.UpstreamCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.UpstreamClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.UpstreamClientCertFile, config.UpstreamClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
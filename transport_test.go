@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test that the shared client trusts a custom CA bundle
+func TestUpstreamCAFile(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	config := testConfig()
+	client, err := newUpstreamClient(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := client.Get(upstream.URL); err == nil {
+		t.Fatalf("Expected the test certificate to be untrusted without a CA file")
+	}
+
+	config.UpstreamCAFile = filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := os.WriteFile(config.UpstreamCAFile, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	client, err = newUpstreamClient(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Expected the CA file to be trusted, got %v", err)
+	}
+	resp.Body.Close()
+}
+
+// Test that requests go through an explicitly configured proxy
+func TestUpstreamProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	config := testConfig()
+	config.UpstreamProxy = proxy.URL
+	client, err := newUpstreamClient(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	resp, err := client.Get("http://upstream.invalid/v1/messages")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if proxied != "http://upstream.invalid/v1/messages" {
+		t.Errorf("Expected the request to go through the proxy, got %q", proxied)
+	}
+}
+
+// Test that the client presents the configured client certificate
+func TestUpstreamClientCert(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	config := testConfig()
+	config.UpstreamCAFile = filepath.Join(dir, "ca.pem")
+	config.UpstreamClientCertFile = filepath.Join(dir, "client.pem")
+	config.UpstreamClientKeyFile = filepath.Join(dir, "client-key.pem")
+	os.WriteFile(config.UpstreamCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600)
+	writeTestCertificate(t, "egress-client", config.UpstreamClientCertFile, config.UpstreamClientKeyFile)
+
+	client, err := newUpstreamClient(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the client certificate to be accepted, got status %d", resp.StatusCode)
+	}
+}
+
+// Test validation of the transport settings
+func TestValidateTransport(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(*Config)
+		valid  bool
+	}{
+		{"defaults", func(c *Config) {}, true},
+		{"proxy", func(c *Config) { c.UpstreamProxy = "http://proxy.internal:3128" }, true},
+		{"proxy without scheme", func(c *Config) { c.UpstreamProxy = "proxy.internal:3128" }, false},
+		{"cert without key", func(c *Config) { c.UpstreamClientCertFile = "client.pem" }, false},
+		{"negative timeout", func(c *Config) { c.UpstreamConnectTimeoutSecs = -1 }, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			tc.modify(&config)
+			err := validateTransport(config)
+			if tc.valid && err != nil {
+				t.Errorf("Expected valid config, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key
+func writeTestCertificate(t *testing.T, commonName, certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// How an overflowing history is truncated
+const (
+	TruncationDropOldest = "drop_oldest" // drop the oldest turns
+	TruncationKeepFirst  = "keep_first"  // keep the first exchange and the most recent turns
+	TruncationSummarize  = "summarize"   // replace the oldest turns with a summary
+)
+
+// truncationHeader reports the truncation applied to a request
+const truncationHeader = "X-Proxy-Truncation"
+
+// summaryReserve is the room left for a summary of dropped turns, matching
+// the output limit of summarizeMessages
+const summaryReserve = 1024
+
+// truncation describes the history dropped from a request
+type truncation struct {
+	Strategy string
+	Dropped  int
+}
+
+// String returns the truncation as reported in the response header, or ""
+// if nothing was dropped
+func (t truncation) String() string {
+	if t.Dropped == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s; dropped=%d", t.Strategy, t.Dropped)
+}
+
+// truncateHistory drops messages from req by the configured strategy so
+// that, with reserved tokens, they fit in budget. The latest
+// truncation_keep_messages are always kept. A strategy that cannot apply
+// falls back to dropping the oldest turns.
+func (s *Server) truncateHistory(ctx context.Context, req *ClaudeRequest, reserved, budget int) truncation {
+	messages := req.Messages
+	keep := max(s.config.TruncationKeepMessages, 1)
+	// An assistant prefill only makes sense with the message it answers
+	if messages[len(messages)-1].Role == RoleAssistant {
+		keep = max(keep, 2)
+	}
+
+	switch s.config.TruncationStrategy {
+	case TruncationKeepFirst:
+		if len(messages) > keep+2 && messages[0].Role == RoleUser && messages[1].Role == RoleAssistant {
+			head := messages[:2]
+			headTokens := estimateMessageTokens(head[0]) + estimateMessageTokens(head[1])
+			tail := fitMessages(messages[2:], keep, reserved+headTokens, budget)
+			if dropped := len(messages) - len(head) - len(tail); dropped > 0 && fitsBudget(tail, reserved+headTokens, budget) {
+				req.Messages = append(append([]Message{}, head...), tail...)
+				return truncation{Strategy: TruncationKeepFirst, Dropped: dropped}
+			}
+		}
+
+	case TruncationSummarize:
+		kept := fitMessages(messages, keep, reserved+summaryReserve, budget)
+		if dropped := messages[:len(messages)-len(kept)]; len(dropped) > 0 {
+			summary, err := s.summarizeMessages(ctx, s.truncationSummaryModel(), "", dropped)
+			if err == nil {
+				// The summary goes into the history rather than the system
+				// prompt, so that it is kept with the conversation's context
+				req.Messages = append([]Message{
+					NewUserTextMessage("Summary of the earlier conversation:\n" + summary),
+					NewAssistantTextMessage("Understood."),
+				}, kept...)
+				return truncation{Strategy: TruncationSummarize, Dropped: len(dropped)}
+			}
+			log.Printf("Failed to summarise %d messages, dropping them instead: %v", len(dropped), err)
+		}
+	}
+
+	kept := fitMessages(messages, keep, reserved, budget)
+	req.Messages = kept
+	return truncation{Strategy: TruncationDropOldest, Dropped: len(messages) - len(kept)}
+}
+
+// fitsBudget reports whether messages and reserved tokens fit in budget
+func fitsBudget(messages []Message, reserved, budget int) bool {
+	for _, msg := range messages {
+		reserved += estimateMessageTokens(msg)
+	}
+	return reserved <= budget
+}
+
+// truncationSummaryModel returns the model that summarises dropped turns
+func (s *Server) truncationSummaryModel() string {
+	if s.config.TruncationSummaryModel != "" {
+		return s.config.TruncationSummaryModel
+	}
+	return s.config.SessionSummaryModel
+}
+
+// validateTruncation checks the truncation settings
+func validateTruncation(config Config) error {
+	switch config.ContextOverflow {
+	case ContextOverflowReject, ContextOverflowTruncate:
+	default:
+		return fmt.Errorf("unknown context overflow %q", config.ContextOverflow)
+	}
+
+	switch config.TruncationStrategy {
+	case TruncationDropOldest, TruncationKeepFirst:
+	case TruncationSummarize:
+		if config.TruncationSummaryModel == "" && config.SessionSummaryModel == "" {
+			return fmt.Errorf("truncation strategy %q needs truncation_summary_model or session_summary_model", TruncationSummarize)
+		}
+	default:
+		return fmt.Errorf("unknown truncation strategy %q", config.TruncationStrategy)
+	}
+
+	if config.TruncationKeepMessages < 0 {
+		return fmt.Errorf("truncation keep messages must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// longHistory returns a first exchange, pairs of long user turns and short
+// replies, and a latest user message
+func longHistory(pairs, length int) []Message {
+	messages := []Message{NewUserTextMessage("first question"), NewAssistantTextMessage("first answer")}
+	for i := 0; i < pairs; i++ {
+		messages = append(messages, NewUserTextMessage(strings.Repeat("x", length)), NewAssistantTextMessage("ok"))
+	}
+	return append(messages, NewUserTextMessage("latest"))
+}
+
+// Test each truncation strategy
+func TestTruncateHistory(t *testing.T) {
+	config := testConfig()
+	newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		if strings.HasPrefix(req.System, "Summarise") {
+			return "the user asked many things"
+		}
+		return "ok"
+	})
+	config.TruncationSummaryModel = string(testModelHaiku)
+
+	testCases := []struct {
+		name     string
+		strategy string
+		keep     int
+		check    func(t *testing.T, messages []Message)
+	}{
+		{"drop oldest", TruncationDropOldest, 0, func(t *testing.T, messages []Message) {
+			if messages[0].Content[0].Text == "first question" {
+				t.Errorf("Expected the first exchange to be dropped")
+			}
+		}},
+		{"keep first", TruncationKeepFirst, 0, func(t *testing.T, messages []Message) {
+			if messages[0].Content[0].Text != "first question" || messages[1].Content[0].Text != "first answer" || messages[2].Role != RoleUser {
+				t.Errorf("Expected the first exchange followed by a user turn, got %+v", messages[:3])
+			}
+		}},
+		{"summarize", TruncationSummarize, 0, func(t *testing.T, messages []Message) {
+			if !strings.Contains(messages[0].Content[0].Text, "the user asked many things") || messages[1].Role != RoleAssistant {
+				t.Errorf("Expected a summary exchange first, got %+v", messages[:2])
+			}
+		}},
+		{"keep latest", TruncationDropOldest, 11, func(t *testing.T, messages []Message) {
+			if len(messages) != 11 {
+				t.Errorf("Expected the latest 11 messages to be kept, got %d", len(messages))
+			}
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config.TruncationStrategy = tc.strategy
+			config.TruncationKeepMessages = tc.keep
+			s := NewServer(config)
+
+			req := ClaudeRequest{Messages: longHistory(10, 4000)}
+			applied := s.truncateHistory(context.Background(), &req, 0, 3500)
+			if applied.Strategy != tc.strategy || applied.Dropped == 0 {
+				t.Fatalf("Expected %s to drop messages, got %+v", tc.strategy, applied)
+			}
+			if len(req.Messages)+applied.Dropped != 23 && tc.strategy != TruncationSummarize {
+				t.Errorf("Expected %d kept and %d dropped messages to make 23", len(req.Messages), applied.Dropped)
+			}
+			if last := req.Messages[len(req.Messages)-1]; last.Content[0].Text != "latest" || req.Messages[0].Role != RoleUser {
+				t.Errorf("Expected the latest message kept and a user turn first, got %+v", req.Messages)
+			}
+			if tc.keep == 0 && !fitsBudget(req.Messages, 0, 3500) {
+				t.Errorf("Expected the kept messages to fit the budget")
+			}
+			tc.check(t, req.Messages)
+		})
+	}
+
+	// A fill-in-the-middle prefill is kept with the message it answers
+	s := NewServer(config)
+	req := ClaudeRequest{Messages: buildFIMMessages(strings.Repeat("x", 20000), "")}
+	if applied := s.truncateHistory(context.Background(), &req, 0, 3500); applied.Dropped != 0 || len(req.Messages) != 2 {
+		t.Errorf("Expected a prefilled request to be left alone, got %+v", applied)
+	}
+}
+
+// Test that truncation of a context history is reported in a header
+func TestGenerateTruncation(t *testing.T) {
+	config := testConfig()
+	var sent ClaudeRequest
+	newFakeClaude(t, &config, func(req ClaudeRequest) string {
+		sent = req
+		return "ok"
+	})
+	config.ContextOverflow = ContextOverflowTruncate
+	config.TruncationStrategy = TruncationKeepFirst
+	s := NewServer(config)
+
+	history := longHistory(24, 40000)
+	handle := s.contexts.Put(history[:len(history)-1])
+	body, _ := json.Marshal(OllamaRequest{Model: "claude-2.1", Prompt: "latest", Context: handle})
+	recorder := postGenerate(t, s, string(body))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected the request to be truncated and sent, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if header := recorder.Header().Get(truncationHeader); !strings.HasPrefix(header, "keep_first; dropped=") {
+		t.Errorf("Expected the truncation to be reported, got %q", header)
+	}
+	if len(sent.Messages) >= len(history) || sent.Messages[0].Content[0].Text != "first question" {
+		t.Errorf("Expected a truncated history starting with the first exchange, got %d messages", len(sent.Messages))
+	}
+
+	// Requests that fit are not truncated
+	recorder = postGenerate(t, s, `{"model": "claude", "prompt": "hi"}`)
+	if header := recorder.Header().Get(truncationHeader); header != "" {
+		t.Errorf("Expected no truncation header, got %q", header)
+	}
+}
+
+// Test validation of the truncation settings
+func TestValidateTruncation(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(*Config)
+		valid  bool
+	}{
+		{"defaults", func(c *Config) {}, true},
+		{"keep first", func(c *Config) { c.TruncationStrategy = TruncationKeepFirst }, true},
+		{"summarize with session model", func(c *Config) {
+			c.TruncationStrategy = TruncationSummarize
+			c.SessionSummaryModel = string(testModelHaiku)
+		}, true},
+		{"summarize without model", func(c *Config) { c.TruncationStrategy = TruncationSummarize }, false},
+		{"unknown strategy", func(c *Config) { c.TruncationStrategy = "middle_out" }, false},
+		{"unknown overflow", func(c *Config) { c.ContextOverflow = "ignore" }, false},
+		{"negative keep", func(c *Config) { c.TruncationKeepMessages = -1 }, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			tc.modify(&config)
+			err := validateTruncation(config)
+			if tc.valid && err != nil {
+				t.Errorf("Expected valid config, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModelPrice is the price of a Claude model in USD per million tokens
+type ModelPrice struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheWrite float64 `json:"cache_write"`
+	CacheRead  float64 `json:"cache_read"`
+}
+
+// defaultPrices are Anthropic's list prices, keyed by model ID prefix
+func defaultPrices() map[string]ModelPrice {
+	return map[string]ModelPrice{
+		"claude-3-opus":     {Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.5},
+		"claude-3-sonnet":   {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+		"claude-3-5-sonnet": {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+		"claude-3-7-sonnet": {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+		"claude-3-haiku":    {Input: 0.25, Output: 1.25, CacheWrite: 0.3, CacheRead: 0.03},
+		"claude-3-5-haiku":  {Input: 0.8, Output: 4, CacheWrite: 1, CacheRead: 0.08},
+		"claude-2":          {Input: 8, Output: 24},
+	}
+}
+
+// priceFor returns the price of a model: an exact entry, or else the
+// entry with the longest matching prefix
+func priceFor(prices map[string]ModelPrice, model ModelID) (ModelPrice, bool) {
+	if price, ok := prices[string(model)]; ok {
+		return price, true
+	}
+	var best string
+	for prefix := range prices {
+		if strings.HasPrefix(string(model), prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return prices[best], true
+}
+
+// cost returns the cost of a response's usage in USD
+func (p ModelPrice) cost(usage ClaudeUsage) float64 {
+	return (float64(usage.InputTokens)*p.Input +
+		float64(usage.OutputTokens)*p.Output +
+		float64(usage.CacheCreationInputTokens)*p.CacheWrite +
+		float64(usage.CacheReadInputTokens)*p.CacheRead) / 1e6
+}
+
+// SpendCap limits the monthly spend of a client, an alias, or a client on
+// an alias. Empty fields match everything, so a cap with neither limits
+// total spend.
+type SpendCap struct {
+	Client     string  `json:"client,omitempty"`
+	Alias      string  `json:"alias,omitempty"`
+	MonthlyUSD float64 `json:"monthly_usd"`
+}
+
+// matches reports whether a cap applies to a client and alias
+func (c SpendCap) matches(client, alias string) bool {
+	return (c.Client == "" || c.Client == client) &&
+		(c.Alias == "" || normalizeModelName(c.Alias) == normalizeModelName(alias))
+}
+
+// spendCapError is returned when a request would exceed a spend cap
+type spendCapError struct {
+	Cap   SpendCap
+	Spent float64
+}
+
+func (e *spendCapError) Error() string {
+	scope := "total"
+	switch {
+	case e.Cap.Client != "" && e.Cap.Alias != "":
+		scope = fmt.Sprintf("client %q on %s", e.Cap.Client, e.Cap.Alias)
+	case e.Cap.Client != "":
+		scope = fmt.Sprintf("client %q", e.Cap.Client)
+	case e.Cap.Alias != "":
+		scope = e.Cap.Alias
+	}
+	return fmt.Sprintf("monthly spend cap of $%.2f for %s is exhausted ($%.2f spent)", e.Cap.MonthlyUSD, scope, e.Spent)
+}
+
+// UsageRow is the usage of one client on one alias and model for a day
+type UsageRow struct {
+	Day                      string  `json:"day"`
+	Client                   string  `json:"client"`
+	Alias                    string  `json:"alias"`
+	Model                    ModelID `json:"model"`
+	Requests                 int64   `json:"requests"`
+	InputTokens              int64   `json:"input_tokens"`
+	OutputTokens             int64   `json:"output_tokens"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens"`
+	CostUSD                  float64 `json:"cost_usd"`
+}
+
+func (row UsageRow) key() string {
+	return row.Day + "\x00" + row.Client + "\x00" + row.Alias + "\x00" + string(row.Model)
+}
+
+func (row *UsageRow) add(other UsageRow) {
+	row.Requests += other.Requests
+	row.InputTokens += other.InputTokens
+	row.OutputTokens += other.OutputTokens
+	row.CacheCreationInputTokens += other.CacheCreationInputTokens
+	row.CacheReadInputTokens += other.CacheReadInputTokens
+	row.CostUSD += other.CostUSD
+}
+
+// usageFlushInterval is how often changed usage is written to the usage file
+const usageFlushInterval = 5 * time.Second
+
+// UsageStore accumulates usage and spend by day, client, alias and model
+// and, if path is set, persists it to a JSON file. The totals in memory are
+// authoritative; the file is rewritten in the background when they change
+// and on Close.
+type UsageStore struct {
+	mu     sync.Mutex
+	rows   map[string]*UsageRow
+	prices map[string]ModelPrice
+	caps   []SpendCap
+	path   string
+	now    func() time.Time
+	dirty  bool
+
+	// saveMu serializes writes of the file, which happen outside mu
+	saveMu    sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewUsageStore creates a usage store, loading earlier usage from path if
+// it exists
+func NewUsageStore(config Config) (*UsageStore, error) {
+	store := &UsageStore{
+		rows:   make(map[string]*UsageRow),
+		prices: config.Prices,
+		caps:   config.SpendCaps,
+		path:   config.UsageFile,
+		now:    time.Now,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if store.path == "" {
+		close(store.done)
+		return store, nil
+	}
+
+	data, err := os.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		go store.flushLoop()
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage file: %w", err)
+	}
+
+	var rows []*UsageRow
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, fmt.Errorf("failed to parse usage file: %w", err)
+	}
+	for _, row := range rows {
+		store.rows[row.key()] = row
+	}
+
+	log.Printf("Loaded %d usage rows from %s", len(rows), store.path)
+	go store.flushLoop()
+	return store, nil
+}
+
+// flushLoop writes changed usage every usageFlushInterval until Close
+func (us *UsageStore) flushLoop() {
+	defer close(us.done)
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := us.Flush(); err != nil {
+				log.Printf("Error saving usage: %v", err)
+			}
+		case <-us.stop:
+			return
+		}
+	}
+}
+
+// Flush writes the usage to the usage file if it changed since the last
+// write
+func (us *UsageStore) Flush() error {
+	us.saveMu.Lock()
+	defer us.saveMu.Unlock()
+
+	us.mu.Lock()
+	if us.path == "" || !us.dirty {
+		us.mu.Unlock()
+		return nil
+	}
+	rows := make([]UsageRow, 0, len(us.rows))
+	for _, row := range us.rows {
+		rows = append(rows, *row)
+	}
+	us.dirty = false
+	us.mu.Unlock()
+
+	if err := writeUsageFile(us.path, rows); err != nil {
+		us.mu.Lock()
+		us.dirty = true
+		us.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close stops the background writes and writes any unsaved usage
+func (us *UsageStore) Close() error {
+	us.closeOnce.Do(func() { close(us.stop) })
+	<-us.done
+	return us.Flush()
+}
+
+// Add accounts a response's usage to a client and alias
+func (us *UsageStore) Add(client, alias string, model ModelID, usage ClaudeUsage) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	price, ok := priceFor(us.prices, model)
+	if !ok {
+		log.Printf("No price configured for model %s, recording its usage at no cost", model)
+	}
+
+	row := UsageRow{
+		Day:                      us.now().UTC().Format(time.DateOnly),
+		Client:                   client,
+		Alias:                    normalizeModelName(alias),
+		Model:                    model,
+		Requests:                 1,
+		InputTokens:              int64(usage.InputTokens),
+		OutputTokens:             int64(usage.OutputTokens),
+		CacheCreationInputTokens: int64(usage.CacheCreationInputTokens),
+		CacheReadInputTokens:     int64(usage.CacheReadInputTokens),
+		CostUSD:                  price.cost(usage),
+	}
+
+	if existing, ok := us.rows[row.key()]; ok {
+		existing.add(row)
+	} else {
+		us.rows[row.key()] = &row
+	}
+	us.dirty = true
+}
+
+// SetPricing replaces the price table and spend caps
+func (us *UsageStore) SetPricing(prices map[string]ModelPrice, caps []SpendCap) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.prices = prices
+	us.caps = caps
+}
+
+// CheckCaps returns a spendCapError if a cap applying to the client and
+// alias has been used up this month
+func (us *UsageStore) CheckCaps(client, alias string) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	month := us.now().UTC().Format("2006-01")
+	for _, spendCap := range us.caps {
+		if !spendCap.matches(client, alias) {
+			continue
+		}
+		var spent float64
+		for _, row := range us.rows {
+			if strings.HasPrefix(row.Day, month) && spendCap.matches(row.Client, row.Alias) {
+				spent += row.CostUSD
+			}
+		}
+		if spent >= spendCap.MonthlyUSD {
+			return &spendCapError{Cap: spendCap, Spent: spent}
+		}
+	}
+	return nil
+}
+
+// Report returns the usage between two days inclusive, summed over the
+// dimensions not in groupBy and sorted
+func (us *UsageStore) Report(from, to string, groupBy map[string]bool) []UsageRow {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	grouped := make(map[string]*UsageRow)
+	for _, row := range us.rows {
+		if (from != "" && row.Day < from) || (to != "" && row.Day > to) {
+			continue
+		}
+		g := UsageRow{}
+		if groupBy["day"] {
+			g.Day = row.Day
+		}
+		if groupBy["client"] {
+			g.Client = row.Client
+		}
+		if groupBy["alias"] {
+			g.Alias = row.Alias
+		}
+		if groupBy["model"] {
+			g.Model = row.Model
+		}
+		if existing, ok := grouped[g.key()]; ok {
+			existing.add(*row)
+		} else {
+			g.add(*row)
+			grouped[g.key()] = &g
+		}
+	}
+
+	rows := make([]UsageRow, 0, len(grouped))
+	for _, row := range grouped {
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].key() < rows[j].key() })
+	return rows
+}
+
+// writeUsageFile replaces the usage file with rows
+func writeUsageFile(path string, rows []UsageRow) error {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].key() < rows[j].key() })
+
+	data, err := json.MarshalIndent(rows, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write usage file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write usage file: %w", err)
+	}
+	return nil
+}
+
+// usageBackend accounts the usage of every call to a backend, including
+// streams that fail after the upstream reported usage
+type usageBackend struct {
+	Backend
+	usage   *UsageStore
+	clients map[string]string
+}
+
+// withUsage wraps every backend in usage accounting
+func withUsage(backends map[string]Backend, usage *UsageStore, clients map[string]string) map[string]Backend {
+	wrapped := make(map[string]Backend, len(backends))
+	for name, backend := range backends {
+		wrapped[name] = &usageBackend{Backend: backend, usage: usage, clients: clients}
+	}
+	return wrapped
+}
+
+// Unwrap returns the wrapped backend
+func (b *usageBackend) Unwrap() Backend {
+	return b.Backend
+}
+
+// Send implements Backend
+func (b *usageBackend) Send(ctx context.Context, req ClaudeRequest) (*ClaudeResponse, error) {
+	resp, err := b.Backend.Send(ctx, req)
+	b.account(ctx, req, resp, err)
+	return resp, err
+}
+
+// Stream implements Backend
+func (b *usageBackend) Stream(ctx context.Context, req ClaudeRequest, onText func(string) error) (*ClaudeResponse, error) {
+	resp, err := b.Backend.Stream(ctx, req, onText)
+	b.account(ctx, req, resp, err)
+	return resp, err
+}
+
+// account adds the usage of a response, or the partial usage of a failed
+// stream
+func (b *usageBackend) account(ctx context.Context, req ClaudeRequest, resp *ClaudeResponse, err error) {
+	var usage ClaudeUsage
+	var partial *partialStreamError
+	switch {
+	case resp != nil:
+		usage = resp.Usage
+	case errors.As(err, &partial):
+		usage = partial.usage
+	default:
+		return
+	}
+	info := requestInfoFrom(ctx)
+	b.usage.Add(clientName(b.clients, info.Client), info.Alias, req.Model, usage)
+}
+
+// validateUsage checks the price table and spend caps
+func validateUsage(config Config) error {
+	for model, price := range config.Prices {
+		if price.Input < 0 || price.Output < 0 || price.CacheWrite < 0 || price.CacheRead < 0 {
+			return fmt.Errorf("price for model %q must not be negative", model)
+		}
+	}
+	for i, spendCap := range config.SpendCaps {
+		if spendCap.MonthlyUSD <= 0 {
+			return fmt.Errorf("spend_caps[%d] needs a positive monthly_usd", i)
+		}
+	}
+	return nil
+}
+
+// usageColumns are the CSV columns of a usage report
+var usageColumns = []string{"day", "client", "alias", "model", "requests", "input_tokens", "output_tokens", "cache_creation_input_tokens", "cache_read_input_tokens", "cost_usd"}
+
+// Handle GET /admin/usage. Query parameters: from and to (YYYY-MM-DD,
+// inclusive), group_by (a comma-separated subset of day, client, alias and
+// model; all four by default) and format (json or csv).
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	for _, day := range []string{from, to} {
+		if day == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, day); err != nil {
+			writeOllamaError(w, http.StatusBadRequest, "from and to must be dates like 2024-06-01")
+			return
+		}
+	}
+
+	groupBy := map[string]bool{"day": true, "client": true, "alias": true, "model": true}
+	if value := query.Get("group_by"); value != "" {
+		groupBy = make(map[string]bool)
+		for _, dim := range strings.Split(value, ",") {
+			dim = strings.TrimSpace(dim)
+			switch dim {
+			case "day", "client", "alias", "model":
+				groupBy[dim] = true
+			default:
+				writeOllamaError(w, http.StatusBadRequest, fmt.Sprintf("cannot group by %q", dim))
+				return
+			}
+		}
+	}
+
+	rows := s.usage.Report(from, to, groupBy)
+
+	switch query.Get("format") {
+	case "", "json":
+		var total float64
+		for _, row := range rows {
+			total += row.CostUSD
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Rows         []UsageRow `json:"rows"`
+			TotalCostUSD float64    `json:"total_cost_usd"`
+		}{rows, total})
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write(usageColumns)
+		for _, row := range rows {
+			cw.Write([]string{
+				row.Day, row.Client, row.Alias, string(row.Model),
+				strconv.FormatInt(row.Requests, 10),
+				strconv.FormatInt(row.InputTokens, 10),
+				strconv.FormatInt(row.OutputTokens, 10),
+				strconv.FormatInt(row.CacheCreationInputTokens, 10),
+				strconv.FormatInt(row.CacheReadInputTokens, 10),
+				strconv.FormatFloat(row.CostUSD, 'f', 6, 64),
+			})
+		}
+		cw.Flush()
+	default:
+		writeOllamaError(w, http.StatusBadRequest, "format must be json or csv")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test price lookup by exact ID and longest prefix
+func TestPriceFor(t *testing.T) {
+	prices := map[string]ModelPrice{
+		"claude-3":                 {Input: 1},
+		"claude-3-haiku":           {Input: 2},
+		"claude-3-haiku-20240307":  {Input: 3},
+		"claude-3-5-sonnet-latest": {Input: 4},
+	}
+
+	testCases := []struct {
+		model    ModelID
+		expected float64
+		found    bool
+	}{
+		{"claude-3-haiku-20240307", 3, true},
+		{"claude-3-haiku-20250101", 2, true},
+		{"claude-3-opus-20240229", 1, true},
+		{"claude-2.1", 0, false},
+	}
+
+	for _, tc := range testCases {
+		price, found := priceFor(prices, tc.model)
+		if found != tc.found || price.Input != tc.expected {
+			t.Errorf("priceFor(%s) = %v, %v, expected input price %v", tc.model, price, found, tc.expected)
+		}
+	}
+
+	usage := ClaudeUsage{InputTokens: 1000000, OutputTokens: 100000, CacheCreationInputTokens: 200000, CacheReadInputTokens: 1000000}
+	price := ModelPrice{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3}
+	if cost := price.cost(usage); math.Abs(cost-5.55) > 1e-9 {
+		t.Errorf("Expected a cost of $5.55, got $%f", cost)
+	}
+}
+
+// Test that usage is accounted per client and reported, and that a spend
+// cap rejects requests once it is used up
+func TestUsageAccountingAndCaps(t *testing.T) {
+	config := testConfig()
+	config.UsageFile = filepath.Join(t.TempDir(), "usage.json")
+	config.Prices = map[string]ModelPrice{"claude-3-haiku": {Input: 1000, Output: 1000}}
+	config.ClientNames = map[string]string{"key-a": "team-a"}
+	config.SpendCaps = []SpendCap{{Client: "team-a", MonthlyUSD: 2}}
+	newFakeClaude(t, &config, func(ClaudeRequest) string { return "ok" })
+	server := NewServer(config)
+
+	generate := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model": "claude-3-haiku", "prompt": "hi"}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		recorder := httptest.NewRecorder()
+		server.handleOllamaGenerate(recorder, req)
+		return recorder
+	}
+
+	// Each request costs 1200 tokens at $1000 per million, so $1.20
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusPaymentRequired} {
+		if recorder := generate("key-a"); recorder.Code != expected {
+			t.Fatalf("Request %d: expected status %d, got %d: %s", i+1, expected, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// Other clients are not capped
+	if recorder := generate("key-b"); recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for another client, got %d", http.StatusOK, recorder.Code)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.handleUsage(recorder, httptest.NewRequest(http.MethodGet, "/admin/usage?group_by=client", nil))
+	var report struct {
+		Rows         []UsageRow `json:"rows"`
+		TotalCostUSD float64    `json:"total_cost_usd"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if len(report.Rows) != 2 || math.Abs(report.TotalCostUSD-3.6) > 1e-9 {
+		t.Fatalf("Expected 2 clients costing $3.60, got %+v", report)
+	}
+	teamA := report.Rows[1]
+	if report.Rows[0].Client == "team-a" {
+		teamA = report.Rows[0]
+	}
+	if teamA.Client != "team-a" || teamA.Requests != 2 || teamA.InputTokens != 2000 || teamA.Model != "" {
+		t.Errorf("Unexpected row for team-a: %+v", teamA)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.handleUsage(recorder, httptest.NewRequest(http.MethodGet, "/admin/usage?format=csv", nil))
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ",") != strings.Join(usageColumns, ",") {
+		t.Fatalf("Expected a header and 2 rows, got %v", records)
+	}
+	today := time.Now().UTC().Format(time.DateOnly)
+	if records[1][0] != today || records[1][3] != "claude-3-haiku-20240307" {
+		t.Errorf("Unexpected CSV row %v", records[1])
+	}
+
+	// Usage survives a restart, once written
+	if err := server.usage.Close(); err != nil {
+		t.Fatalf("Failed to save usage: %v", err)
+	}
+	restarted := NewServer(config)
+	if err := restarted.usage.CheckCaps("team-a", "claude-3-haiku"); err == nil {
+		t.Errorf("Expected the reloaded usage to keep team-a over its cap")
+	}
+}
+
+// Test that usage is written in the background rather than on every call,
+// and written on Close
+func TestUsageFlush(t *testing.T) {
+	config := testConfig()
+	config.UsageFile = filepath.Join(t.TempDir(), "usage.json")
+	store, err := NewUsageStore(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	store.Add("team-a", "claude", testModelHaiku, ClaudeUsage{InputTokens: 10})
+	if _, err := os.Stat(config.UsageFile); !os.IsNotExist(err) {
+		t.Errorf("Expected no write on the request path, got %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	reloaded, err := NewUsageStore(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer reloaded.Close()
+	if rows := reloaded.Report("", "", map[string]bool{}); len(rows) != 1 || rows[0].InputTokens != 10 {
+		t.Errorf("Expected the usage to be saved on close, got %+v", rows)
+	}
+}
+
+// Test that a stream failing midway is still accounted with the usage
+// reported before it failed
+func TestUsagePartialStream(t *testing.T) {
+	config := testConfig()
+	config.ClientNames = map[string]string{"key-a": "team-a"}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range testStreamEvents[:3] {
+			fmt.Fprintf(w, "data: %s\n\n", event)
+		}
+	}))
+	defer upstream.Close()
+	config.APIEndpoint = upstream.URL
+	server := NewServer(config)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model": "claude-3-haiku", "prompt": "hi", "stream": true}`))
+	req.Header.Set("Authorization", "Bearer key-a")
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, req)
+	if !strings.Contains(recorder.Body.String(), `"error"`) {
+		t.Fatalf("Expected the stream to end with an error, got %s", recorder.Body.String())
+	}
+
+	rows := server.usage.Report("", "", map[string]bool{"client": true})
+	if len(rows) != 1 || rows[0].Client != "team-a" || rows[0].InputTokens != 12 || rows[0].OutputTokens < 1 {
+		t.Errorf("Expected the partial usage of team-a, got %+v", rows)
+	}
+}
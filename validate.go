@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// requestError is a problem with a request found before any upstream call,
+// with the status to report it with
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// badRequest returns a 400 request error
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// writeRequestError writes err as an Ollama error, using its status if it
+// is a request error and 400 otherwise
+func writeRequestError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		writeOllamaError(w, reqErr.status, reqErr.message)
+		return
+	}
+	writeOllamaError(w, http.StatusBadRequest, err.Error())
+}
+
+// methodNotAllowed answers requests to a route with a method it does not
+// serve
+func methodNotAllowed(allowed string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allowed)
+		writeOllamaError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed, use %s", r.Method, allowed))
+	}
+}
+
+// withBodyLimit caps request bodies at max_request_bytes. Handlers see the
+// cap as a read error.
+func (s *Server) withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.MaxRequestBytes > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxRequestBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeRequest reads a JSON request body into v and returns the raw body.
+// In strict mode a field v does not have is an error. Errors say what is
+// wrong and where, so that clients can fix the request.
+func (s *Server) decodeRequest(r *http.Request, v interface{}) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, &requestError{
+			status:  http.StatusRequestEntityTooLarge,
+			message: fmt.Sprintf("request body is larger than the %d byte limit", tooLarge.Limit),
+		}
+	}
+	if err != nil {
+		return nil, badRequest("failed to read request body: %v", err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, badRequest("missing request body")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if s.config.StrictRequests {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return nil, describeDecodeError(err)
+	}
+	if decoder.More() {
+		return nil, badRequest("invalid JSON: unexpected data after the request object")
+	}
+	return body, nil
+}
+
+// describeDecodeError turns a JSON decoding error into a request error
+// naming the offending field or offset
+func describeDecodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return badRequest("invalid JSON at offset %d: %v", syntaxErr.Offset, syntaxErr)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return badRequest("invalid value for %q: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	case errors.As(err, &typeErr):
+		return badRequest("invalid request: expected a JSON object, got %s", typeErr.Value)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return badRequest("invalid JSON: unexpected end of request body")
+	}
+	// The decoder reports unknown fields only as text
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return badRequest("unknown field %s", field)
+	}
+	return badRequest("invalid request: %v", err)
+}
+
+// validateGenerate checks a generate request before any tokens are spent.
+// A request continuing a session may leave the model to the session.
+func (s *Server) validateGenerate(req *OllamaRequest, session *Session) error {
+	if req.Model == "" && session == nil {
+		return badRequest("model is required")
+	}
+	if req.Model != "" && !s.knownModel(req.Model) {
+		return &requestError{status: http.StatusNotFound, message: fmt.Sprintf("model %q not found", req.Model)}
+	}
+
+	options := req.Options
+	if options.Temperature < 0 || options.Temperature > 1 {
+		return badRequest("options.temperature must be between 0 and 1, got %g", options.Temperature)
+	}
+	if options.TopP < 0 || options.TopP > 1 {
+		return badRequest("options.top_p must be between 0 and 1, got %g", options.TopP)
+	}
+	if options.TopK < 0 {
+		return badRequest("options.top_k must not be negative, got %d", options.TopK)
+	}
+	// Ollama uses -1 for no limit and -2 for filling the context, which
+	// leave the limit to the backend here
+	if options.NumPredict < -2 {
+		return badRequest("options.num_predict must be positive, -1 or -2, got %d", options.NumPredict)
+	}
+	if options.NumPredict < 0 {
+		req.Options.NumPredict = 0
+	}
+	for i, stop := range options.Stop {
+		if stop == "" {
+			return badRequest("options.stop[%d] must not be empty", i)
+		}
+	}
+	return nil
+}
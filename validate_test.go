@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postGenerate sends body to /api/generate through the full handler
+func postGenerate(t *testing.T, s *Server, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	s.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body)))
+	return recorder
+}
+
+// ollamaError decodes the error message of an Ollama error response
+func ollamaError(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected an Ollama error, got %q", recorder.Body.String())
+	}
+	return body.Error
+}
+
+// Test that bad requests are rejected with precise errors before any
+// upstream call
+func TestGenerateValidation(t *testing.T) {
+	config := testConfig()
+	calls := 0
+	newFakeClaude(t, &config, func(ClaudeRequest) string {
+		calls++
+		return "ok"
+	})
+	config.StrictRequests = true
+	config.MaxRequestBytes = 4096
+	s := NewServer(config)
+
+	testCases := []struct {
+		name   string
+		body   string
+		status int
+		error  string
+	}{
+		{"empty body", ``, http.StatusBadRequest, "missing request body"},
+		{"syntax", `{"model": "claude",}`, http.StatusBadRequest, "invalid JSON at offset"},
+		{"truncated", `{"model": "claude"`, http.StatusBadRequest, "unexpected end"},
+		{"wrong type", `{"model": "claude", "prompt": "hi", "options": {"temperature": "hot"}}`, http.StatusBadRequest, `"options.temperature"`},
+		{"not an object", `["claude"]`, http.StatusBadRequest, "expected a JSON object"},
+		{"trailing data", `{"model": "claude", "prompt": "hi"} {}`, http.StatusBadRequest, "unexpected data"},
+		{"unknown field", `{"model": "claude", "prompt": "hi", "promt": "typo"}`, http.StatusBadRequest, `unknown field "promt"`},
+		{"no model", `{"prompt": "hi"}`, http.StatusBadRequest, "model is required"},
+		{"unknown model", `{"model": "llama3", "prompt": "hi"}`, http.StatusNotFound, `model "llama3" not found`},
+		{"unknown session", `{"session_id": "nope", "prompt": "hi"}`, http.StatusNotFound, `session "nope" not found`},
+		{"temperature", `{"model": "claude", "prompt": "hi", "options": {"temperature": 1.5}}`, http.StatusBadRequest, "options.temperature"},
+		{"top_p", `{"model": "claude", "prompt": "hi", "options": {"top_p": -0.1}}`, http.StatusBadRequest, "options.top_p"},
+		{"num_predict", `{"model": "claude", "prompt": "hi", "options": {"num_predict": -5}}`, http.StatusBadRequest, "options.num_predict"},
+		{"stop", `{"model": "claude", "prompt": "hi", "options": {"stop": ["\n", ""]}}`, http.StatusBadRequest, "options.stop[1]"},
+		{"too large", `{"model": "claude", "prompt": "` + strings.Repeat("x", 5000) + `"}`, http.StatusRequestEntityTooLarge, "4096 byte limit"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := postGenerate(t, s, tc.body)
+			if recorder.Code != tc.status {
+				t.Errorf("Expected status %d, got %d: %s", tc.status, recorder.Code, recorder.Body.String())
+			}
+			if message := ollamaError(t, recorder); !strings.Contains(message, tc.error) {
+				t.Errorf("Expected an error containing %q, got %q", tc.error, message)
+			}
+		})
+	}
+	if calls != 0 {
+		t.Errorf("Expected no upstream calls, got %d", calls)
+	}
+
+	// Outside strict mode unknown fields are ignored, as Ollama does
+	config.StrictRequests = false
+	if recorder := postGenerate(t, NewServer(config), `{"model": "claude", "prompt": "hi", "images": []}`); recorder.Code != http.StatusOK {
+		t.Errorf("Expected unknown fields to be ignored, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// Test that only POST is accepted
+func TestGenerateMethod(t *testing.T) {
+	recorder := get(t, NewServer(testConfig()).Handler(), http.MethodGet, "/api/generate", nil)
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("Expected 405 allowing POST, got %d %v", recorder.Code, recorder.Header())
+	}
+	if message := ollamaError(t, recorder); !strings.Contains(message, "method GET not allowed") {
+		t.Errorf("Unexpected error %q", message)
+	}
+}
+
+// Test that an empty prompt loads the model without calling upstream, as
+// in Ollama
+func TestGenerateEmptyPrompt(t *testing.T) {
+	config := testConfig()
+	calls := 0
+	newFakeClaude(t, &config, func(ClaudeRequest) string {
+		calls++
+		return "ok"
+	})
+
+	recorder := postGenerate(t, NewServer(config), `{"model": "claude"}`)
+	var resp OllamaResponse
+	json.Unmarshal(recorder.Body.Bytes(), &resp)
+	if recorder.Code != http.StatusOK || !resp.Done || resp.DoneReason != "load" || calls != 0 {
+		t.Errorf("Expected a load response without upstream calls, got %d %s (%d calls)", recorder.Code, recorder.Body.String(), calls)
+	}
+}
+
+// Test that prompts estimated to overflow the context window are rejected
+func TestGenerateContextWindow(t *testing.T) {
+	config := testConfig()
+	calls := 0
+	newFakeClaude(t, &config, func(ClaudeRequest) string {
+		calls++
+		return "ok"
+	})
+	s := NewServer(config)
+
+	body, _ := json.Marshal(OllamaRequest{Model: "claude-2.1", Prompt: strings.Repeat("word ", 90000)})
+	recorder := postGenerate(t, s, string(body))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(ollamaError(t, recorder), "100000 token context window") {
+		t.Errorf("Expected a context window error, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	body, _ = json.Marshal(OllamaRequest{Model: "claude", Prompt: strings.Repeat("word ", 1000), Options: OllamaOptions{NumPredict: 199000}})
+	recorder = postGenerate(t, s, string(body))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(ollamaError(t, recorder), "num_predict 199000") {
+		t.Errorf("Expected the output budget to count, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if calls != 0 {
+		t.Errorf("Expected no upstream calls, got %d", calls)
+	}
+}